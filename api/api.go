@@ -16,9 +16,12 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/tetratelabs/car/internal"
@@ -30,6 +33,13 @@ const (
 	MediaTypeOCIImageLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
 	MediaTypeOCIImageManifest = "application/vnd.oci.image.manifest.v1+json"
 
+	// MediaTypeOCIImageLayerUncompressed is a tar layer that isn't compressed.
+	MediaTypeOCIImageLayerUncompressed = "application/vnd.oci.image.layer.v1.tar"
+
+	// MediaTypeOCIImageLayerZstd is a layer compressed with zstd, such as one
+	// built with "docker buildx build --output type=image,compression=zstd".
+	MediaTypeOCIImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
 	MediaTypeDockerContainerImage = "application/vnd.docker.container.image.v1+json"
 	MediaTypeDockerImageLayer     = "application/vnd.docker.image.rootfs.diff.tar.gzip"
 	MediaTypeDockerManifest       = "application/vnd.docker.distribution.manifest.v2+json"
@@ -69,10 +79,26 @@ const (
 type Reference interface {
 	internal.CarOnly
 
+	// Domain is the registry host, e.g. "ghcr.io", "oci:${dir}" for an OCI
+	// image layout directory or "docker-archive:${file}" for a "docker save"
+	// archive.
 	Domain() string
+
+	// Path is the repository in the registry, e.g. "envoyproxy/envoy". This
+	// is empty for an OCI image layout directory. For a "docker save"
+	// archive, this includes the domain of the repository, e.g.
+	// "index.docker.io/envoyproxy/envoy", or is empty.
 	Path() string
+
+	// Tag is the possibly empty tag, e.g. "v1.18.3". This is only empty when
+	// Digest is not, except in an OCI image layout directory or "docker save"
+	// archive, where it selects its only image.
 	Tag() string
 
+	// Digest is the possibly empty manifest digest the reference is pinned
+	// to, e.g. "sha256:5d0da3dc976460b72c77d94c8a1ad043720b0416bfc16c52c45d4847e53fadb6".
+	Digest() string
+
 	fmt.Stringer
 }
 
@@ -88,16 +114,70 @@ type Registry interface {
 	//   - path: the image path which must include at least one slash, possibly
 	//     more than two. The only paths allowed to exclude a slash are DockerHub
 	//     official images like "alpine"
-	//   - platform: possibly empty Image.Platform qualifier.
+	//   - platform: possibly empty Image.Platform qualifier. A variant may be
+	//     omitted when only one matches, e.g. "linux/arm64" selects
+	//     "linux/arm64/v8". An os.version, or its leading fields, can be
+	//     added in parentheses, e.g. "windows(10.0.17763)/amd64". Otherwise,
+	//     the latest os.version is chosen.
 	//
 	// # Errors
 	//
-	//   - there is no image manifest
-	//   - The platform parameter is empty, but there is more than one platform
-	//     choice in the image.
-	//   - The platform parameter does not match a platform in the image.
+	//   - there is no image manifest, e.g. a RegistryError that is ErrNotFound
+	//   - AmbiguousPlatformError when the platform parameter is empty, but
+	//     there is more than one platform choice in the image.
+	//   - UnsupportedPlatformError when the platform parameter does not match
+	//     a platform in the image.
+	//   - ErrNoPlatform when the image config doesn't say its platform.
+	//   - AmbiguousImageError when the reference has no tag, but there is more
+	//     than one image in a "docker save" archive.
+	//   - UnsupportedMediaTypeError when the manifest or config isn't an image.
+	//   - DigestMismatchError when a manifest or config doesn't match the
+	//     digest it was referenced by.
 	GetImage(ctx context.Context, ref Reference, platform string) (Image, error)
 
+	// ListPlatforms returns the platforms of an image tag without choosing
+	// one. For a multi-platform image, these are in the order of its image
+	// index, excluding attestation manifests, such as those added by
+	// "docker buildx build". Otherwise, this is the only platform, from the
+	// image config.
+	//
+	// # Errors
+	//
+	//   - there is no image index or manifest, e.g. a RegistryError that is
+	//     ErrNotFound
+	//   - DigestMismatchError when an index, manifest or config doesn't match
+	//     the digest it was referenced by.
+	ListPlatforms(ctx context.Context, ref Reference) ([]Platform, error)
+
+	// ListTags returns the tags of the repository of the reference, which
+	// can have no tag. These are in the order of the registry, usually
+	// lexical, following any pages of results.
+	//
+	// In a "docker save" archive without a repository, these are each of its
+	// "RepoTags", e.g. "envoyproxy/envoy:v1.18.3".
+	//
+	// # Errors
+	//
+	//   - the repository doesn't exist, e.g. a RegistryError that is
+	//     ErrNotFound
+	ListTags(ctx context.Context, ref Reference) ([]string, error)
+
+	// Resolve returns the descriptor of the image index or manifest the
+	// reference points to, without reading it. For a remote registry, this
+	// is a HEAD request, which Docker Hub doesn't count against its pull rate
+	// limit. Compare the digest to a previous one to know if a tag moved.
+	//
+	// In a "docker save" archive, this is the image config, as its digest is
+	// the image ID and there is no manifest.
+	//
+	// # Errors
+	//
+	//   - there is no image index or manifest, e.g. a RegistryError that is
+	//     ErrNotFound
+	//   - the registry doesn't return the optional "Docker-Content-Digest"
+	//     header for a tag, as reading the content instead would be a pull.
+	Resolve(ctx context.Context, ref Reference) (Descriptor, error)
+
 	// ReadFilesystemLayer iterates over the files in the "tar.gz" represented
 	// by a FilesystemLayer
 	//
@@ -109,21 +189,92 @@ type Registry interface {
 	// # Errors
 	//
 	//   - The readFile parameter returned an error.
+	//   - DigestMismatchError when the layer content doesn't match its digest.
+	//     As the layer is streamed, this is only known after readFile has
+	//     been called for each file.
 	ReadFilesystemLayer(ctx context.Context, layer FilesystemLayer, readFile ReadFile) error
 }
 
+// Descriptor describes content by its digest, such as an image index or
+// manifest a tag points to.
+//
+// See https://github.com/opencontainers/image-spec/blob/master/descriptor.md
+type Descriptor struct {
+	// MediaType is the media type of the content.
+	// e.g. MediaTypeOCIImageIndex
+	MediaType string `json:"mediaType"`
+
+	// Digest is the digest of the content, which changes when it does.
+	// e.g. "sha256:5d0da3dc976460b72c77d94c8a1ad043720b0416bfc16c52c45d4847e53fadb6"
+	Digest string `json:"digest"`
+
+	// Size is the size in bytes of the content.
+	Size int64 `json:"size"`
+}
+
+// Platform describes an image manifest for a specific platform, such as one
+// in an image index, a.k.a. multi-platform image. Fields are empty when
+// unknown.
+//
+// See https://github.com/opencontainers/image-spec/blob/master/image-index.md#image-index-property-descriptions
+type Platform struct {
+	// OS is the operating system, typically runtime.GOOS. e.g. "linux"
+	OS string `json:"os"`
+
+	// Architecture is the CPU architecture, typically runtime.GOARCH.
+	// e.g. "arm64"
+	Architecture string `json:"architecture"`
+
+	// Variant is the variant of the CPU. e.g. "v7" for "linux/arm/v7"
+	Variant string `json:"variant,omitempty"`
+
+	// OSVersion is the version of the operating system, usually only set on
+	// Windows. e.g. "10.0.17763.1879"
+	OSVersion string `json:"os.version,omitempty"`
+
+	// OSFeatures are required features of the operating system.
+	// e.g. "win32k"
+	OSFeatures []string `json:"os.features,omitempty"`
+
+	// Digest is the digest of the image manifest, which can be used in a
+	// reference to pin the platform. Empty when the image has no manifest,
+	// e.g. in a "docker save" archive.
+	Digest string `json:"digest,omitempty"`
+
+	// MediaType is the media type of the image manifest.
+	// e.g. MediaTypeOCIImageManifest
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Size is the size in bytes of the image manifest.
+	Size int64 `json:"size,omitempty"`
+}
+
 // ReadFile is a callback for each selected file in the FilesystemLayer. This
-// is only called on regular files, which means it doesn't support tracking the
-// directory that contains them. As this is usually backed by a tar file, it is
-// possible the same name will be encountered more than once. It is also
-// possible files are filtered out.
+// is called on regular files, directories, symbolic links and hard links, but
+// not on other types, such as devices. As this is usually backed by a tar
+// file, it is possible the same name will be encountered more than once. It
+// is also possible files are filtered out.
+//
+// Whiteout files, such as "dir/.wh.foo" or "dir/.wh..wh..opq", are passed
+// through. These mark files deleted from lower layers, so are only relevant
+// when combining layers.
+//
+// See https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
 //
 // # Parameters
 //
 // The parameters correspond with tar.Header fields and are unaltered when this
 // is backed by a tar. The reader argument optionally reads from the current
 // file until io.EOF. Use the size argument to be more precise.
-type ReadFile func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error
+//
+// The type of the file is in the mode, as returned by tar.Header FileInfo:
+//   - os.ModeDir for a directory, e.g. name="usr/lib/"
+//   - os.ModeSymlink for a symbolic link, where linkName is its target,
+//     e.g. name="usr/lib/libfoo.so", linkName="libfoo.so.1"
+//   - otherwise, a regular file, or a hard link when linkName is non-empty.
+//     A hard link's linkName is the name of a file earlier in the same layer,
+//     e.g. name="usr/bin/vi", linkName="usr/bin/vim"
+type ReadFile func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error
 
 // Image represents filesystem layers that make up an image on a specific
 // Platform, parsed from the OCI manifest and
@@ -135,7 +286,8 @@ type Image interface {
 	internal.CarOnly
 
 	// Platform is the potentially empty platform. When present, this is
-	// typically 'runtime.GOOS/runtime.GOARCH'. e.g. "darwin/amd64"
+	// typically 'runtime.GOOS/runtime.GOARCH'. e.g. "darwin/amd64", possibly
+	// with a variant. e.g. "linux/arm/v7"
 	Platform() string
 
 	// FilesystemLayerCount is the count of layers, used to loop.
@@ -144,9 +296,58 @@ type Image interface {
 	// FilesystemLayer returns a FilesystemLayer given its index or nil if invalid.
 	FilesystemLayer(int) FilesystemLayer
 
+	// ManifestDigest is the possibly empty digest of the image manifest, e.g.
+	// the one a tag resolved to. This is empty when the image wasn't read
+	// from a manifest, e.g. in a "docker save" archive.
+	ManifestDigest() string
+
+	// ManifestMediaType is the possibly empty media type of the image
+	// manifest, e.g. MediaTypeOCIImageManifest.
+	ManifestMediaType() string
+
+	// IndexDigest is the possibly empty digest of the image index (a.k.a.
+	// manifest list) the manifest was chosen from, by platform. This is empty
+	// when the tag resolved directly to a manifest.
+	IndexDigest() string
+
+	// Config is how a container is meant to run the image. This is empty
+	// when the image configuration doesn't have one, e.g. a wasm module.
+	Config() ImageConfig
+
 	fmt.Stringer
 }
 
+// ImageConfig is the "config" field of the image configuration, which is the
+// same as "Config" in "docker inspect". Fields are empty when unset.
+//
+// See https://github.com/opencontainers/image-spec/blob/master/config.md#properties
+type ImageConfig struct {
+	// User is the user name or UID, optionally with a group, that runs the
+	// process. e.g. "nobody" or "1000:1000"
+	User string `json:"User,omitempty"`
+
+	// Env are environment variables in the format "NAME=value".
+	// e.g. "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	Env []string `json:"Env,omitempty"`
+
+	// Entrypoint is the command to run, before any Cmd arguments.
+	// e.g. ["/docker-entrypoint.sh"]
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+
+	// Cmd are the default arguments to the Entrypoint, or the command to run
+	// when Entrypoint is empty. e.g. ["envoy", "-c", "/etc/envoy/envoy.yaml"]
+	Cmd []string `json:"Cmd,omitempty"`
+
+	// WorkingDir is the working directory of the process. e.g. "/app"
+	WorkingDir string `json:"WorkingDir,omitempty"`
+
+	// Labels are arbitrary metadata, such as the pre-defined annotation keys.
+	// e.g. "org.opencontainers.image.version"
+	//
+	// See https://github.com/opencontainers/image-spec/blob/master/annotations.md#pre-defined-annotation-keys
+	Labels map[string]string `json:"Labels,omitempty"`
+}
+
 // FilesystemLayer is a reference to a non-empty, possibly zipped layer.
 //
 // See https://github.com/opencontainers/image-spec/blob/master/layer.md
@@ -158,6 +359,8 @@ type FilesystemLayer interface {
 	// # Examples
 	//
 	//   - MediaTypeOCIImageLayer
+	//   - MediaTypeOCIImageLayerUncompressed
+	//   - MediaTypeOCIImageLayerZstd
 	//   - MediaTypeModuleWasmImageLayer
 	MediaType() string
 
@@ -175,5 +378,258 @@ type FilesystemLayer interface {
 	// FileName is present when not a tar.
 	FileName() string
 
+	// Digest is the digest of the layer as stored, e.g. compressed. Layers
+	// shared between images have the same digest.
+	// e.g. "sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f"
+	Digest() string
+
+	// DiffID is the possibly empty digest of the uncompressed layer, from
+	// "rootfs.diff_ids" in the image configuration. This is the same as
+	// Digest when the layer is uncompressed, and is what tools such as
+	// vulnerability scanners usually report.
+	DiffID() string
+
+	// Annotations are the possibly nil annotations of the layer descriptor.
+	// e.g. "org.opencontainers.image.title", which is also the FileName.
+	Annotations() map[string]string
+
 	fmt.Stringer
 }
+
+// DigestMismatchError is returned when content read from a registry doesn't
+// hash to the digest it was addressed by. For example, a layer corrupted by a
+// CDN or tampered with in transit.
+//
+// See https://github.com/opencontainers/image-spec/blob/master/descriptor.md#digests
+type DigestMismatchError struct {
+	// Expected is the digest the content was requested by.
+	Expected string
+
+	// Actual is the digest of the content read.
+	Actual string
+}
+
+// Error implements error
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, but was %s", e.Expected, e.Actual)
+}
+
+// Sentinel errors to use with errors.Is, to tell common failures apart
+// without parsing their messages. For example, a tag that doesn't exist from a
+// registry that denies access.
+var (
+	// ErrNotFound is when a repository, tag, digest, platform or file doesn't
+	// exist. This includes RegistryError, NotFoundError and
+	// UnsupportedPlatformError.
+	ErrNotFound = errors.New("not found")
+
+	// ErrUnauthorized is when a registry denies access, such as a private
+	// repository read without credentials, or with the wrong ones.
+	//
+	// Note: Some registries, such as Docker Hub, deny access to a repository
+	// that doesn't exist instead of saying it isn't found.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrRateLimited is when a registry refuses a request because too many
+	// were made, e.g. Docker Hub's pull rate limit.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrNoPlatform is when an image config has no OS or architecture, which
+	// could be a sign of a bug in its JSON.
+	ErrNoPlatform = errors.New("image config contains no platform information")
+)
+
+// RegistryError is returned when a registry responds with an unexpected
+// status code, after any retries.
+//
+// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+type RegistryError struct {
+	// URL is the URL requested.
+	URL string
+
+	// StatusCode is the HTTP status code of the response.
+	// e.g. 404
+	StatusCode int
+
+	// Errors are the possibly empty errors in the response body.
+	Errors []RegistryErrorDetail
+}
+
+// RegistryErrorDetail is an error in the body of a registry response.
+type RegistryErrorDetail struct {
+	// Code is the error code defined by the distribution spec.
+	// e.g. "MANIFEST_UNKNOWN"
+	Code string `json:"code"`
+
+	// Message is the possibly empty message of the registry.
+	// e.g. "manifest unknown"
+	Message string `json:"message"`
+}
+
+// Error implements error
+func (e *RegistryError) Error() string {
+	msg := fmt.Sprintf("received %v status code from %q", e.StatusCode, e.URL)
+	for i, d := range e.Errors {
+		if i == 0 {
+			msg += ": "
+		} else {
+			msg += ", "
+		}
+		msg += d.Code
+		if d.Message != "" {
+			msg += " " + d.Message
+		}
+	}
+	return msg
+}
+
+// Is allows errors.Is to match ErrNotFound, ErrUnauthorized or
+// ErrRateLimited by status code or error code.
+func (e *RegistryError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || e.hasCode("BLOB_UNKNOWN", "MANIFEST_UNKNOWN", "NAME_UNKNOWN")
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden ||
+			e.hasCode("UNAUTHORIZED", "DENIED")
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests || e.hasCode("TOOMANYREQUESTS")
+	default:
+		return false
+	}
+}
+
+func (e *RegistryError) hasCode(codes ...string) bool {
+	for _, d := range e.Errors {
+		for _, code := range codes {
+			if d.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NotFoundError is returned when something doesn't exist where it was looked
+// for, e.g. a tag in a "docker save" archive or a file in a layer. Use
+// errors.Is with ErrNotFound to match any not found error.
+type NotFoundError struct {
+	// What is what wasn't found.
+	// e.g. "index.docker.io/user/repo:v2.0"
+	What string
+
+	// Where is the possibly empty place it was looked for.
+	// e.g. "envoy.tar"
+	Where string
+}
+
+// Error implements error
+func (e *NotFoundError) Error() string {
+	if e.Where == "" {
+		return e.What + " not found"
+	}
+	return e.What + " not found in " + e.Where
+}
+
+// Is allows errors.Is to match ErrNotFound.
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// AmbiguousPlatformError is returned when a platform wasn't chosen, or is
+// missing a variant, but more than one in the image matches.
+type AmbiguousPlatformError struct {
+	// Platforms are the candidates, sorted.
+	// e.g. ["linux/amd64", "linux/arm64"]
+	Platforms []string
+}
+
+// Error implements error
+func (e *AmbiguousPlatformError) Error() string {
+	return "choose a platform: " + strings.Join(e.Platforms, ", ")
+}
+
+// AmbiguousImageError is returned when an image wasn't chosen, but a "docker
+// save" archive has more than one.
+type AmbiguousImageError struct {
+	// Images are the repository tags of the candidates, sorted.
+	// e.g. ["alpine:3.14.0", "user/repo:v1.0"]
+	Images []string
+}
+
+// Error implements error
+func (e *AmbiguousImageError) Error() string {
+	return "choose an image: " + strings.Join(e.Images, ", ")
+}
+
+// UnsupportedPlatformError is returned when no platform in the image matches
+// the one chosen. Use errors.Is with ErrNotFound to match it along with other
+// not found errors.
+type UnsupportedPlatformError struct {
+	// Platform is the one chosen.
+	// e.g. "linux/s390x"
+	Platform string
+
+	// Platforms are those in the image, sorted.
+	// e.g. ["linux/amd64", "linux/arm64"]
+	Platforms []string
+}
+
+// Error implements error
+func (e *UnsupportedPlatformError) Error() string {
+	return fmt.Sprintf("%s is not a supported platform: %s", e.Platform, strings.Join(e.Platforms, ", "))
+}
+
+// Is allows errors.Is to match ErrNotFound.
+func (e *UnsupportedPlatformError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// UnsupportedMediaTypeError is returned when a manifest or config has a media
+// type this library can't read, e.g. a Helm chart.
+type UnsupportedMediaTypeError struct {
+	// MediaType is the media type of the content.
+	// e.g. "application/vnd.cncf.helm.config.v1+json"
+	MediaType string
+
+	// URL is where the content was read from.
+	URL string
+}
+
+// Error implements error
+func (e *UnsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("unknown mediaType %s from %s", e.MediaType, e.URL)
+}
+
+// RetryPolicy is how requests to a registry are retried when they fail with a
+// status like "429 Too Many Requests" or "503 Service Unavailable", or a
+// transient network error, such as a connection reset.
+//
+// The delay before each retry doubles, with jitter, unless the response has a
+// "Retry-After" header. Retries stop early when the delay would pass the
+// context deadline.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// One or less disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.
+	// e.g. time.Second
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits the delay between attempts. When a server asks for
+	// longer with "Retry-After", the attempt's error is returned instead of
+	// waiting, e.g. a RegistryError that is ErrRateLimited.
+	// e.g. 30 * time.Second
+	MaxBackoff time.Duration
+
+	// OnRetry is called, if set, before waiting to retry a failed attempt,
+	// e.g. to log it.
+	OnRetry func(url string, attempt int, delay time.Duration, err error)
+}
+
+// DefaultRetryPolicy returns the policy used unless another is in the
+// context, e.g. from car.ContextWithRetryPolicy.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+}
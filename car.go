@@ -18,6 +18,7 @@ import (
 	"context"
 
 	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/httpclient"
 	"github.com/tetratelabs/car/internal/reference"
 	"github.com/tetratelabs/car/internal/registry"
 )
@@ -25,11 +26,28 @@ import (
 // ParseReference is a simplified parser of OCI references that handle Docker
 // familiar images. This is not strict, so a bad url will result in an HTTP
 // error.
+//
+// A reference prefixed with "oci:" is an OCI image layout directory, e.g.
+// "oci:./build:v1.0". One prefixed with "docker-archive:" is a "docker save"
+// archive, e.g. "docker-archive:envoy.tar:envoyproxy/envoy:v1.18.3".
 func ParseReference(ref string) (r api.Reference, err error) {
 	return reference.Parse(ref)
 }
 
+// ParseRepository is like ParseReference, except the tag is optional, as it
+// is for api.Registry ListTags. e.g. "envoyproxy/envoy"
+func ParseRepository(ref string) (r api.Reference, err error) {
+	return reference.ParseRepository(ref)
+}
+
 // NewRegistry returns a new api.Registry appropriate for a Domain in an api.Reference.
 func NewRegistry(ctx context.Context, refDomain string) (api.Registry, error) {
 	return registry.New(ctx, refDomain)
 }
+
+// ContextWithRetryPolicy returns a context that retries requests of registries
+// with the policy instead of api.DefaultRetryPolicy. For example, to log each
+// retry, or to disable retries with a MaxAttempts of one.
+func ContextWithRetryPolicy(ctx context.Context, policy api.RetryPolicy) context.Context {
+	return httpclient.ContextWithRetryPolicy(ctx, policy)
+}
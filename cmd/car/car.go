@@ -24,21 +24,35 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/tetratelabs/car"
 	"github.com/tetratelabs/car/api"
 	internalcar "github.com/tetratelabs/car/internal/car"
+	"github.com/tetratelabs/car/internal/osversion"
+	"github.com/tetratelabs/car/internal/registry/auth"
+	"github.com/tetratelabs/car/internal/registry/cache"
 )
 
 const (
+	flagCacheDir         = "cache-dir"
+	flagCacheSize        = "cache-size"
 	flagCreatedByPattern = "created-by-pattern"
 	flagDirectory        = "directory"
 	flagExtract          = "extract"
 	flagFastRead         = "fast-read"
+	flagInspect          = "inspect"
+	flagJSON             = "json"
 	flagList             = "list"
+	flagListPlatforms    = "list-platforms"
+	flagParallel         = "parallel"
+	flagPermissive       = "permissive"
 	flagPlatform         = "platform"
 	flagReference        = "reference"
+	flagResolve          = "resolve"
+	flagSquash           = "squash"
 	flagStripComponents  = "strip-components"
+	flagTags             = "tags"
 	flagVerbose          = "verbose"
 	flagVeryVerbose      = "very-verbose"
 )
@@ -50,16 +64,26 @@ USAGE:
    car [global options] [arguments...]
 
 GLOBAL OPTIONS:
+   --cache-dir value            Cache manifests, configs and layers by digest in this directory, to reuse them across runs. (default: $CAR_CACHE_DIR)
+   --cache-size value           Evict the least recently used content when the cache is larger than this many megabytes. (default: unbounded)
    --created-by-pattern value   regular expression to match the 'created_by' field of image layers
    --directory value, -C value  Change to [directory] before extracting files (default: .)
    --extract, -x                Extract the image filesystem layers. (default: false)
    --fast-read, -q              Extract or list only the first archive entry that matches each pattern or filename operand. (default: false)
+   --inspect                    Print the image configuration as JSON, such as its entrypoint, environment and labels. (default: false)
+   --json                       Print --list-platforms or --resolve as JSON instead of a table. (default: false)
    --list, -t                   List image filesystem layers to stdout. (default: false)
-   --platform value             Required when multi-architecture. e.g. linux/arm64, darwin/amd64 or windows/amd64
-   --reference value, -f value  OCI reference to list or extract files from. e.g. envoyproxy/envoy:v1.18.3 or ghcr.io/homebrew/core/envoy:1.18.3-1
+   --list-platforms             List the platforms of the image, without choosing one. (default: false)
+   --parallel value             Download up to this many layers at once, into temporary files. Files are still read in layer order, and only the content of those read is kept. (default: 1)
+   --permissive                 Skip files that would be extracted outside the directory, instead of failing. (default: false)
+   --platform value             Required when multi-architecture. e.g. linux/arm64, linux/arm/v7, darwin/amd64, windows(10.0.17763)/amd64 or all to list or extract each platform
+   --reference value, -f value  OCI reference to list or extract files from. e.g. envoyproxy/envoy:v1.18.3, ghcr.io/homebrew/core/envoy:1.18.3-1, oci:./dir:tag or docker-archive:image.tar:repo:tag
+   --resolve                    Print the digest, media type and size of the image index or manifest, using HEAD requests only. (default: false)
+   --squash                     List or extract the files a container would see, applying deletions from later layers. Layers are read once, top-most first, keeping the content of matching files in temporary files until all are read. (default: false)
    --strip-components value     Strip NUMBER leading components from file names on extraction. (default: NUMBER)
+   --tags value                 List the tags of a repository, oldest version first, e.g. envoyproxy/envoy. Arguments filter tags like file names, e.g. 'v1.18.*'
    --verbose, -v                Produce verbose output. In extract mode, this will list each file name as it is extracted.In list mode, this produces output similar to ls. (default: false)
-   --very-verbose, --vv         Produce very verbose output. This produces arg header for each image layer and file details similar to ls. (default: false)
+   --very-verbose, --vv         Produce very verbose output. This produces arg header for each image layer and file details similar to ls, and prints retries and credential lookup errors to stderr. (default: false)
 
 `
 
@@ -83,6 +107,14 @@ func doMain(
 	var help bool
 	flag.BoolVar(&help, "h", false, "print usage")
 
+	cacheDir := os.Getenv("CAR_CACHE_DIR")
+	flag.StringVar(&cacheDir, flagCacheDir, cacheDir,
+		"Cache manifests, configs and layers by digest in this directory, to reuse them across runs.")
+
+	var cacheSize uint
+	flag.UintVar(&cacheSize, flagCacheSize, 0,
+		"Evict the least recently used content when the cache is larger than this many megabytes.")
+
 	createdByPattern := createdByPatternValue{}
 	flag.Var(&createdByPattern, flagCreatedByPattern,
 		"regular expression to match the 'created_by' field of image layers")
@@ -103,25 +135,57 @@ func doMain(
 		flag.BoolVar(&fastRead, n, false, "Extract or list only the first archive entry that matches each pattern or filename operand.")
 	}
 
+	var inspect bool
+	flag.BoolVar(&inspect, flagInspect, false,
+		"Print the image configuration as JSON, such as its entrypoint, environment and labels.")
+
+	var asJSON bool
+	flag.BoolVar(&asJSON, flagJSON, false,
+		fmt.Sprintf("Print --%s or --%s as JSON instead of a table.", flagListPlatforms, flagResolve))
+
 	var list bool
 	for _, n := range []string{flagList, "t"} {
 		flag.BoolVar(&list, n, false, "List image filesystem layers to stdout. (default: false).")
 	}
 
+	var listPlatforms bool
+	flag.BoolVar(&listPlatforms, flagListPlatforms, false,
+		"List the platforms of the image, without choosing one.")
+
+	var parallel uint
+	flag.UintVar(&parallel, flagParallel, 1,
+		"Download up to this many layers at once, into temporary files. Files are still read in layer order, and only the content of those read is kept.")
+
+	var permissive bool
+	flag.BoolVar(&permissive, flagPermissive, false,
+		"Skip files that would be extracted outside the directory, instead of failing.")
+
 	var platform platformValue
 	flag.Var(&platform, flagPlatform,
-		"Required when multi-architecture. e.g. linux/arm64, darwin/amd64 or windows/amd64")
+		"Required when multi-architecture. e.g. linux/arm64, linux/arm/v7, darwin/amd64, windows(10.0.17763)/amd64 or all to list or extract each platform")
 
 	imageRef := referenceValue{}
 	for _, n := range []string{flagReference, "f"} {
 		flag.Var(&imageRef, n,
-			"OCI reference to list or extract files from. e.g. envoyproxy/envoy:v1.18.3 or ghcr.io/homebrew/core/envoy:1.18.3-1")
+			"OCI reference to list or extract files from. e.g. envoyproxy/envoy:v1.18.3, ghcr.io/homebrew/core/envoy:1.18.3-1, oci:./dir:tag or docker-archive:image.tar:repo:tag")
 	}
 
+	var resolve bool
+	flag.BoolVar(&resolve, flagResolve, false,
+		"Print the digest, media type and size of the image index or manifest, using HEAD requests only.")
+
+	var squash bool
+	flag.BoolVar(&squash, flagSquash, false,
+		"List or extract the files a container would see, applying deletions from later layers. Layers are read once, top-most first, keeping the content of matching files in temporary files until all are read.")
+
 	var stripComponents uint
 	flag.UintVar(&stripComponents, flagStripComponents, 0,
 		"Strip NUMBER leading components from file names on extraction.")
 
+	tagsRef := repositoryValue{}
+	flag.Var(&tagsRef, flagTags,
+		"List the tags of a repository, oldest version first, e.g. envoyproxy/envoy. Arguments filter tags like file names, e.g. 'v1.18.*'")
+
 	var verbose bool
 	for _, n := range []string{flagVerbose, "v"} {
 		flag.BoolVar(&verbose, n, false, "Produce verbose output. In extract mode, this will list each file name as it is extracted."+
@@ -130,7 +194,7 @@ func doMain(
 
 	var veryVerbose bool
 	for _, n := range []string{flagVeryVerbose, "vv"} {
-		flag.BoolVar(&veryVerbose, n, false, "Produce very verbose output. This produces arg header for each image layer and file details similar to ls.")
+		flag.BoolVar(&veryVerbose, n, false, "Produce very verbose output. This produces arg header for each image layer and file details similar to ls, and prints retries and credential lookup errors to stderr.")
 	}
 
 	if err := flag.Parse(unBundleFlags(os.Args[1:])); err != nil {
@@ -141,7 +205,27 @@ func doMain(
 	} else {
 		createdByPattern := createdByPattern.p
 		ref := imageRef.r
+		if tagsRef.r != nil {
+			if ref != nil {
+				fmt.Fprintf(stderr, "you cannot combine flags [%s] and [%s]\n%s", flagTags, flagReference, usage)
+				exit(1)
+			}
+			ref = tagsRef.r
+		}
 
+		if veryVerbose { // stderr, as retries can happen while layers are read in the background
+			policy := api.DefaultRetryPolicy()
+			policy.OnRetry = func(url string, attempt int, delay time.Duration, err error) {
+				fmt.Fprintf(stderr, "retrying %s in %s after attempt %d: %v\n", url, delay.Round(time.Millisecond), attempt, err)
+			}
+			ctx = car.ContextWithRetryPolicy(ctx, policy)
+			ctx = auth.ContextWithOnLookupError(ctx, func(host string, err error) {
+				fmt.Fprintf(stderr, "continuing without credentials for %s: %v\n", host, err)
+			})
+		}
+		if cacheDir != "" {
+			ctx = cache.ContextWithCache(ctx, cache.New(cacheDir, int64(cacheSize)<<20))
+		}
 		r, err := newRegistry(ctx, ref.Domain())
 		if err != nil {
 			fmt.Fprintln(stderr, "error:", err)
@@ -156,16 +240,43 @@ func doMain(
 			fastRead,
 			verbose,
 			veryVerbose,
+			squash,
+			int(parallel),
 		)
 
-		if list {
-			if extract {
-				fmt.Fprintf(stderr, "you cannot combine flags [%s] and [%s]\n%s", flagList, flagExtract, usage)
-				exit(1)
+		var modes []string // only one of these can be chosen
+		for _, m := range []struct {
+			flag string
+			set  bool
+		}{
+			{flagInspect, inspect},
+			{flagListPlatforms, listPlatforms},
+			{flagResolve, resolve},
+			{flagTags, tagsRef.r != nil},
+			{flagList, list},
+			{flagExtract, extract},
+		} {
+			if m.set {
+				modes = append(modes, m.flag)
 			}
+		}
+		if len(modes) > 1 {
+			fmt.Fprintf(stderr, "you cannot combine flags [%s] and [%s]\n%s", modes[0], modes[1], usage)
+			exit(1)
+		}
+
+		if inspect {
+			err = car.Inspect(ctx, ref, string(platform))
+		} else if listPlatforms {
+			err = car.ListPlatforms(ctx, ref, asJSON)
+		} else if resolve {
+			err = car.Resolve(ctx, ref, asJSON)
+		} else if tagsRef.r != nil {
+			err = car.ListTags(ctx, ref)
+		} else if list {
 			err = car.List(ctx, ref, string(platform))
 		} else if extract {
-			err = car.Extract(ctx, ref, string(platform), string(directory), int(stripComponents))
+			err = car.Extract(ctx, ref, string(platform), string(directory), int(stripComponents), permissive)
 		}
 		if err != nil {
 			fmt.Fprintln(stderr, "error:", err)
@@ -231,6 +342,24 @@ func (r *referenceValue) String() string {
 	return r.r.String()
 }
 
+// repositoryValue is like referenceValue, except the tag is optional.
+type repositoryValue struct {
+	r api.Reference
+}
+
+// Set implements flag.Value
+func (r *repositoryValue) Set(val string) (err error) {
+	r.r, err = car.ParseRepository(val)
+	return
+}
+
+func (r *repositoryValue) String() string {
+	if r.r == nil {
+		return ""
+	}
+	return r.r.String()
+}
+
 type platformValue string
 
 // Set implements flag.Value
@@ -238,9 +367,14 @@ func (p *platformValue) Set(val string) error {
 	if val == "" { // optional
 		return nil
 	}
-	s := strings.Split(val, "/")
-	if len(s) != 2 {
-		return errors.New("should be 2 / delimited fields")
+	if val == internalcar.AllPlatforms {
+		*p = platformValue(val)
+		return nil
+	}
+	platform, _ := osversion.Split(val) // e.g. "windows(10.0.17763)/amd64"
+	s := strings.Split(platform, "/")
+	if len(s) != 2 && len(s) != 3 { // os/architecture[/variant]
+		return errors.New("should be 2 or 3 / delimited fields")
 	}
 	*p = platformValue(val)
 	return nil
@@ -17,13 +17,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/httpclient"
+	"github.com/tetratelabs/car/internal/registry/cache"
 	"github.com/tetratelabs/car/internal/registry/fake"
 )
 
@@ -68,7 +72,7 @@ func Test_doMain(t *testing.T) {
 			name:           "invalid platform value",
 			args:           []string{"car", "--platform", "icecream", "-tf", "tetratelabs/car:v1.0"},
 			expectedStatus: 1,
-			expectedStderr: "invalid value \"icecream\" for flag -platform: should be 2 / delimited fields\n" + usage,
+			expectedStderr: "invalid value \"icecream\" for flag -platform: should be 2 or 3 / delimited fields\n" + usage,
 		},
 		{
 			name:           "missing created-by-pattern value",
@@ -106,12 +110,123 @@ func Test_doMain(t *testing.T) {
 			expectedStatus: 1,
 			expectedStderr: "you cannot combine flags [list] and [extract]\n" + usage,
 		},
+		{
+			name:           "inspect and list",
+			args:           []string{"car", "--inspect", "-tf", "tetratelabs/car:v1.0"},
+			expectedStatus: 1,
+			expectedStderr: "you cannot combine flags [inspect] and [list]\n" + usage,
+		},
+		{
+			name:           "list-platforms and extract",
+			args:           []string{"car", "--list-platforms", "-xf", "tetratelabs/car:v1.0"},
+			expectedStatus: 1,
+			expectedStderr: "you cannot combine flags [list-platforms] and [extract]\n" + usage,
+		},
+		{
+			name: "list-platforms",
+			args: []string{"car", "--list-platforms", "-f", "tetratelabs/car:v1.0"},
+			expectedStdout: `PLATFORM       OS VERSION       OS FEATURES  DIGEST                                                                   SIZE
+linux/amd64                                  sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17  1234
+windows/amd64  10.0.17763.1879  win32k       sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129  2345
+`,
+		},
+		{
+			name:           "resolve and list",
+			args:           []string{"car", "--resolve", "-tf", "tetratelabs/car:v1.0"},
+			expectedStatus: 1,
+			expectedStderr: "you cannot combine flags [resolve] and [list]\n" + usage,
+		},
+		{
+			name: "resolve",
+			args: []string{"car", "--resolve", "-f", "tetratelabs/car:v1.0"},
+			expectedStdout: `sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68	application/vnd.docker.distribution.manifest.list.v2+json	743
+`,
+		},
+		{
+			name: "resolve json",
+			args: []string{"car", "--resolve", "--json", "-f", "tetratelabs/car:v1.0"},
+			expectedStdout: `{
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "digest": "sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68",
+  "size": 743
+}
+`,
+		},
+		{
+			name:           "tags and reference",
+			args:           []string{"car", "--tags", "tetratelabs/car", "-tf", "tetratelabs/car:v1.0"},
+			expectedStatus: 1,
+			expectedStderr: "you cannot combine flags [tags] and [reference]\n" + usage,
+		},
+		{
+			name:           "tags and list",
+			args:           []string{"car", "--tags", "tetratelabs/car", "-t"},
+			expectedStatus: 1,
+			expectedStderr: "you cannot combine flags [tags] and [list]\n" + usage,
+		},
+		{
+			name: "tags",
+			args: []string{"car", "--tags", "tetratelabs/car", "v1.*"},
+			expectedStdout: `v1.0-rc1
+v1.0
+v1.9.0
+v1.10.0
+`,
+		},
+		{
+			name: "inspect",
+			args: []string{"car", "--inspect", "-f", "tetratelabs/car:v1.0"},
+			expectedStdout: `{
+  "User": "nobody",
+  "Env": [
+    "PATH=/usr/local/bin:/usr/bin:/bin"
+  ],
+  "Entrypoint": [
+    "/usr/local/bin/car"
+  ],
+  "Cmd": [
+    "--help"
+  ],
+  "WorkingDir": "/",
+  "Labels": {
+    "org.opencontainers.image.version": "v1.0"
+  }
+}
+`,
+		},
 		{
 			name: "list",
 			args: []string{"car", "-tf", "tetratelabs/car:v1.0"},
 			expectedStdout: `bin/apple.txt
+usr/local/bin/
+usr/local/bin/boat
+usr/local/boat
+usr/local/bin/car
+usr/local/bin/van
+Files/ProgramData/truck/bin/truck.exe
+usr/local/sbin/car
+`,
+		},
+		{
+			name: "list layers in parallel",
+			args: []string{"car", "--parallel", "3", "-tf", "tetratelabs/car:v1.0"},
+			expectedStdout: `bin/apple.txt
+usr/local/bin/
 usr/local/bin/boat
+usr/local/boat
+usr/local/bin/car
+usr/local/bin/van
+Files/ProgramData/truck/bin/truck.exe
+usr/local/sbin/car
+`,
+		},
+		{
+			name: "list squash",
+			args: []string{"car", "--squash", "-tf", "tetratelabs/car:" + fake.WhiteoutsTag},
+			expectedStdout: `usr/local/bin/
+usr/local/boat
 usr/local/bin/car
+usr/local/bin/van
 Files/ProgramData/truck/bin/truck.exe
 usr/local/sbin/car
 `,
@@ -121,6 +236,7 @@ usr/local/sbin/car
 			args: []string{"car", "-tf", "tetratelabs/car:v1.0", "usr/local/bin/*"},
 			expectedStdout: `usr/local/bin/boat
 usr/local/bin/car
+usr/local/bin/van
 `,
 		},
 		{
@@ -129,6 +245,7 @@ usr/local/bin/car
 			expectedStatus: 1,
 			expectedStdout: `usr/local/bin/boat
 usr/local/bin/car
+usr/local/bin/van
 `,
 			expectedStderr: `error: robots not found in layer
 `,
@@ -138,6 +255,7 @@ usr/local/bin/car
 			args: []string{"car", "--created-by-pattern", "ADD", "-tf", "tetratelabs/car:v1.0", "usr/local/bin/*"},
 			expectedStdout: `usr/local/bin/boat
 usr/local/bin/car
+usr/local/bin/van
 `,
 		},
 		{
@@ -162,9 +280,102 @@ usr/local/bin/car
 	}
 }
 
+func Test_doMain_Cache(t *testing.T) {
+	tests := []struct {
+		name, env string
+		args      []string
+		expected  *cache.Cache
+	}{
+		{
+			name: "no cache",
+			args: []string{"car", "-tf", "tetratelabs/car:v1.0"},
+		},
+		{
+			name:     "environment",
+			env:      "/var/cache/car",
+			args:     []string{"car", "-tf", "tetratelabs/car:v1.0"},
+			expected: cache.New("/var/cache/car", 0),
+		},
+		{
+			name:     "flag instead of environment",
+			env:      "/var/cache/car",
+			args:     []string{"car", "--cache-dir", "cache", "-tf", "tetratelabs/car:v1.0"},
+			expected: cache.New("cache", 0),
+		},
+		{
+			name:     "size in megabytes",
+			args:     []string{"car", "--cache-dir", "cache", "--cache-size", "2", "-tf", "tetratelabs/car:v1.0"},
+			expected: cache.New("cache", 2<<20),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("CAR_CACHE_DIR", tc.env)
+
+			var c *cache.Cache
+			exitCode, _, stderr := runMainWithRegistry(t, "", tc.args, func(ctx context.Context, host string) (api.Registry, error) {
+				c = cache.FromContext(ctx)
+				return fake.Registry, nil
+			})
+
+			require.Empty(t, stderr)
+			require.Zero(t, exitCode)
+			require.Equal(t, tc.expected, c)
+		})
+	}
+}
+
+func Test_doMain_Retries(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		expectedStderr string
+	}{
+		{
+			name: "not printed",
+			args: []string{"car", "-tf", "tetratelabs/car:v1.0"},
+		},
+		{
+			name:           "printed when very verbose",
+			args:           []string{"car", "-tvvf", "tetratelabs/car:v1.0"},
+			expectedStderr: "retrying https://ghcr.io/v2/ in 1.5s after attempt 1: received 503 status code\n",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, stderr := runMainWithRegistry(t, "", tc.args, func(ctx context.Context, host string) (api.Registry, error) {
+				if onRetry := httpclient.RetryPolicyFromContext(ctx).OnRetry; onRetry != nil {
+					onRetry("https://ghcr.io/v2/", 1, 1500*time.Millisecond, errors.New("received 503 status code"))
+				}
+				return fake.Registry, nil
+			})
+			require.Equal(t, tc.expectedStderr, stderr)
+		})
+	}
+}
+
 func runMain(t *testing.T, workdir string, args []string) (int, string, string) {
 	t.Helper()
 
+	return runMainWithRegistry(t, workdir, args, func(ctx context.Context, host string) (api.Registry, error) {
+		return fake.Registry, nil
+	})
+}
+
+func runMainWithRegistry(
+	t *testing.T,
+	workdir string,
+	args []string,
+	newRegistry func(ctx context.Context, host string) (api.Registry, error),
+) (int, string, string) {
+	t.Helper()
+
 	// Use a workdir override if supplied.
 	if workdir != "" {
 		oldcwd, err := os.Getwd()
@@ -193,9 +404,7 @@ func runMain(t *testing.T, workdir string, args []string) (int, string, string)
 		}()
 		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
-		doMain(context.Background(), func(ctx context.Context, host string) (api.Registry, error) {
-			return fake.Registry, nil
-		}, &stdout, &stderr, func(code int) {
+		doMain(context.Background(), newRegistry, &stdout, &stderr, func(code int) {
 			exitCode = code
 			panic(code) // to exit the func and set the exit status.
 		})
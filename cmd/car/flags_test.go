@@ -124,13 +124,21 @@ func Test_platformValue(t *testing.T) {
 		{name: "solaris/amd64"},
 		{name: "windows/s390x"}, // permit unlikely arch
 		{name: "wasm32/wasi"},   // permit reverse order platform
+		{name: "linux/arm/v7"},  // variant
+		{name: "linux/arm64/v8"},
+		{name: "all"},
+		{name: "windows(10.0.17763)/amd64"}, // os.version
 		{
 			name:        "darwin",
-			expectedErr: `should be 2 / delimited fields`,
+			expectedErr: `should be 2 or 3 / delimited fields`,
 		},
 		{
-			name:        "darwin/amd64/11.3",
-			expectedErr: `should be 2 / delimited fields`,
+			name:        "windows(10.0.17763)",
+			expectedErr: `should be 2 or 3 / delimited fields`,
+		},
+		{
+			name:        "linux/arm/v7/extra",
+			expectedErr: `should be 2 or 3 / delimited fields`,
 		},
 	}
 
@@ -186,6 +194,40 @@ func Test_referenceValue(t *testing.T) {
 	}
 }
 
+// Test_repositoryValue only covers a couple cases to avoid duplicating tests
+// in the reference package.
+func Test_repositoryValue(t *testing.T) {
+	tests := []struct{ name, reference, expectedDomain, expectedPath, expectedErr string }{
+		{
+			name:           "docker familiar",
+			reference:      "envoyproxy/envoy",
+			expectedDomain: "index.docker.io",
+			expectedPath:   "envoyproxy/envoy",
+		},
+		{
+			name:        "empty",
+			reference:   "",
+			expectedErr: "invalid reference format",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			var r repositoryValue
+			err := r.Set(tc.reference)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expectedDomain, r.r.Domain())
+				require.Equal(t, tc.expectedPath, r.r.Path())
+			}
+		})
+	}
+}
+
 func Test_createdByPatternValue(t *testing.T) {
 	tests := []struct {
 		name            string
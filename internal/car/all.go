@@ -0,0 +1,132 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/osversion"
+)
+
+// AllPlatforms is a platform parameter that lists or extracts each platform
+// of an image, instead of choosing one.
+const AllPlatforms = "all"
+
+// platformDirectory returns the subdirectory to extract a platform into,
+// e.g. "linux_arm64_v8" for "linux/arm64/v8".
+func platformDirectory(platform string) string {
+	return strings.ReplaceAll(platform, "/", "_")
+}
+
+// forEachPlatform calls fn for each platform of the image, with a copy of the
+// car that prefixes each line of output with the platform.
+//
+// When the platform has a manifest digest, the reference passed to fn is
+// pinned to it and the platform is empty, so the image index isn't read
+// again.
+func (c *car) forEachPlatform(ctx context.Context, ref api.Reference, fn func(c *car, ref api.Reference, platform, name string) error) error {
+	platforms, err := c.registry.ListPlatforms(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]int{} // index of each platform in chosen
+	var chosen []api.Platform
+	for _, p := range platforms {
+		if p.OS == "" {
+			continue // e.g. an image index entry without a platform, which can't be chosen.
+		}
+		name := path.Join(p.OS, p.Architecture, p.Variant)
+		if i, ok := seen[name]; ok { // like GetImage, choose the latest os.version
+			if osversion.Compare(p.OSVersion, chosen[i].OSVersion) >= 0 {
+				chosen[i] = p
+			}
+			continue
+		}
+		seen[name] = len(chosen)
+		chosen = append(chosen, p)
+	}
+
+	for _, p := range chosen {
+		name := path.Join(p.OS, p.Architecture, p.Variant)
+		pc := *c
+		pc.out = &prefixWriter{w: c.out, prefix: []byte(name + "\t")}
+
+		pRef, platform := ref, name
+		if p.Digest != "" {
+			pRef, platform = pinnedReference{Reference: ref, digest: p.Digest}, ""
+		}
+		if err = fn(&pc, pRef, platform, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pinnedReference is a reference pinned to the manifest digest of a platform.
+type pinnedReference struct {
+	api.Reference
+
+	digest string
+}
+
+// Digest implements the same method as documented on api.Reference
+func (r pinnedReference) Digest() string {
+	return r.digest
+}
+
+// String implements fmt.Stringer
+func (r pinnedReference) String() string {
+	return r.Reference.String() + "@" + r.digest
+}
+
+// prefixWriter writes a prefix at the start of each line, e.g. the platform.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	// midLine is true when the last write didn't end with a newline.
+	midLine bool
+}
+
+// Write implements io.Writer
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		if !p.midLine {
+			if _, err := p.w.Write(p.prefix); err != nil {
+				return n, err
+			}
+			p.midLine = true
+		}
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+			p.midLine = false
+		}
+		written, err := p.w.Write(line)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[len(line):]
+	}
+	return n, nil
+}
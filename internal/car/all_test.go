@@ -0,0 +1,110 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/internal/reference"
+	"github.com/tetratelabs/car/internal/registry/fake"
+)
+
+func TestList_AllPlatforms(t *testing.T) {
+	tests := []struct {
+		name, reference          string
+		verbose                  bool
+		expectedOut, expectedErr string
+	}{
+		{
+			name:      "normal",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			expectedOut: `linux/amd64	usr/local/bin/car
+windows/amd64	usr/local/bin/car
+`,
+		},
+		{
+			name:      "verbose",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			verbose:   true,
+			expectedOut: `linux/amd64	-rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
+windows/amd64	-rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
+`,
+		},
+		{
+			name:        "tag not found",
+			reference:   "ghcr.io/tetratelabs/car:v2.0",
+			expectedErr: "tag v2.0 not found",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := New(fake.Registry, &stdout, nil, []string{"usr/local/bin/car"}, false, tc.verbose, false, false, 1)
+
+			if err := c.List(context.Background(), reference.MustParse(tc.reference), AllPlatforms); tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedOut, stdout.String())
+		})
+	}
+}
+
+func TestExtract_AllPlatforms(t *testing.T) {
+	ref := reference.MustParse("ghcr.io/tetratelabs/car:v1.0")
+	var stdout bytes.Buffer
+	c := New(fake.Registry, &stdout, nil, []string{"usr/local/bin/car"}, false, false, false, false, 1)
+
+	directory := t.TempDir()
+	require.NoError(t, c.Extract(context.Background(), ref, AllPlatforms, directory, 0, false))
+	require.Empty(t, stdout.String())
+
+	for _, platform := range []string{"linux_amd64", "windows_amd64"} {
+		stat, err := os.Stat(filepath.Join(directory, platform, "usr/local/bin/car"))
+		require.NoError(t, err)
+		require.Equal(t, int64(30), stat.Size())
+	}
+}
+
+func TestPlatformDirectory(t *testing.T) {
+	require.Equal(t, "linux_amd64", platformDirectory("linux/amd64"))
+	require.Equal(t, "linux_arm_v7", platformDirectory("linux/arm/v7"))
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := &prefixWriter{w: &b, prefix: []byte("linux/amd64\t")}
+
+	for _, s := range []string{"bin/", "apple.txt\nusr/", "\n", "", "a\nb\n"} {
+		n, err := w.Write([]byte(s))
+		require.NoError(t, err)
+		require.Equal(t, len(s), n)
+	}
+	require.Equal(t, `linux/amd64	bin/apple.txt
+linux/amd64	usr/
+linux/amd64	a
+linux/amd64	b
+`, b.String())
+}
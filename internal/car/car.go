@@ -16,12 +16,16 @@ package car
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/tetratelabs/car/api"
@@ -39,6 +43,9 @@ type Car interface {
 	internal.CarOnly
 
 	// List prints any non-filtered files from the image layers of the given tag and platform.
+	//
+	// When platform is AllPlatforms, this lists each platform of the image, prefixing each line with the platform.
+	//   Ex platform=all -> "linux/arm64\tusr/bin/tar"
 	List(ctx context.Context, ref api.Reference, platform string) error
 
 	// Extract writes any non-filtered files from the image layers of the given tag and platform into the directory.
@@ -48,7 +55,34 @@ type Car interface {
 	//   Ex directory=v1.0, stripComponents=1, name=/usr/bin/tar -> v1.0/bin/tar
 	//   Ex directory=v1.0, stripComponents=2, name=/usr/bin/tar -> v1.0/tar
 	//   Ex directory=v1.0, stripComponents=4, name=/usr/bin/tar -> ignored because too many path components
-	Extract(ctx context.Context, ref api.Reference, platform, directory string, stripComponents int) error
+	//
+	// Files are never written outside the directory. Symbolic links extracted earlier are followed as if the directory
+	// were the root, and a name outside it is an error, unless permissive is true, which skips it instead.
+	//   Ex directory=v1.0, name=../etc/cron.d/x -> error
+	//   Ex directory=v1.0, name=var/run/x, where var/run -> /run -> v1.0/run/x
+	//
+	// When platform is AllPlatforms, this extracts each platform of the image into a subdirectory named after it.
+	//   Ex directory=v1.0, platform=all, name=/usr/bin/tar -> v1.0/linux_arm64/usr/bin/tar
+	Extract(ctx context.Context, ref api.Reference, platform, directory string, stripComponents int, permissive bool) error
+
+	// Inspect prints the configuration of the image of the given tag and platform as JSON, like the "Config" field of
+	// "docker inspect". This doesn't read any layers.
+	Inspect(ctx context.Context, ref api.Reference, platform string) error
+
+	// ListPlatforms prints the platforms of the image of the given tag, as a table or JSON when asJSON is true. This
+	// doesn't choose a platform, so is how to find the values allowed by the platform parameter of other methods.
+	ListPlatforms(ctx context.Context, ref api.Reference, asJSON bool) error
+
+	// ListTags prints the tags of the repository of the reference, which can have no tag. Tags are filtered by any
+	// patterns, like file names, and printed oldest version first, so that "v1.10.0" is after "v1.9.0".
+	//   Ex patterns=["v1.18.*"] -> "v1.18.0" ... "v1.18.10"
+	ListTags(ctx context.Context, ref api.Reference) error
+
+	// Resolve prints the digest, media type and size of the image index or manifest of the given tag, as a line of
+	// tab-separated values or JSON when asJSON is true. This doesn't read the content, so is how to check if a tag
+	// moved without counting against pull rate limits.
+	//   Ex ref=ghcr.io/tetratelabs/car:v1.0 -> "sha256:...	application/vnd.docker.distribution.manifest.list.v2+json	743"
+	Resolve(ctx context.Context, ref api.Reference, asJSON bool) error
 }
 
 type car struct {
@@ -60,10 +94,19 @@ type car struct {
 	// filePatterns just like tar. Ex "car -tf image:tag foo/* bar.txt"
 	filePatterns                   []string
 	fastRead, verbose, veryVerbose bool
+	// squash applies whiteouts across layers, so that each file is read once,
+	// as a running container would see it.
+	squash bool
+	// parallel is how many layers to read at once, unless squashing. Files
+	// are still read in layer order.
+	parallel int
 }
 
 // New creates a new instance of Car
-func New(registry api.Registry, out io.Writer, createdByPattern *regexp.Regexp, patterns []string, fastRead, verbose, veryVerbose bool) Car {
+//
+// When parallel is more than one, that many layers are read at once into temporary files, which only keep the
+// content of files matching the patterns.
+func New(registry api.Registry, out io.Writer, createdByPattern *regexp.Regexp, patterns []string, fastRead, verbose, veryVerbose, squash bool, parallel int) Car {
 	return &car{
 		registry:         registry,
 		out:              out,
@@ -72,69 +115,102 @@ func New(registry api.Registry, out io.Writer, createdByPattern *regexp.Regexp,
 		fastRead:         fastRead,
 		verbose:          verbose || veryVerbose,
 		veryVerbose:      veryVerbose,
+		squash:           squash,
+		parallel:         parallel,
 	}
 }
 
-func (c *car) do(ctx context.Context, readFile api.ReadFile, ref api.Reference, platform string) error {
+// do calls readFile for each matching file in the layers of the image. When
+// readsContent is false, readFile ignores the reader, e.g. to list files.
+func (c *car) do(ctx context.Context, readFile api.ReadFile, readsContent bool, ref api.Reference, platform string) error {
 	filteredLayers, err := c.getFilesystemLayers(ctx, ref, platform)
 	if err != nil {
 		return err
 	}
 	pm := patternmatcher.New(c.filePatterns, c.fastRead)
-	rf := func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error {
+	if c.squash {
+		err = c.readSquashed(ctx, filteredLayers, pm, readFile, readsContent)
+	} else {
+		err = c.readLayers(ctx, filteredLayers, pm, readFile, readsContent)
+	}
+	if err != nil {
+		return err
+	}
+	unmatched := pm.Unmatched()
+	if len(unmatched) > 0 {
+		return &api.NotFoundError{What: strings.Join(unmatched, ", "), Where: "layer"}
+	}
+	return nil
+}
+
+// readLayers calls readFile for each file in the layers that matches pm, in
+// layer order, until pm is no longer still matching.
+func (c *car) readLayers(ctx context.Context, layers []api.FilesystemLayer, pm patternmatcher.PatternMatcher, readFile api.ReadFile, readsContent bool) error {
+	rf := func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
 		name = stripLeadingSlash(name)
-		if !pm.MatchesPattern(name) {
+		// Match directories without their trailing slash, so that "usr/bin/*" doesn't match "usr/bin/".
+		if isWhiteout(name) || !pm.MatchesPattern(strings.TrimSuffix(name, "/")) {
 			return nil
 		}
-		return readFile(name, size, mode, modTime, reader)
+		return readFile(name, size, mode, modTime, linkName, reader)
+	}
+	readLayer := func(layer api.FilesystemLayer) error {
+		return c.registry.ReadFilesystemLayer(ctx, layer, rf)
 	}
-	for _, layer := range filteredLayers {
+	if c.parallel > 1 && len(layers) > 1 {
+		var keep keepFunc // nil when only metadata is needed
+		if readsContent {
+			keep = func(name string, _ os.FileMode) (bool, bool) {
+				name = stripLeadingSlash(name)
+				return true, !isWhiteout(name) && patternmatcher.Matches(c.filePatterns, strings.TrimSuffix(name, "/"))
+			}
+		}
+		p := c.prefetch(ctx, layers, c.parallel, keep)
+		defer p.close() // e.g. when fast-read stops early
+		readLayer = func(api.FilesystemLayer) error {
+			return p.readNext(rf)
+		}
+	}
+	for _, layer := range layers {
 		if c.veryVerbose {
 			fmt.Fprintln(c.out, layer) //nolint
 		}
-		if err := c.registry.ReadFilesystemLayer(ctx, layer, rf); err != nil {
+		if err := readLayer(layer); err != nil {
 			return err
 		}
 		if !pm.StillMatching() {
 			break
 		}
 	}
-	unmatched := pm.Unmatched()
-	if len(unmatched) > 0 {
-		return fmt.Errorf("%s not found in layer", strings.Join(unmatched, ", "))
-	}
 	return nil
 }
 
-func (c *car) Extract(ctx context.Context, ref api.Reference, platform, directory string, stripComponents int) error {
-	// maintain a lazy map of directories already created
-	dirsCreated := map[string]struct{}{}
-	return c.do(ctx, func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error {
-		destinationPath, ok := newDestinationPath(name, directory, stripComponents)
-		if !ok {
-			return nil // skip
-		}
-
-		baseDir := filepath.Dir(destinationPath)
-		if _, ok := dirsCreated[baseDir]; !ok {
-			if err := os.MkdirAll(baseDir, 0o755); err != nil { //nolint:gosec
-				return err
-			}
-			dirsCreated[baseDir] = struct{}{}
-		}
-		fw, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_RDWR, mode) //nolint:gosec
-		if err != nil {
+func (c *car) Extract(ctx context.Context, ref api.Reference, platform, directory string, stripComponents int, permissive bool) error {
+	if platform == AllPlatforms {
+		return c.forEachPlatform(ctx, ref, func(pc *car, ref api.Reference, platform, name string) error {
+			return pc.Extract(ctx, ref, platform, filepath.Join(directory, platformDirectory(name)), stripComponents, permissive)
+		})
+	}
+	e, err := newExtractor(directory, stripComponents, permissive)
+	if err != nil {
+		return err
+	}
+	err = c.do(ctx, func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+		if ok, err := e.extract(name, size, mode, linkName, reader); err != nil || !ok {
 			return err
 		}
 
 		if c.veryVerbose { // extract veryVerbose = list verbose. In other words, tar -xvv output is the same as tar -tv
-			c.listVerbose(name, size, mode, modTime)
+			c.listVerbose(name, size, mode, modTime, linkName)
 		} else if c.verbose {
 			fmt.Fprintln(c.out, name)
 		}
-		_, err = io.CopyN(fw, reader, size)
+		return nil
+	}, true, ref, platform)
+	if err != nil {
 		return err
-	}, ref, platform)
+	}
+	return e.chmodDirs()
 }
 
 // newDestinationPath allows manipulation of the output path based on flags like `--strip-components`
@@ -155,17 +231,95 @@ func newDestinationPath(name, directory string, stripComponents int) (string, bo
 }
 
 func (c *car) List(ctx context.Context, ref api.Reference, platform string) error {
-	return c.do(ctx, func(name string, size int64, mode os.FileMode, modTime time.Time, _ io.Reader) error {
+	if platform == AllPlatforms {
+		return c.forEachPlatform(ctx, ref, func(pc *car, ref api.Reference, platform, _ string) error {
+			return pc.List(ctx, ref, platform)
+		})
+	}
+	return c.do(ctx, func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, _ io.Reader) error {
 		if c.verbose {
-			c.listVerbose(name, size, mode, modTime)
+			c.listVerbose(name, size, mode, modTime, linkName)
 		} else {
 			fmt.Fprintln(c.out, name)
 		}
 		return nil
-	}, ref, platform)
+	}, false, ref, platform)
 }
 
-func (c *car) listVerbose(name string, size int64, mode os.FileMode, modTime time.Time) {
+func (c *car) Inspect(ctx context.Context, ref api.Reference, platform string) error {
+	img, err := c.registry.GetImage(ctx, ref, platform)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(img.Config(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, string(b))
+	return err
+}
+
+func (c *car) ListTags(ctx context.Context, ref api.Reference) error {
+	tags, err := c.registry.ListTags(ctx, ref)
+	if err != nil {
+		return err
+	}
+	pm := patternmatcher.New(c.filePatterns, false)
+	tags = slices.DeleteFunc(tags, func(tag string) bool { return !pm.MatchesPattern(tag) })
+	slices.SortStableFunc(tags, compareTags)
+	for _, tag := range tags {
+		fmt.Fprintln(c.out, tag)
+	}
+	return nil
+}
+
+func (c *car) ListPlatforms(ctx context.Context, ref api.Reference, asJSON bool) error {
+	platforms, err := c.registry.ListPlatforms(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		b, err := json.MarshalIndent(platforms, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.out, string(b))
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PLATFORM\tOS VERSION\tOS FEATURES\tDIGEST\tSIZE") //nolint
+	for _, p := range platforms {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", //nolint
+			path.Join(p.OS, p.Architecture, p.Variant), p.OSVersion, strings.Join(p.OSFeatures, ","), p.Digest, p.Size)
+	}
+	return w.Flush()
+}
+
+func (c *car) Resolve(ctx context.Context, ref api.Reference, asJSON bool) error {
+	d, err := c.registry.Resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		b, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.out, string(b))
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s\t%s\t%d\n", d.Digest, d.MediaType, d.Size)
+	return err
+}
+
+func (c *car) listVerbose(name string, size int64, mode os.FileMode, modTime time.Time, linkName string) {
+	switch { // like tar, which shows the target of each link.
+	case mode&os.ModeSymlink != 0:
+		name = name + " -> " + linkName
+	case linkName != "":
+		name = name + " link to " + linkName
+	}
 	fmt.Fprintf(c.out, "%s\t%d\t%s\t%s\n", mode, size, modTime.Format(time.Stamp), name) //nolint
 }
 
@@ -175,6 +329,9 @@ func (c *car) getFilesystemLayers(ctx context.Context, ref api.Reference, platfo
 		return nil, err
 	}
 	if c.veryVerbose {
+		if r := resolved(ref, img); r != "" {
+			fmt.Fprintln(c.out, r) //nolint
+		}
 		fmt.Fprintln(c.out, img) //nolint
 	}
 
@@ -189,6 +346,27 @@ func (c *car) getFilesystemLayers(ctx context.Context, ref api.Reference, platfo
 	return filteredLayers, nil
 }
 
+// resolved returns what the reference resolved to, for reproducibility. e.g.
+// "v1.0 -> index sha256:3d95... -> manifest sha256:d6ec... (application/vnd.docker.distribution.manifest.v2+json)"
+//
+// This is empty when the image wasn't read from a manifest.
+func resolved(ref api.Reference, img api.Image) string {
+	if img.ManifestDigest() == "" {
+		return ""
+	}
+	var steps []string
+	if ref.Digest() != "" {
+		steps = append(steps, ref.Digest())
+	} else if ref.Tag() != "" {
+		steps = append(steps, ref.Tag())
+	}
+	if img.IndexDigest() != "" {
+		steps = append(steps, "index "+img.IndexDigest())
+	}
+	steps = append(steps, fmt.Sprintf("manifest %s (%s)", img.ManifestDigest(), img.ManifestMediaType()))
+	return strings.Join(steps, " -> ")
+}
+
 // stripLeadingSlash removes any leading slash from the input file name, to
 // normalize pattern matching. For example, paketo images have a combination of
 // relative and absolute paths in their squashed image.
@@ -17,6 +17,9 @@ package car
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -24,12 +27,14 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/tetratelabs/car/api"
 	"github.com/tetratelabs/car/internal/reference"
 	"github.com/tetratelabs/car/internal/registry/fake"
 )
 
 func TestList(t *testing.T) {
 	ref := reference.MustParse("ghcr.io/tetratelabs/car:v1.0")
+	whiteoutsRef := reference.MustParse("ghcr.io/tetratelabs/car:" + fake.WhiteoutsTag)
 	platform := "linux/amd64"
 
 	tests := []struct {
@@ -37,15 +42,59 @@ func TestList(t *testing.T) {
 		patterns                       []string
 		createdByPattern               *regexp.Regexp
 		fastRead, verbose, veryVerbose bool
+		squash                         bool
+		ref                            api.Reference // defaults to ref
 		expectedOut, expectedErr       string
 	}{
 		{
 			name: "normal",
 			expectedOut: `bin/apple.txt
+usr/local/bin/
 usr/local/bin/boat
+usr/local/boat
 usr/local/bin/car
+usr/local/bin/van
 Files/ProgramData/truck/bin/truck.exe
 usr/local/sbin/car
+`,
+		},
+		{
+			name:   "squash",
+			squash: true,
+			ref:    whiteoutsRef,
+			// Files are in layer order, except those deleted by the top layer.
+			expectedOut: `usr/local/bin/
+usr/local/boat
+usr/local/bin/car
+usr/local/bin/van
+Files/ProgramData/truck/bin/truck.exe
+usr/local/sbin/car
+`,
+		},
+		{
+			name:     "squash, deleted pattern",
+			squash:   true,
+			ref:      whiteoutsRef,
+			patterns: []string{"usr/local/bin/*", "bin/apple.txt"},
+			expectedOut: `usr/local/bin/car
+usr/local/bin/van
+`,
+			expectedErr: "bin/apple.txt not found in layer",
+		},
+		{
+			name:        "squash, fast match, very verbose",
+			squash:      true,
+			ref:         whiteoutsRef,
+			fastRead:    true,
+			veryVerbose: true,
+			patterns:    []string{"usr/local/sbin/car"},
+			expectedOut: `v1.0-whiteouts -> index sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68 -> manifest sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17 (application/vnd.docker.distribution.manifest.v2+json)
+linux/amd64
+4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f
+15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2
+1b68df344f018b7cdd39908b93b6d60792a414cbf47975f7606a18bd603e6a81
+6d2d8da2960b0044c22730be087e6d7b197ab215d78f9090a3dff8cb7c40c241
+-rwxr-xr-x	50	May 12 03:53:29	usr/local/sbin/car
 `,
 		},
 		{
@@ -54,6 +103,7 @@ usr/local/sbin/car
 			expectedOut: `bin/apple.txt
 usr/local/bin/boat
 usr/local/bin/car
+usr/local/bin/van
 Files/ProgramData/truck/bin/truck.exe
 `,
 		},
@@ -62,6 +112,7 @@ Files/ProgramData/truck/bin/truck.exe
 			patterns: []string{"usr/local/bin/*", "/etc"},
 			expectedOut: `usr/local/bin/boat
 usr/local/bin/car
+usr/local/bin/van
 `,
 			expectedErr: "/etc not found in layer",
 		},
@@ -70,6 +121,7 @@ usr/local/bin/car
 			patterns: []string{"usr/local/bin/*"},
 			expectedOut: `usr/local/bin/boat
 usr/local/bin/car
+usr/local/bin/van
 `,
 		},
 		{
@@ -84,7 +136,8 @@ usr/local/bin/car
 			fastRead:    true,
 			veryVerbose: true,
 			patterns:    []string{"usr/local/bin/car"},
-			expectedOut: `linux/amd64
+			expectedOut: `v1.0 -> index sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68 -> manifest sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17 (application/vnd.docker.distribution.manifest.v2+json)
+linux/amd64
 4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f
 15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2
 -rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
@@ -94,6 +147,7 @@ usr/local/bin/car
 			name:             "layer pattern",
 			createdByPattern: regexp.MustCompile(`ADD build`),
 			expectedOut: `usr/local/bin/car
+usr/local/bin/van
 usr/local/sbin/car
 `,
 		},
@@ -101,8 +155,11 @@ usr/local/sbin/car
 			name:    "verbose",
 			verbose: true,
 			expectedOut: `-rw-r-----	10	Jun  7 06:28:15	bin/apple.txt
+drwxr-xr-x	0	Apr 16 22:53:09	usr/local/bin/
 -rwxr-xr-x	20	Apr 16 22:53:09	usr/local/bin/boat
+Lrwxrwxrwx	0	Apr 16 22:53:09	usr/local/boat -> bin/boat
 -rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
+-rwxr-xr-x	0	May 12 03:53:29	usr/local/bin/van link to usr/local/bin/car
 -rw-r--r--	40	May 12 03:53:15	Files/ProgramData/truck/bin/truck.exe
 -rwxr-xr-x	50	May 12 03:53:29	usr/local/sbin/car
 `,
@@ -110,12 +167,16 @@ usr/local/sbin/car
 		{
 			name:        "veryVerbose",
 			veryVerbose: true,
-			expectedOut: `linux/amd64
+			expectedOut: `v1.0 -> index sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68 -> manifest sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17 (application/vnd.docker.distribution.manifest.v2+json)
+linux/amd64
 4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f
 -rw-r-----	10	Jun  7 06:28:15	bin/apple.txt
+drwxr-xr-x	0	Apr 16 22:53:09	usr/local/bin/
 -rwxr-xr-x	20	Apr 16 22:53:09	usr/local/bin/boat
+Lrwxrwxrwx	0	Apr 16 22:53:09	usr/local/boat -> bin/boat
 15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2
 -rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
+-rwxr-xr-x	0	May 12 03:53:29	usr/local/bin/van link to usr/local/bin/car
 1b68df344f018b7cdd39908b93b6d60792a414cbf47975f7606a18bd603e6a81
 -rw-r--r--	40	May 12 03:53:15	Files/ProgramData/truck/bin/truck.exe
 6d2d8da2960b0044c22730be087e6d7b197ab215d78f9090a3dff8cb7c40c241
@@ -128,25 +189,37 @@ usr/local/sbin/car
 		tc := test // pin! see https://github.com/kyoh86/scopelint for why
 
 		t.Run(tc.name, func(t *testing.T) {
-			ctx := context.Background()
-			var stdout bytes.Buffer
+			for _, parallel := range []int{1, 3} { // files are read in layer order either way
+				parallel := parallel
+				t.Run(fmt.Sprintf("parallel=%d", parallel), func(t *testing.T) {
+					ctx := context.Background()
+					var stdout bytes.Buffer
 
-			c := New(
-				fake.Registry,
-				&stdout,
-				tc.createdByPattern,
-				tc.patterns,
-				tc.fastRead,
-				tc.verbose,
-				tc.veryVerbose,
-			)
-
-			if err := c.List(ctx, ref, platform); tc.expectedErr != "" {
-				require.EqualError(t, err, tc.expectedErr)
-				require.Equal(t, tc.expectedOut, stdout.String())
-			} else {
-				require.NoError(t, err)
-				require.Equal(t, tc.expectedOut, stdout.String())
+					c := New(
+						fake.Registry,
+						&stdout,
+						tc.createdByPattern,
+						tc.patterns,
+						tc.fastRead,
+						tc.verbose,
+						tc.veryVerbose,
+						tc.squash,
+						parallel,
+					)
+
+					var tcRef api.Reference = ref
+					if tc.ref != nil {
+						tcRef = tc.ref
+					}
+					if err := c.List(ctx, tcRef, platform); tc.expectedErr != "" {
+						require.EqualError(t, err, tc.expectedErr)
+						require.ErrorIs(t, err, api.ErrNotFound) // patterns unmatched
+						require.Equal(t, tc.expectedOut, stdout.String())
+					} else {
+						require.NoError(t, err)
+						require.Equal(t, tc.expectedOut, stdout.String())
+					}
+				})
 			}
 		})
 	}
@@ -154,6 +227,7 @@ usr/local/sbin/car
 
 func TestExtract(t *testing.T) {
 	ref := reference.MustParse("ghcr.io/tetratelabs/car:v1.0")
+	whiteoutsRef := reference.MustParse("ghcr.io/tetratelabs/car:" + fake.WhiteoutsTag)
 	platform := "linux/amd64"
 	allFilesToSizes := map[string]int64{
 		"bin/apple.txt":                         10,
@@ -168,8 +242,11 @@ func TestExtract(t *testing.T) {
 		patterns                       []string
 		createdByPattern               *regexp.Regexp
 		fastRead, verbose, veryVerbose bool
+		squash                         bool
+		ref                            api.Reference // defaults to ref
 		stripComponents                int
 		expectedFileToSizes            map[string]int64
+		expectedMissing                []string
 		expectedOut, expectedErr       string
 	}{
 		{
@@ -219,7 +296,8 @@ func TestExtract(t *testing.T) {
 			expectedFileToSizes: map[string]int64{
 				"usr/local/bin/car": 30,
 			},
-			expectedOut: `linux/amd64
+			expectedOut: `v1.0 -> index sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68 -> manifest sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17 (application/vnd.docker.distribution.manifest.v2+json)
+linux/amd64
 4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f
 15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2
 -rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
@@ -233,6 +311,28 @@ func TestExtract(t *testing.T) {
 				"usr/local/sbin/car": 50,
 			},
 		},
+		{
+			name:   "squash",
+			squash: true,
+			ref:    whiteoutsRef,
+			expectedFileToSizes: map[string]int64{
+				"usr/local/bin/car":                     30,
+				"Files/ProgramData/truck/bin/truck.exe": 40,
+				"usr/local/sbin/car":                    50,
+			},
+			expectedMissing: []string{"bin", "usr/local/bin/boat"},
+		},
+		{
+			name:            "squash - fastRead picks first",
+			squash:          true,
+			ref:             whiteoutsRef,
+			fastRead:        true,
+			stripComponents: 3,
+			patterns:        []string{"usr/local/*/car"},
+			expectedFileToSizes: map[string]int64{
+				"car": 30, // files are still read in layer order
+			},
+		},
 		{
 			name:            "strip components - same match overwrites",
 			stripComponents: 3,
@@ -261,8 +361,11 @@ usr/local/sbin/car
 			verbose:             true,
 			expectedFileToSizes: allFilesToSizes,
 			expectedOut: `bin/apple.txt
+usr/local/bin/
 usr/local/bin/boat
+usr/local/boat
 usr/local/bin/car
+usr/local/bin/van
 Files/ProgramData/truck/bin/truck.exe
 usr/local/sbin/car
 `,
@@ -271,12 +374,16 @@ usr/local/sbin/car
 			name:                "veryVerbose",
 			veryVerbose:         true,
 			expectedFileToSizes: allFilesToSizes,
-			expectedOut: `linux/amd64
+			expectedOut: `v1.0 -> index sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68 -> manifest sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17 (application/vnd.docker.distribution.manifest.v2+json)
+linux/amd64
 4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f
 -rw-r-----	10	Jun  7 06:28:15	bin/apple.txt
+drwxr-xr-x	0	Apr 16 22:53:09	usr/local/bin/
 -rwxr-xr-x	20	Apr 16 22:53:09	usr/local/bin/boat
+Lrwxrwxrwx	0	Apr 16 22:53:09	usr/local/boat -> bin/boat
 15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2
 -rwxr-xr-x	30	May 12 03:53:29	usr/local/bin/car
+-rwxr-xr-x	0	May 12 03:53:29	usr/local/bin/van link to usr/local/bin/car
 1b68df344f018b7cdd39908b93b6d60792a414cbf47975f7606a18bd603e6a81
 -rw-r--r--	40	May 12 03:53:15	Files/ProgramData/truck/bin/truck.exe
 6d2d8da2960b0044c22730be087e6d7b197ab215d78f9090a3dff8cb7c40c241
@@ -289,32 +396,318 @@ usr/local/sbin/car
 		tc := test // pin! see https://github.com/kyoh86/scopelint for why
 
 		t.Run(tc.name, func(t *testing.T) {
-			ctx := context.Background()
-			var stdout bytes.Buffer
-			c := New(
-				fake.Registry,
-				&stdout,
-				tc.createdByPattern,
-				tc.patterns,
-				tc.fastRead,
-				tc.verbose,
-				tc.veryVerbose,
-			)
+			for _, parallel := range []int{1, 3} { // files are read in layer order either way
+				parallel := parallel
+				t.Run(fmt.Sprintf("parallel=%d", parallel), func(t *testing.T) {
+					ctx := context.Background()
+					var stdout bytes.Buffer
+					c := New(
+						fake.Registry,
+						&stdout,
+						tc.createdByPattern,
+						tc.patterns,
+						tc.fastRead,
+						tc.verbose,
+						tc.veryVerbose,
+						tc.squash,
+						parallel,
+					)
+
+					directory := t.TempDir()
+					var tcRef api.Reference = ref
+					if tc.ref != nil {
+						tcRef = tc.ref
+					}
+					if err := c.Extract(ctx, tcRef, platform, directory, tc.stripComponents, false); tc.expectedErr != "" {
+						require.EqualError(t, err, tc.expectedErr)
+						require.ErrorIs(t, err, api.ErrNotFound) // patterns unmatched
+						require.Equal(t, tc.expectedOut, stdout.String())
+					} else {
+						require.NoError(t, err)
+						require.Equal(t, tc.expectedOut, stdout.String())
+					}
+					for file, size := range tc.expectedFileToSizes {
+						stat, err := os.Stat(filepath.Join(directory, file))
+						require.NoError(t, err)
+						require.True(t, !stat.IsDir())
+						require.Equal(t, size, stat.Size())
+					}
+					for _, file := range tc.expectedMissing {
+						_, err := os.Stat(filepath.Join(directory, file))
+						require.True(t, os.IsNotExist(err), file)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestExtract_Links(t *testing.T) {
+	ref := reference.MustParse("ghcr.io/tetratelabs/car:v1.0")
+
+	tests := []struct {
+		name        string
+		unsupported bool
+	}{
+		{name: "links"},
+		{name: "links unsupported", unsupported: true},
+	}
+
+	for _, test := range tests {
+		tc := test // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.unsupported {
+				unsupported := func(string, string) error { return errors.New("unsupported") }
+				symlink, link = unsupported, unsupported
+				defer func() { symlink, link = os.Symlink, os.Link }()
+			}
 
 			directory := t.TempDir()
-			if err := c.Extract(ctx, ref, platform, directory, tc.stripComponents); tc.expectedErr != "" {
+			c := New(fake.Registry, io.Discard, nil, nil, false, false, false, false, 1)
+			require.NoError(t, c.Extract(context.Background(), ref, "linux/amd64", directory, 0, false))
+
+			stat, err := os.Stat(filepath.Join(directory, "usr/local/bin"))
+			require.NoError(t, err)
+			require.Equal(t, os.ModeDir|0o755, stat.Mode())
+
+			boat := filepath.Join(directory, "usr/local/boat")
+			car := filepath.Join(directory, "usr/local/bin/car")
+			van := filepath.Join(directory, "usr/local/bin/van")
+			if tc.unsupported { // falls back to copying
+				stat, err = os.Lstat(boat)
+				require.NoError(t, err)
+				require.True(t, stat.Mode().IsRegular())
+				require.Equal(t, int64(20), stat.Size())
+
+				stat, err = os.Stat(van)
+				require.NoError(t, err)
+				require.Equal(t, int64(30), stat.Size())
+			} else {
+				target, err := os.Readlink(boat)
+				require.NoError(t, err)
+				require.Equal(t, "bin/boat", target)
+
+				carStat, err := os.Stat(car)
+				require.NoError(t, err)
+				vanStat, err := os.Stat(van)
+				require.NoError(t, err)
+				require.True(t, os.SameFile(carStat, vanStat))
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ref := reference.MustParse("ghcr.io/tetratelabs/car:v1.0")
+
+	tests := []struct {
+		name, platform           string
+		expectedOut, expectedErr string
+	}{
+		{
+			name: "normal",
+			expectedOut: `{
+  "User": "nobody",
+  "Env": [
+    "PATH=/usr/local/bin:/usr/bin:/bin"
+  ],
+  "Entrypoint": [
+    "/usr/local/bin/car"
+  ],
+  "Cmd": [
+    "--help"
+  ],
+  "WorkingDir": "/",
+  "Labels": {
+    "org.opencontainers.image.version": "v1.0"
+  }
+}
+`,
+		},
+		{
+			name:        "platform not found",
+			platform:    "linux/arm64",
+			expectedErr: "platform linux/arm64 not found",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := New(fake.Registry, &stdout, nil, nil, false, false, false, false, 1)
+
+			if err := c.Inspect(context.Background(), ref, tc.platform); tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedOut, stdout.String())
+		})
+	}
+}
+
+func TestListPlatforms(t *testing.T) {
+	tests := []struct {
+		name, reference          string
+		asJSON                   bool
+		expectedOut, expectedErr string
+	}{
+		{
+			name:      "table",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			expectedOut: `PLATFORM       OS VERSION       OS FEATURES  DIGEST                                                                   SIZE
+linux/amd64                                  sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17  1234
+windows/amd64  10.0.17763.1879  win32k       sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129  2345
+`,
+		},
+		{
+			name:      "json",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			asJSON:    true,
+			expectedOut: `[
+  {
+    "os": "linux",
+    "architecture": "amd64",
+    "digest": "sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17",
+    "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+    "size": 1234
+  },
+  {
+    "os": "windows",
+    "architecture": "amd64",
+    "os.version": "10.0.17763.1879",
+    "os.features": [
+      "win32k"
+    ],
+    "digest": "sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129",
+    "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+    "size": 2345
+  }
+]
+`,
+		},
+		{
+			name:        "tag not found",
+			reference:   "ghcr.io/tetratelabs/car:v2.0",
+			expectedErr: "tag v2.0 not found",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := New(fake.Registry, &stdout, nil, nil, false, false, false, false, 1)
+
+			if err := c.ListPlatforms(context.Background(), reference.MustParse(tc.reference), tc.asJSON); tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedOut, stdout.String())
+		})
+	}
+}
+
+func TestListTags(t *testing.T) {
+	tests := []struct {
+		name, reference          string
+		patterns                 []string
+		expectedOut, expectedErr string
+	}{
+		{
+			name:      "oldest version first",
+			reference: "ghcr.io/tetratelabs/car",
+			expectedOut: `latest
+v0.9
+v1.0-rc1
+v1.0
+v1.9.0
+v1.10.0
+`,
+		},
+		{
+			name:      "patterns",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			patterns:  []string{"v1.*.0", "v0.*"},
+			expectedOut: `v0.9
+v1.9.0
+v1.10.0
+`,
+		},
+		{
+			name:        "repository not found",
+			reference:   "ghcr.io/tetratelabs/bus",
+			expectedErr: "repository tetratelabs/bus not found",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := New(fake.Registry, &stdout, nil, tc.patterns, false, false, false, false, 1)
+
+			ref, err := reference.ParseRepository(tc.reference)
+			require.NoError(t, err)
+			if err = c.ListTags(context.Background(), ref); tc.expectedErr != "" {
 				require.EqualError(t, err, tc.expectedErr)
-				require.Equal(t, tc.expectedOut, stdout.String())
 			} else {
 				require.NoError(t, err)
-				require.Equal(t, tc.expectedOut, stdout.String())
 			}
-			for file, size := range tc.expectedFileToSizes {
-				stat, err := os.Stat(filepath.Join(directory, file))
+			require.Equal(t, tc.expectedOut, stdout.String())
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name, reference          string
+		asJSON                   bool
+		expectedOut, expectedErr string
+	}{
+		{
+			name:      "table",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			expectedOut: `sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68	application/vnd.docker.distribution.manifest.list.v2+json	743
+`,
+		},
+		{
+			name:      "json",
+			reference: "ghcr.io/tetratelabs/car:v1.0",
+			asJSON:    true,
+			expectedOut: `{
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "digest": "sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68",
+  "size": 743
+}
+`,
+		},
+		{
+			name:        "tag not found",
+			reference:   "ghcr.io/tetratelabs/car:v2.0",
+			expectedErr: "tag v2.0 not found",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			c := New(fake.Registry, &stdout, nil, nil, false, false, false, false, 1)
+
+			if err := c.Resolve(context.Background(), reference.MustParse(tc.reference), tc.asJSON); tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
 				require.NoError(t, err)
-				require.True(t, !stat.IsDir())
-				require.Equal(t, size, stat.Size())
 			}
+			require.Equal(t, tc.expectedOut, stdout.String())
 		})
 	}
 }
@@ -0,0 +1,296 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// symlink and link are variables, so that tests can simulate a filesystem
+// that doesn't support links.
+var (
+	symlink = os.Symlink
+	link    = os.Link
+)
+
+// extractor writes files into a directory, never outside it. Symbolic links
+// extracted are followed as a container would, as if the directory were the
+// root.
+type extractor struct {
+	directory       string
+	stripComponents int
+	permissive      bool
+
+	// dirsCreated is a lazy map of directories already created.
+	dirsCreated map[string]struct{}
+	// dirModes are applied after extraction, so that a read-only directory
+	// doesn't prevent extracting files into it.
+	dirModes map[string]os.FileMode
+}
+
+func newExtractor(directory string, stripComponents int, permissive bool) (*extractor, error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{
+		directory:       directory,
+		stripComponents: stripComponents,
+		permissive:      permissive,
+		dirsCreated:     map[string]struct{}{},
+		dirModes:        map[string]os.FileMode{},
+	}, nil
+}
+
+// extract writes the file, returning false if it was skipped.
+func (e *extractor) extract(name string, size int64, mode os.FileMode, linkName string, reader io.Reader) (bool, error) {
+	destinationPath, ok := newDestinationPath(name, e.directory, e.stripComponents)
+	if !ok {
+		return false, nil // skip
+	}
+
+	// A file from a lower layer is replaced, not followed, so only its
+	// directory is resolved. A directory is written into, so is.
+	destinationPath, err := e.confine(destinationPath, mode.IsDir())
+	if err != nil {
+		return e.unsafe(name, err)
+	}
+
+	if mode.IsDir() {
+		if err := os.MkdirAll(destinationPath, 0o755); err != nil { //nolint:gosec
+			return false, err
+		}
+		e.dirsCreated[destinationPath] = struct{}{}
+		e.dirModes[destinationPath] = mode.Perm()
+		return true, nil
+	}
+
+	baseDir := filepath.Dir(destinationPath)
+	if _, ok := e.dirsCreated[baseDir]; !ok {
+		if err := os.MkdirAll(baseDir, 0o755); err != nil { //nolint:gosec
+			return false, err
+		}
+		e.dirsCreated[baseDir] = struct{}{}
+	}
+	// Remove any file from a lower layer, so that we don't write through a symbolic link.
+	if err := removeFile(destinationPath); err != nil {
+		return false, err
+	}
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return true, e.extractSymlink(destinationPath, linkName)
+	case linkName != "":
+		target, ok := newDestinationPath(stripLeadingSlash(linkName), e.directory, e.stripComponents)
+		if !ok {
+			return false, fmt.Errorf("%s links to %s, which wasn't extracted", name, linkName)
+		}
+		if target, err = e.confine(target, true); err != nil {
+			return e.unsafe(name, err)
+		}
+		return true, extractLink(destinationPath, target)
+	default:
+		return true, extractFile(destinationPath, size, mode, reader)
+	}
+}
+
+// unsafe returns an error for a file that would be written outside the
+// directory, unless permissive, which skips it.
+func (e *extractor) unsafe(name string, err error) (bool, error) {
+	if e.permissive {
+		return false, nil
+	}
+	return false, fmt.Errorf("unsafe path %s: %w", name, err)
+}
+
+// maxSymlinks is how many symbolic links resolving a path can follow, the
+// same as Linux, so that a loop fails instead of never ending.
+const maxSymlinks = 40
+
+// errTooManySymlinks is returned when resolving a path follows more than
+// maxSymlinks, e.g. due to a loop.
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// confine returns the path with any symbolic links extracted earlier resolved
+// inside the directory, or an error if the path isn't in the directory. When
+// follow is false, the path itself isn't resolved, only its parents.
+func (e *extractor) confine(path string, follow bool) (string, error) {
+	if !inDirectory(e.directory, path) { // e.g. "../etc/cron.d/x"
+		return "", fmt.Errorf("outside %s", e.directory)
+	}
+	rel, err := filepath.Rel(e.directory, path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := e.resolve(rel, follow)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(e.directory, resolved), nil
+}
+
+// resolve resolves symbolic links in the path relative to the directory, one
+// element at a time, as if the directory were the root. This means an
+// absolute link target is relative to the directory, and ".." doesn't leave
+// it. e.g. "var/run/x" where "var/run -> /run" resolves to "run/x".
+//
+// This is similar to github.com/cyphar/filepath-securejoin, except it only
+// considers links extracted, not any on the host.
+func (e *extractor) resolve(path string, follow bool) (string, error) {
+	const sep = string(filepath.Separator)
+	var resolved string // relative to the directory, or empty for itself.
+	for links := 0; path != ""; {
+		var elem string
+		elem, path, _ = strings.Cut(path, sep)
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if i := strings.LastIndex(resolved, sep); i != -1 {
+				resolved = resolved[:i]
+			} else {
+				resolved = "" // stop at the directory
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, elem)
+		if path == "" && !follow {
+			return next, nil
+		}
+		stat, err := os.Lstat(filepath.Join(e.directory, next))
+		if err != nil || stat.Mode()&os.ModeSymlink == 0 {
+			resolved = next // e.g. a directory, or a path not yet extracted
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", errTooManySymlinks
+		}
+		target, err := os.Readlink(filepath.Join(e.directory, next))
+		if err != nil {
+			return "", err
+		}
+		if target = filepath.FromSlash(target); filepath.IsAbs(target) || strings.HasPrefix(target, sep) {
+			resolved = "" // relative to the directory, not the host
+		}
+		path = target + sep + path
+	}
+	return resolved, nil
+}
+
+// chmodDirs applies the mode of each directory extracted, deepest first, so
+// that a directory without search permission doesn't prevent changing the
+// mode of those in it.
+func (e *extractor) chmodDirs() error {
+	dirs := make([]string, 0, len(e.dirModes))
+	for dir := range e.dirModes {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	slices.Reverse(dirs) // a directory sorts before those in it
+	for _, dir := range dirs {
+		if err := os.Chmod(dir, e.dirModes[dir]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inDirectory returns true if the path is the directory or inside it, without
+// considering symbolic links.
+func inDirectory(directory, path string) bool {
+	rel, err := filepath.Rel(directory, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func extractFile(destinationPath string, size int64, mode os.FileMode, reader io.Reader) error {
+	fw, err := os.OpenFile(destinationPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, mode) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer fw.Close() //nolint
+	_, err = io.CopyN(fw, reader, size)
+	return err
+}
+
+// extractSymlink creates a symbolic link to the unaltered linkName. If the
+// filesystem doesn't support that, this copies the target, if it is a file
+// already extracted into the directory.
+func (e *extractor) extractSymlink(destinationPath, linkName string) error {
+	err := symlink(linkName, destinationPath)
+	if err == nil {
+		return nil
+	}
+
+	var target string
+	if strings.HasPrefix(linkName, "/") { // absolute to the root of the image
+		var ok bool
+		if target, ok = newDestinationPath(stripLeadingSlash(linkName), e.directory, e.stripComponents); !ok {
+			return nil // skip, as the target can't have been extracted
+		}
+	} else {
+		target = filepath.Join(filepath.Dir(destinationPath), linkName)
+	}
+	if target, err = e.confine(target, true); err != nil {
+		return nil // skip, as the target isn't in the directory.
+	}
+	if err = copyFile(destinationPath, target); os.IsNotExist(err) {
+		return nil // skip, as the target wasn't extracted, or is a dangling link.
+	}
+	return err
+}
+
+// extractLink creates a hard link to the target, which is a file earlier in
+// the same layer. If the filesystem doesn't support that, this copies it.
+func extractLink(destinationPath, target string) error {
+	if err := link(target, destinationPath); err != nil {
+		if copyErr := copyFile(destinationPath, target); copyErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file at the source path, including its mode.
+func copyFile(destinationPath, sourcePath string) error {
+	src, err := os.Open(sourcePath) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer src.Close() //nolint
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	} else if !stat.Mode().IsRegular() {
+		return os.ErrNotExist
+	}
+	return extractFile(destinationPath, stat.Size(), stat.Mode(), src)
+}
+
+// removeFile removes any file, but not directory, at the path.
+func removeFile(path string) error {
+	if stat, err := os.Lstat(path); err != nil || stat.IsDir() {
+		return nil // nothing to remove
+	}
+	return os.Remove(path)
+}
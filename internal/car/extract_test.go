@@ -0,0 +1,175 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractor_Unsafe(t *testing.T) {
+	type entry struct {
+		name     string
+		mode     os.FileMode
+		linkName string
+	}
+	file := func(name string) entry { return entry{name: name, mode: 0o644} }
+	dir := func(name string) entry { return entry{name: name, mode: os.ModeDir | 0o755} }
+	symbolicLink := func(name, linkName string) entry { return entry{name, os.ModeSymlink | 0o777, linkName} }
+	hardLink := func(name, linkName string) entry { return entry{name, 0o644, linkName} }
+
+	// $outside is replaced with a directory next to the one extracted to, $dir.
+	tests := []struct {
+		name        string
+		entries     []entry
+		expected    string // a file expected inside $dir
+		expectedErr string
+	}{
+		{
+			name:        "parent",
+			entries:     []entry{file("../outside/x")},
+			expectedErr: "unsafe path ../outside/x: outside $dir",
+		},
+		{
+			name:     "absolute symlink parent",
+			entries:  []entry{symbolicLink("lib", "$outside"), file("lib/x")},
+			expected: "$outside/x", // absolute to $dir, not the host
+		},
+		{
+			name:     "relative symlink parent",
+			entries:  []entry{symbolicLink("lib", "../outside"), file("lib/x")},
+			expected: "outside/x", // ".." stops at $dir
+		},
+		{
+			name:     "directory through symlink",
+			entries:  []entry{symbolicLink("etc", "$outside"), dir("etc/"), file("etc/x")},
+			expected: "$outside/x",
+		},
+		{
+			name:     "absolute symlink into the image",
+			entries:  []entry{dir("run/"), dir("var/"), symbolicLink("var/run", "/run"), file("var/run/x")},
+			expected: "run/x",
+		},
+		{
+			name:     "symlink to a later directory",
+			entries:  []entry{symbolicLink("lib", "usr/lib"), dir("usr/lib/"), file("lib/x")},
+			expected: "usr/lib/x",
+		},
+		{
+			name:     "symlink to a missing directory",
+			entries:  []entry{symbolicLink("lib", "usr/lib"), file("lib/x")},
+			expected: "usr/lib/x",
+		},
+		{
+			name:        "symlink loop",
+			entries:     []entry{symbolicLink("a", "b"), symbolicLink("b", "a"), file("a/x")},
+			expectedErr: "unsafe path a/x: too many levels of symbolic links",
+		},
+		{
+			name:        "hard link outside",
+			entries:     []entry{hardLink("passwd", "../outside/passwd")},
+			expectedErr: "unsafe path passwd: outside $dir",
+		},
+		{
+			name:     "symlink parent inside",
+			entries:  []entry{dir("usr/lib/"), symbolicLink("lib", "usr/lib"), file("lib/x")},
+			expected: "usr/lib/x",
+		},
+		{
+			name:     "replaces symlink",
+			entries:  []entry{symbolicLink("x", "$outside/passwd"), file("x")},
+			expected: "x",
+		},
+	}
+
+	for _, test := range tests {
+		tc := test // pin! see https://github.com/kyoh86/scopelint for why
+
+		for _, permissive := range []bool{false, true} {
+			permissive := permissive
+			name := tc.name
+			if permissive {
+				name += ", permissive"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				tmp := t.TempDir()
+				directory, outside := filepath.Join(tmp, "dir"), filepath.Join(tmp, "outside")
+				require.NoError(t, os.Mkdir(directory, 0o755))
+				require.NoError(t, os.Mkdir(outside, 0o755))
+				passwd := filepath.Join(outside, "passwd")
+				require.NoError(t, os.WriteFile(passwd, []byte("root"), 0o600))
+
+				e, err := newExtractor(directory, 0, permissive)
+				require.NoError(t, err)
+
+				for _, f := range tc.entries {
+					linkName := strings.ReplaceAll(f.linkName, "$outside", outside)
+					_, err = e.extract(f.name, 0, f.mode, linkName, bytes.NewReader(nil))
+					if err != nil {
+						break
+					}
+				}
+
+				if tc.expectedErr != "" && !permissive {
+					require.EqualError(t, err, strings.ReplaceAll(tc.expectedErr, "$dir", directory))
+				} else {
+					require.NoError(t, err)
+				}
+				if tc.expected != "" {
+					expected := strings.ReplaceAll(tc.expected, "$outside", outside)
+					stat, err := os.Lstat(filepath.Join(directory, expected))
+					require.NoError(t, err)
+					require.True(t, stat.Mode().IsRegular())
+				}
+
+				// Regardless of the result, nothing was written outside.
+				files, err := os.ReadDir(outside)
+				require.NoError(t, err)
+				require.Equal(t, 1, len(files))
+				b, err := os.ReadFile(passwd)
+				require.NoError(t, err)
+				require.Equal(t, "root", string(b))
+			})
+		}
+	}
+}
+
+func TestInDirectory(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "/dir", expected: true},
+		{path: "/dir/x", expected: true},
+		{path: "/dir/..x", expected: true},
+		{path: "/", expected: false},
+		{path: "/dirx", expected: false},
+		{path: "/other/x", expected: false},
+	}
+
+	for _, test := range tests {
+		tc := test // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.path, func(t *testing.T) {
+			require.Equal(t, tc.expected, inDirectory("/dir", tc.path))
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/car/api"
+)
+
+// prefetcher reads layers in the background, up to a number at once, into
+// temporary files. Files are still read in layer order, so that later layers
+// overwrite earlier ones as they would otherwise.
+type prefetcher struct {
+	cancel context.CancelFunc
+	// slots limits how many layers are read or waiting to be, so that a
+	// large image isn't spooled to disk all at once.
+	slots   chan struct{}
+	results []chan spoolResult
+	next    int
+}
+
+type spoolResult struct {
+	layer *spooledLayer
+	err   error
+	// slot is true when the layer was started, so holds a slot until read.
+	slot bool
+}
+
+// keepFunc returns whether a file in a layer will be read, and if so, whether
+// its content will be. It is called in the order of files in the layer, but
+// concurrently for different layers.
+type keepFunc func(name string, mode os.FileMode) (file, content bool)
+
+// prefetch starts reading the layers in the background, up to parallel at
+// once. Call readNext for each layer in order, then close.
+//
+// Only the content of files keep returns true for is written to temporary
+// files. When keep is nil, all files are kept without content, e.g. for
+// listing.
+func (c *car) prefetch(ctx context.Context, layers []api.FilesystemLayer, parallel int, keep keepFunc) *prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &prefetcher{cancel: cancel, slots: make(chan struct{}, parallel), results: make([]chan spoolResult, len(layers))}
+	for i := range p.results {
+		p.results[i] = make(chan spoolResult, 1)
+	}
+
+	go func() { // start in order, so that the next layer to read is first.
+		for i, layer := range layers {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				p.results[i] <- spoolResult{err: ctx.Err()}
+				continue
+			}
+			go func(i int, layer api.FilesystemLayer) {
+				s, err := c.spoolLayer(ctx, layer, keep)
+				p.results[i] <- spoolResult{layer: s, err: err, slot: true}
+			}(i, layer)
+		}
+	}()
+	return p
+}
+
+// readNext waits for the next layer, then calls readFile for each of its
+// files.
+func (p *prefetcher) readNext(readFile api.ReadFile) error {
+	r := <-p.results[p.next]
+	p.next++
+	defer p.release(r)
+	if r.err != nil {
+		return r.err
+	}
+	return r.layer.readFiles(readFile)
+}
+
+// close stops reading any layers not yet read and removes their temporary
+// files.
+func (p *prefetcher) close() {
+	p.cancel()
+	for ; p.next < len(p.results); p.next++ {
+		p.release(<-p.results[p.next])
+	}
+}
+
+// release removes the temporary file of a layer and frees its slot.
+func (p *prefetcher) release(r spoolResult) {
+	if r.layer != nil {
+		r.layer.close()
+	}
+	if r.slot {
+		<-p.slots
+	}
+}
+
+// spooledLayer is the files of a layer, with the content of those kept in a
+// temporary file.
+type spooledLayer struct {
+	files []spooledFile
+	spool *os.File // nil until content is kept
+}
+
+type spooledFile struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+	linkName string
+	// offset and length are the location of the content in the spool.
+	offset, length int64
+}
+
+func (c *car) spoolLayer(ctx context.Context, layer api.FilesystemLayer, keep keepFunc) (*spooledLayer, error) {
+	s := &spooledLayer{}
+	var offset int64
+	err := c.registry.ReadFilesystemLayer(ctx, layer, func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+		file, content := true, false
+		if keep != nil {
+			file, content = keep(name, mode)
+		}
+		if !file {
+			return nil
+		}
+		var n int64
+		if content {
+			if s.spool == nil {
+				f, err := os.CreateTemp("", "car-layer-*")
+				if err != nil {
+					return err
+				}
+				s.spool = f
+			}
+			var err error
+			if n, err = io.Copy(s.spool, reader); err != nil {
+				return err
+			}
+		}
+		s.files = append(s.files, spooledFile{name, size, mode, modTime, linkName, offset, n})
+		offset += n
+		return nil
+	})
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spooledLayer) readFiles(readFile api.ReadFile) error {
+	for _, f := range s.files {
+		var reader io.Reader = strings.NewReader("") // the content wasn't kept
+		if s.spool != nil {
+			reader = io.NewSectionReader(s.spool, f.offset, f.length)
+		}
+		if err := readFile(f.name, f.size, f.mode, f.modTime, f.linkName, reader); err != nil {
+			return fmt.Errorf("error calling readFile on %s: %w", f.name, err) // like a registry would
+		}
+	}
+	return nil
+}
+
+func (s *spooledLayer) close() {
+	if s.spool != nil {
+		s.spool.Close()           //nolint
+		os.Remove(s.spool.Name()) //nolint
+	}
+}
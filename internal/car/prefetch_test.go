@@ -0,0 +1,126 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/reference"
+	"github.com/tetratelabs/car/internal/registry/fake"
+)
+
+// blockingRegistry reads no layer until its context is done.
+type blockingRegistry struct {
+	api.Registry
+
+	started  chan struct{}
+	inFlight atomic.Int32
+}
+
+func (r *blockingRegistry) ReadFilesystemLayer(ctx context.Context, _ api.FilesystemLayer, _ api.ReadFile) error {
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+	r.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPrefetch_Canceled(t *testing.T) {
+	r := &blockingRegistry{Registry: fake.Registry, started: make(chan struct{}, 3)}
+	c := New(r, io.Discard, nil, nil, false, false, false, false, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-r.started
+		cancel()
+	}()
+
+	err := c.List(ctx, reference.MustParse("ghcr.io/tetratelabs/car:v1.0"), "linux/amd64")
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, r.inFlight.Load()) // every download stopped before returning
+}
+
+// countingRegistry counts the layers and bytes of file content read from it,
+// and the temporary files in a directory while reading.
+type countingRegistry struct {
+	api.Registry
+
+	tmp       string
+	layers    atomic.Int32
+	read      atomic.Int64
+	tempFiles atomic.Int32
+}
+
+func (r *countingRegistry) ReadFilesystemLayer(ctx context.Context, layer api.FilesystemLayer, readFile api.ReadFile) error {
+	r.layers.Add(1)
+	return r.Registry.ReadFilesystemLayer(ctx, layer, func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+		if entries, err := os.ReadDir(r.tmp); err == nil {
+			r.tempFiles.Add(int32(len(entries)))
+		}
+		return readFile(name, size, mode, modTime, linkName, &countingReader{reader, &r.read})
+	})
+}
+
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestPrefetch_KeepsMatchingContent(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	r := &countingRegistry{Registry: fake.Registry, tmp: tmp}
+
+	c := New(r, io.Discard, nil, []string{"usr/local/sbin/car"}, false, false, false, false, 3)
+	require.NoError(t, c.Extract(context.Background(), reference.MustParse("ghcr.io/tetratelabs/car:v1.0"), "linux/amd64", t.TempDir(), 0, false))
+	require.Equal(t, int64(50), r.read.Load()) // only the content of the file extracted
+}
+
+func TestPrefetch_ListWithoutSpool(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	r := &countingRegistry{Registry: fake.Registry, tmp: tmp}
+
+	c := New(r, io.Discard, nil, nil, false, false, false, false, 3)
+	require.NoError(t, c.List(context.Background(), reference.MustParse("ghcr.io/tetratelabs/car:v1.0"), "linux/amd64"))
+	require.Zero(t, r.read.Load())
+	require.Zero(t, r.tempFiles.Load())
+}
+
+func TestPrefetch_RemovesSpool(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	c := New(fake.Registry, io.Discard, nil, []string{"bin/apple.txt"}, true, false, false, false, 3)
+	require.NoError(t, c.Extract(context.Background(), reference.MustParse("ghcr.io/tetratelabs/car:v1.0"), "linux/amd64", t.TempDir(), 0, false))
+
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries) // including layers not read, as fast-read stopped at the first
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/patternmatcher"
+)
+
+const (
+	// whiteoutPrefix is the base name prefix of a file deleted from lower
+	// layers. e.g. "etc/.wh.motd" deletes "etc/motd".
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque is the base name of a file that hides all contents of
+	// its directory in lower layers.
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// isWhiteout returns true if the name is a whiteout file.
+//
+// See https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+// squash tracks the paths hidden by upper layers, when reading layers from
+// the top-most down. This results in each path being read once, from the
+// layer a running container would see it in.
+type squash struct {
+	// seen are paths already read from an upper layer. The value is true
+	// for a directory.
+	seen map[string]bool
+	// deleted are paths whited out in an upper layer.
+	deleted map[string]struct{}
+	// opaque are directories whose contents are hidden in lower layers.
+	opaque map[string]struct{}
+
+	// layerDeleted and layerOpaque are from the layer being read. These
+	// don't apply until the next layer, as whiteouts only hide lower layers.
+	layerDeleted, layerOpaque []string
+}
+
+func newSquash() *squash {
+	return &squash{
+		seen:    map[string]bool{},
+		deleted: map[string]struct{}{},
+		opaque:  map[string]struct{}{},
+	}
+}
+
+// visible returns true if the file in the current layer should be read.
+// Whiteout files are recorded and never visible.
+func (s *squash) visible(name string, mode os.FileMode) bool {
+	p := path.Clean(name) // e.g. "./usr/bin" and "usr/bin" are the same path.
+	dir, base := path.Split(p)
+	dir = path.Clean(dir)
+	if base == whiteoutOpaque {
+		s.layerOpaque = append(s.layerOpaque, dir)
+		return false
+	} else if strings.HasPrefix(base, whiteoutPrefix) {
+		s.layerDeleted = append(s.layerDeleted, path.Join(dir, base[len(whiteoutPrefix):]))
+		return false
+	}
+
+	if _, ok := s.seen[p]; ok {
+		return false
+	}
+	if _, ok := s.deleted[p]; ok {
+		return false
+	}
+	for { // check parents, up to the root, which can also be opaque.
+		if _, ok := s.deleted[dir]; ok {
+			return false
+		}
+		if _, ok := s.opaque[dir]; ok {
+			return false
+		}
+		if isDir, ok := s.seen[dir]; ok && !isDir {
+			return false // e.g. an upper layer replaced the directory with a symbolic link.
+		}
+		if dir == "." {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	s.seen[p] = mode.IsDir()
+	return true
+}
+
+// nextLayer applies whiteouts read from the current layer to lower ones.
+func (s *squash) nextLayer() {
+	for _, p := range s.layerDeleted {
+		s.deleted[p] = struct{}{}
+	}
+	for _, p := range s.layerOpaque {
+		s.opaque[p] = struct{}{}
+	}
+	s.layerDeleted, s.layerOpaque = nil, nil
+}
+
+// readSquashed reads the layers once, from the top-most down, keeping the
+// files visible in the squashed image that match the patterns. Then, it calls
+// readFile for the files that match pm in layer order, as readLayers would.
+//
+// When readsContent, the content of kept files is written to temporary files
+// meanwhile. Every layer is read, even on fast-read, as whether a file is
+// visible depends on all layers above it.
+func (c *car) readSquashed(ctx context.Context, layers []api.FilesystemLayer, pm patternmatcher.PatternMatcher, readFile api.ReadFile, readsContent bool) error {
+	sq := newSquash()
+	keep := func(name string, mode os.FileMode) (bool, bool) {
+		name = stripLeadingSlash(name)
+		// Match directories without their trailing slash, so that "usr/bin/*" doesn't match "usr/bin/".
+		if !sq.visible(name, mode) || !patternmatcher.Matches(c.filePatterns, strings.TrimSuffix(name, "/")) {
+			return false, false
+		}
+		return true, readsContent
+	}
+
+	spooled := make([]*spooledLayer, len(layers))
+	defer func() {
+		for _, s := range spooled {
+			if s != nil {
+				s.close()
+			}
+		}
+	}()
+	for i := len(layers) - 1; i >= 0; i-- {
+		s, err := c.spoolLayer(ctx, layers[i], keep)
+		if err != nil {
+			return err
+		}
+		spooled[i] = s
+		sq.nextLayer()
+	}
+
+	rf := func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+		name = stripLeadingSlash(name)
+		if !pm.MatchesPattern(strings.TrimSuffix(name, "/")) {
+			return nil
+		}
+		return readFile(name, size, mode, modTime, linkName, reader)
+	}
+	for i, s := range spooled {
+		if c.veryVerbose {
+			fmt.Fprintln(c.out, layers[i]) //nolint
+		}
+		if err := s.readFiles(rf); err != nil {
+			return err
+		}
+		if !pm.StillMatching() {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/internal/reference"
+	"github.com/tetratelabs/car/internal/registry/fake"
+)
+
+func TestReadSquashed_ReadsLayersOnce(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	r := &countingRegistry{Registry: fake.Registry, tmp: tmp}
+
+	c := New(r, io.Discard, nil, []string{"usr/local/sbin/car"}, false, false, false, true, 1)
+	require.NoError(t, c.Extract(context.Background(), reference.MustParse("ghcr.io/tetratelabs/car:"+fake.WhiteoutsTag), "linux/amd64", t.TempDir(), 0, false))
+	require.Equal(t, int32(5), r.layers.Load())
+	require.Equal(t, int64(50), r.read.Load()) // only the content of the file extracted
+
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSquash(t *testing.T) {
+	tests := []struct {
+		name string
+		// layers are top-most first, as squash reads them.
+		layers   [][]string
+		expected []string
+	}{
+		{
+			name:     "replaced",
+			layers:   [][]string{{"etc/motd"}, {"./etc/motd", "etc/hosts"}},
+			expected: []string{"etc/motd", "etc/hosts"},
+		},
+		{
+			name:     "deleted file",
+			layers:   [][]string{{"etc/.wh.motd"}, {"etc/motd", "etc/hosts"}},
+			expected: []string{"etc/hosts"},
+		},
+		{
+			name:     "deleted directory",
+			layers:   [][]string{{".wh.etc"}, {"etc/motd", "etc/ssl/cert.pem", "etcetera"}},
+			expected: []string{"etcetera"},
+		},
+		{
+			name:     "re-created after delete",
+			layers:   [][]string{{"etc/motd"}, {"etc/.wh.motd"}, {"etc/motd"}},
+			expected: []string{"etc/motd"},
+		},
+		{
+			name:     "whiteout doesn't apply to its own layer",
+			layers:   [][]string{{"etc/.wh.motd", "etc/motd"}, {"etc/motd"}},
+			expected: []string{"etc/motd"},
+		},
+		{
+			name:     "opaque directory",
+			layers:   [][]string{{"etc/.wh..wh..opq", "etc/hosts"}, {"etc/motd", "etc/ssl/cert.pem", "bin/sh"}},
+			expected: []string{"etc/hosts", "bin/sh"},
+		},
+		{
+			name:     "directory in lower layer",
+			layers:   [][]string{{"etc/", "etc/hosts"}, {"etc/", "etc/motd"}},
+			expected: []string{"etc/", "etc/hosts", "etc/motd"},
+		},
+		{
+			name:     "directory replaced by symbolic link",
+			layers:   [][]string{{"etc@"}, {"etc/", "etc/motd"}},
+			expected: []string{"etc"},
+		},
+		{
+			name:     "opaque root",
+			layers:   [][]string{{"./.wh..wh..opq", "etc/hosts"}, {"etc/motd", "bin/sh"}},
+			expected: []string{"etc/hosts"},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSquash()
+			var visible []string
+			for _, layer := range tc.layers {
+				for _, name := range layer {
+					mode := os.FileMode(0o644)
+					if strings.HasSuffix(name, "/") {
+						mode = os.ModeDir | 0o755
+					} else if strings.HasSuffix(name, "@") { // symbolic link
+						name = name[:len(name)-1]
+						mode = os.ModeSymlink | 0o777
+					}
+					if s.visible(name, mode) {
+						visible = append(visible, name)
+					}
+				}
+				s.nextLayer()
+			}
+			require.Equal(t, tc.expected, visible)
+		})
+	}
+}
+
+func TestIsWhiteout(t *testing.T) {
+	require.True(t, isWhiteout("etc/.wh.motd"))
+	require.True(t, isWhiteout("etc/.wh..wh..opq"))
+	require.False(t, isWhiteout("etc/motd.wh.bak"))
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"strings"
+)
+
+// compareTags orders tags naturally, comparing runs of digits as numbers, so
+// that "v1.9.0" is before "v1.10.0". Like semver, a pre-release is before its
+// release, so "v1.0-rc1" is before "v1.0". Otherwise, tags are compared
+// lexically.
+func compareTags(a, b string) int {
+	aRest, bRest := a, b
+	for aRest != "" && bRest != "" {
+		aRun, aDigits := nextRun(aRest)
+		bRun, bDigits := nextRun(bRest)
+		aRest, bRest = aRest[len(aRun):], bRest[len(bRun):]
+		if aDigits && bDigits {
+			// Compare numbers without parsing them, so that any length works.
+			aRun, bRun = strings.TrimLeft(aRun, "0"), strings.TrimLeft(bRun, "0")
+			if len(aRun) != len(bRun) {
+				if len(aRun) < len(bRun) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if c := strings.Compare(aRun, bRun); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case aRest == "" && strings.HasPrefix(bRest, "-"):
+		return 1 // b is a pre-release of a, e.g. "v1.0" and "v1.0-rc1"
+	case bRest == "" && strings.HasPrefix(aRest, "-"):
+		return -1
+	}
+	return strings.Compare(a, b) // e.g. "v01" and "v1"
+}
+
+// nextRun returns the leading run of digits or non-digits in s, and whether
+// it is digits.
+func nextRun(s string) (string, bool) {
+	digits := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], digits
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
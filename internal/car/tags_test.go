@@ -0,0 +1,47 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package car
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareTags(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "v1.9.0", b: "v1.10.0", expected: -1},
+		{a: "v1.18.10", b: "v1.18.3", expected: 1},
+		{a: "1.18.3-1", b: "1.18.3", expected: -1}, // pre-release is before its release
+		{a: "v1.0-rc1", b: "v1.0", expected: -1},
+		{a: "v1.0-rc1", b: "v1.0.1", expected: -1},
+		{a: "v1.0", b: "v1.0", expected: 0},
+		{a: "v01", b: "v1", expected: -1}, // equal numbers fall back to lexical
+		{a: "latest", b: "v1.0", expected: -1},
+		{a: "", b: "v1.0", expected: -1},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.a+" "+tc.b, func(t *testing.T) {
+			require.Equal(t, tc.expected, compareTags(tc.a, tc.b))
+			require.Equal(t, -tc.expected, compareTags(tc.b, tc.a))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package digest handles OCI content digests, such as
+// "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672".
+//
+// See https://github.com/opencontainers/image-spec/blob/master/descriptor.md#digests
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/tetratelabs/car/api"
+)
+
+// algorithms are the digest algorithms registered by the OCI image spec.
+var algorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Validate returns an error unless the digest is a supported algorithm
+// followed by a lower-case hex encoded value of the expected length.
+func Validate(digest string) error {
+	_, err := newHash(digest)
+	return err
+}
+
+// FromBytes returns the sha256 digest of the input.
+func FromBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// FromReader returns the sha256 digest of what's read until EOF.
+func FromReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify returns an error if the input content doesn't match the digest.
+func Verify(digest string, b []byte) error {
+	h, err := newHash(digest)
+	if err != nil {
+		return err
+	}
+	h.Write(b) //nolint
+	return verify(digest, h)
+}
+
+// Verifier hashes content as it is read, so that it can be verified without
+// buffering it. This is used for layers, which can be very large.
+type Verifier struct {
+	digest string
+	hash   hash.Hash
+	reader io.Reader
+}
+
+// NewVerifier returns a Verifier that reads from the input reader.
+func NewVerifier(digest string, reader io.Reader) (*Verifier, error) {
+	h, err := newHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{digest: digest, hash: h, reader: io.TeeReader(reader, h)}, nil
+}
+
+// Read implements io.Reader
+func (v *Verifier) Read(p []byte) (int, error) {
+	return v.reader.Read(p)
+}
+
+// Verify reads any remaining content and returns api.DigestMismatchError if
+// what was read doesn't match the digest.
+//
+// Note: Readers such as tar stop before the end of the stream (e.g. padding),
+// which is why this drains the input before comparing.
+func (v *Verifier) Verify() error {
+	if _, err := io.Copy(io.Discard, v.reader); err != nil {
+		return err
+	}
+	return verify(v.digest, v.hash)
+}
+
+func verify(digest string, h hash.Hash) error {
+	if actual := encode(digest, h); actual != digest {
+		return &api.DigestMismatchError{Expected: digest, Actual: actual}
+	}
+	return nil
+}
+
+func newHash(digest string) (hash.Hash, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid digest format: %q", digest)
+	}
+	newHash, ok := algorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm: %q", digest)
+	}
+	h := newHash()
+	if len(encoded) != h.Size()*2 || strings.ToLower(encoded) != encoded {
+		return nil, fmt.Errorf("invalid digest format: %q", digest)
+	}
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return nil, fmt.Errorf("invalid digest format: %q", digest)
+	}
+	return h, nil
+}
+
+func encode(digest string, h hash.Hash) string {
+	algorithm := digest[:strings.IndexByte(digest, ':')]
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package digest
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/api"
+)
+
+// helloDigest is the sha256 digest of "hello\n"
+const helloDigest = "sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+func TestValidate(t *testing.T) {
+	tests := []struct{ name, digest, expectedErr string }{
+		{name: "sha256", digest: helloDigest},
+		{
+			name:   "sha512",
+			digest: "sha512:cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+		},
+		{name: "empty", expectedErr: `invalid digest format: ""`},
+		{name: "no algorithm", digest: "5891b5b5", expectedErr: `invalid digest format: "5891b5b5"`},
+		{name: "unsupported algorithm", digest: "md5:b1946ac92492d2347c6235b4d2611184", expectedErr: `unsupported digest algorithm: "md5:b1946ac92492d2347c6235b4d2611184"`},
+		{name: "too short", digest: "sha256:5891b5b5", expectedErr: `invalid digest format: "sha256:5891b5b5"`},
+		{
+			name:        "upper case",
+			digest:      "sha256:5891B5B522D5DF086D0FF0B110FBD9D21BB4FC7163AF34D08286A2E846F6BE03",
+			expectedErr: `invalid digest format: "sha256:5891B5B522D5DF086D0FF0B110FBD9D21BB4FC7163AF34D08286A2E846F6BE03"`,
+		},
+		{
+			name:        "not hex",
+			digest:      "sha256:zz91b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+			expectedErr: `invalid digest format: "sha256:zz91b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"`,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(tc.digest)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	require.Equal(t, helloDigest, FromBytes([]byte("hello\n")))
+}
+
+func TestFromReader(t *testing.T) {
+	dgst, err := FromReader(bytes.NewReader([]byte("hello\n")))
+	require.NoError(t, err)
+	require.Equal(t, helloDigest, dgst)
+}
+
+func TestVerify(t *testing.T) {
+	require.NoError(t, Verify(helloDigest, []byte("hello\n")))
+
+	err := Verify(helloDigest, []byte("goodbye\n"))
+	require.EqualError(t, err, "digest mismatch: expected "+helloDigest+
+		", but was sha256:71573b922a87abc3fd1a957f2cfa09d9e16998567dd878a85e12166112751806")
+}
+
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		name, content string
+		readN         int
+		expectedErr   error
+	}{
+		{name: "read all", content: "hello\n", readN: 6},
+		{name: "read some", content: "hello\n", readN: 2},
+		{name: "read none", content: "hello\n"},
+		{
+			name:    "mismatch",
+			content: "goodbye\n",
+			readN:   8,
+			expectedErr: &api.DigestMismatchError{
+				Expected: helloDigest,
+				Actual:   "sha256:71573b922a87abc3fd1a957f2cfa09d9e16998567dd878a85e12166112751806",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := NewVerifier(helloDigest, bytes.NewReader([]byte(tc.content)))
+			require.NoError(t, err)
+
+			b, err := io.ReadAll(io.LimitReader(v, int64(tc.readN)))
+			require.NoError(t, err)
+			require.Equal(t, tc.content[:tc.readN], string(b))
+
+			if err = v.Verify(); tc.expectedErr != nil {
+				require.Equal(t, tc.expectedErr, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewVerifier_InvalidDigest(t *testing.T) {
+	_, err := NewVerifier("sha256:5891b5b5", bytes.NewReader(nil))
+	require.EqualError(t, err, `invalid digest format: "sha256:5891b5b5"`)
+}
@@ -17,11 +17,20 @@ package httpclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"mime"
+	"net"
 	"net/http"
 	urlpkg "net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tetratelabs/car/api"
 )
 
 // HTTPClient is a convenience wrapper for http.Client that consolidates common logic.
@@ -30,10 +39,23 @@ type HTTPClient interface {
 	//
 	// This is optimized for easy content negotiation. Hence, the returned mediaType is stripped of qualifiers.
 	// e.g. "Content-Type: application/json; charset=utf-8" will return mediaType "application/json"
+	//
+	// When the response has "Accept-Ranges: bytes", reading the body continues after a dropped connection with a
+	// "Range" request from where it stopped, so that a large layer isn't downloaded again from the start.
 	Get(ctx context.Context, url string, header http.Header) (body io.ReadCloser, mediaType string, err error)
 
+	// Head returns the header of the URL using the provided context, without reading its body. e.g. to get the
+	// "Docker-Content-Digest" of a manifest.
+	Head(ctx context.Context, url string, header http.Header) (http.Header, error)
+
 	// GetJSON is a convenience function that calls json.Unmarshal after Get.
 	GetJSON(ctx context.Context, url string, accept string, v interface{}) error
+
+	// GetJSONPage is like GetJSON, except it also returns the URL of the next page, from a "Link" header like
+	// `</v2/envoyproxy/envoy/tags/list?last=v1.18.3&n=100>; rel="next"`. This is empty on the last page.
+	//
+	// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-tags
+	GetJSONPage(ctx context.Context, url string, accept string, v interface{}) (next string, err error)
 }
 
 type httpClient struct{ client http.Client }
@@ -59,43 +81,275 @@ func ContextWithTransport(ctx context.Context, transport http.RoundTripper) cont
 	return context.WithValue(ctx, contextClientTransportKey{}, transport)
 }
 
+type contextRetryPolicyKey struct{}
+
+// RetryPolicyFromContext returns the api.RetryPolicy from the context or api.DefaultRetryPolicy
+func RetryPolicyFromContext(ctx context.Context) api.RetryPolicy {
+	if v, ok := ctx.Value(contextRetryPolicyKey{}).(api.RetryPolicy); ok {
+		return v
+	}
+	return api.DefaultRetryPolicy()
+}
+
+// ContextWithRetryPolicy returns a context with an api.RetryPolicy for requests to use
+func ContextWithRetryPolicy(ctx context.Context, policy api.RetryPolicy) context.Context {
+	return context.WithValue(ctx, contextRetryPolicyKey{}, policy)
+}
+
 func (h *httpClient) Get(ctx context.Context, url string, header http.Header) (io.ReadCloser, string, error) {
-	u, err := urlpkg.Parse(url)
+	res, err := h.do(ctx, http.MethodGet, url, header)
 	if err != nil {
 		return nil, "", err
 	}
+	contentType := res.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType) // strip qualifiers
+	if res.Header.Get("Accept-Ranges") == "bytes" {
+		return &resumableBody{h: h, ctx: ctx, url: url, header: header.Clone(), body: res.Body}, mediaType, nil
+	}
+	return res.Body, mediaType, nil
+}
 
-	header.Set("User-Agent", "") // don't add implicit User-Agent
-	req := &http.Request{Method: http.MethodGet, URL: u, Header: header}
-	res, err := h.client.Do(req.WithContext(ctx))
+func (h *httpClient) Head(ctx context.Context, url string, header http.Header) (http.Header, error) {
+	res, err := h.do(ctx, http.MethodHead, url, header)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
+	res.Body.Close() //nolint
+	return res.Header, nil
+}
+
+func (h *httpClient) do(ctx context.Context, method, url string, header http.Header) (*http.Response, error) {
+	return h.doExpecting(ctx, method, url, header, http.StatusOK)
+}
+
+// doExpecting is like do, except it returns an error unless the response has the given status code.
+//
+// Failed attempts are retried according to the api.RetryPolicy in the context.
+func (h *httpClient) doExpecting(ctx context.Context, method, url string, header http.Header, statusCode int) (*http.Response, error) {
+	u, err := urlpkg.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Set("User-Agent", "") // don't add implicit User-Agent
+	policy := RetryPolicyFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		req := &http.Request{Method: method, URL: u, Header: header}
+		res, err := h.client.Do(req.WithContext(ctx))
+		if err == nil && res.StatusCode == statusCode {
+			return res, nil
+		}
 
-	if res.StatusCode != http.StatusOK {
+		var retryable bool
+		var delay time.Duration
+		if err != nil {
+			retryable = transient(err)
+		} else {
+			retryable = retryableStatus(res.StatusCode)
+			delay = retryAfter(res.Header.Get("Retry-After"))
+			err = NewRegistryError(url, res)
+		}
+		if !retryable || attempt >= policy.MaxAttempts {
+			return nil, err
+		}
+		if delay == 0 {
+			delay = backoff(policy, attempt)
+		} else if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+			return nil, err // the server asked to wait longer than the policy allows.
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return nil, err // waiting would only fail with a less useful error.
+		}
+		if policy.OnRetry != nil {
+			policy.OnRetry(url, attempt, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// maxErrorBody limits how much of an error response is read, as some servers respond with an HTML page.
+const maxErrorBody = 64 * 1024
+
+// NewRegistryError returns an api.RegistryError for an unexpected response, including any errors in its body,
+// e.g. {"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}. This closes the response body.
+func NewRegistryError(url string, res *http.Response) *api.RegistryError {
+	defer res.Body.Close() //nolint
+	var body struct {
+		Errors []api.RegistryErrorDetail `json:"errors"`
+	}
+	if b, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBody)); err == nil {
+		_ = json.Unmarshal(b, &body) // the body isn't always in the format of the distribution spec.
+	}
+	return &api.RegistryError{URL: url, StatusCode: res.StatusCode, Errors: body.Errors}
+}
+
+// retryableStatus returns true if the status code is likely to change on retry, such as "503 Service Unavailable".
+func retryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// transient returns true if the error is likely to go away on retry, such as a connection reset, as opposed to one
+// that won't, such as an unknown host.
+func transient(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	case errors.As(err, &netErr):
+		return netErr.Timeout()
+	default:
+		return false
+	}
+}
+
+// retryAfter returns the delay in a "Retry-After" header, which is either seconds or a date, or zero if there isn't
+// one. e.g. "Retry-After: 120" or "Retry-After: Fri, 31 Dec 1999 23:59:59 GMT"
+//
+// See https://www.rfc-editor.org/rfc/rfc9110#section-10.2.3
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// backoff returns the delay before retrying the attempt, which doubles each attempt. This is jittered, so that
+// clients failed by the same outage don't retry in lockstep.
+func backoff(policy api.RetryPolicy, attempt int) time.Duration {
+	delay := policy.InitialBackoff << (attempt - 1)
+	if delay <= 0 || (policy.MaxBackoff > 0 && delay > policy.MaxBackoff) { // <= 0 on overflow
+		delay = policy.MaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// maxResumes is how many times in a row a body is resumed without reading anything, before giving up.
+const maxResumes = 3
+
+// resumableBody is the body of a GET response that continues with a "Range" request when reading it fails.
+//
+// See https://www.rfc-editor.org/rfc/rfc9110#section-14.2
+type resumableBody struct {
+	h      *httpClient
+	ctx    context.Context
+	url    string
+	header http.Header
+	body   io.ReadCloser
+	// offset is how many bytes were read, so where to resume from.
+	offset int64
+	// resumes is how many times in a row the body was resumed without reading anything.
+	resumes int
+}
+
+// Read implements io.Reader
+func (r *resumableBody) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if n > 0 {
+		r.resumes = 0
+	}
+	if err == nil || err == io.EOF || r.ctx.Err() != nil || r.resumes >= maxResumes {
+		return n, err
+	}
+	r.resumes++
+	if resumeErr := r.resume(); resumeErr != nil {
+		r.resumes = maxResumes // the server can't resume, so don't try again.
+		return n, fmt.Errorf("%w (resuming at byte %d: %v)", err, r.offset, resumeErr)
+	}
+	return n, nil
+}
+
+// resume replaces the body with the rest of the content, from the offset.
+func (r *resumableBody) resume() error {
+	r.body.Close() //nolint
+	header := r.header.Clone()
+	header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	res, err := r.h.doExpecting(r.ctx, http.MethodGet, r.url, header, http.StatusPartialContent)
+	if err != nil {
+		return err
+	}
+	// Only use the response if it starts where we stopped, e.g. "Content-Range: bytes 1024-2047/2048"
+	if contentRange := res.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", r.offset)) {
 		res.Body.Close() //nolint
-		return nil, "", fmt.Errorf("received %v status code from %q", res.StatusCode, url)
+		return fmt.Errorf("unexpected Content-Range %q from %q", contentRange, r.url)
 	}
+	r.body = res.Body
+	return nil
+}
 
-	contentType := res.Header.Get("Content-Type")
-	mediaType, _, _ := mime.ParseMediaType(contentType) // strip qualifiers
-	return res.Body, mediaType, nil
+// Close implements io.Closer
+func (r *resumableBody) Close() error {
+	return r.body.Close()
 }
 
 func (h *httpClient) GetJSON(ctx context.Context, url, accept string, v interface{}) error {
+	_, err := h.GetJSONPage(ctx, url, accept, v)
+	return err
+}
+
+func (h *httpClient) GetJSONPage(ctx context.Context, url, accept string, v interface{}) (string, error) {
 	header := http.Header{}
 	header.Add("Accept", accept)
-	body, _, err := h.Get(ctx, url, header)
+	res, err := h.do(ctx, http.MethodGet, url, header)
 	if err != nil {
-		return err // wrapping doesn't help on this branch
+		return "", err // wrapping doesn't help on this branch
 	}
-	defer body.Close()         //nolint
-	b, err := io.ReadAll(body) // fully read the response
+	defer res.Body.Close()         //nolint
+	b, err := io.ReadAll(res.Body) // fully read the response
 	if err != nil {
-		return err
+		return "", err
 	}
 	if err = json.Unmarshal(b, &v); err != nil {
-		return fmt.Errorf("error unmarshalling %v: %w", v, err)
+		return "", fmt.Errorf("error unmarshalling %v: %w", v, err)
 	}
-	return nil
+	base, _ := urlpkg.Parse(url) // already valid, as do parsed it
+	if res.Request != nil {
+		base = res.Request.URL // e.g. after a redirect
+	}
+	return nextLink(base, res.Header.Values("Link")), nil
+}
+
+// nextLink returns the absolute URL of the "next" link in the header values,
+// or empty if there isn't one. The link is usually relative to the request.
+//
+// See https://www.rfc-editor.org/rfc/rfc8288#section-3
+func nextLink(base *urlpkg.URL, links []string) string {
+	for _, values := range links {
+		for _, link := range strings.Split(values, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if name == "rel" && strings.Trim(value, `"`) == "next" {
+					u, err := base.Parse(target[1 : len(target)-1])
+					if err != nil {
+						return ""
+					}
+					return u.String()
+				}
+			}
+		}
+	}
+	return ""
 }
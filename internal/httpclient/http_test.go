@@ -17,12 +17,18 @@ package httpclient
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/api"
 )
 
 func TestHttpClient_Get(t *testing.T) {
@@ -122,6 +128,315 @@ func TestHttpClient_Get_MediaTypeStripsLongContentTypes(t *testing.T) {
 	require.Equal(t, "application/json", mediaType)
 }
 
+func TestHttpClient_Get_Resumes(t *testing.T) {
+	tests := []struct {
+		name           string
+		server         flaky
+		expectedRanges []string
+		expectedErr    string
+	}{
+		{
+			name:           "resumes from where it stopped",
+			server:         flaky{dropAfter: 4, acceptRanges: true},
+			expectedRanges: []string{"", "bytes=4-", "bytes=8-"},
+		},
+		{
+			name:           "doesn't accept ranges",
+			server:         flaky{dropAfter: 4},
+			expectedRanges: []string{""},
+			expectedErr:    "unexpected EOF",
+		},
+		{
+			name:           "ignores range",
+			server:         flaky{dropAfter: 4, acceptRanges: true, ignoreRange: true},
+			expectedRanges: []string{"", "bytes=4-"},
+			expectedErr:    `unexpected EOF (resuming at byte 4: received 200 status code from "https://test/v2/user/repo/blobs/sha256:abc")`,
+		},
+		{
+			name:           "gives up without progress",
+			server:         flaky{dropAfter: 0, acceptRanges: true},
+			expectedRanges: []string{"", "bytes=0-", "bytes=0-", "bytes=0-"},
+			expectedErr:    "unexpected EOF",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			tc.server.content = "hello world"
+			body, _, err := New(&tc.server).Get(context.Background(), "https://test/v2/user/repo/blobs/sha256:abc", http.Header{})
+			require.NoError(t, err)
+			defer body.Close()
+
+			b, err := io.ReadAll(body)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.server.content, string(b))
+			}
+			require.Equal(t, tc.expectedRanges, tc.server.ranges)
+		})
+	}
+}
+
+func TestHttpClient_Get_Retries(t *testing.T) {
+	tests := []struct {
+		name             string
+		responses        []response
+		maxBackoff       time.Duration
+		timeout          time.Duration
+		expectedRequests int
+		expectedRetries  []string
+		expectedErr      string
+	}{
+		{
+			name:             "service unavailable",
+			responses:        []response{{statusCode: http.StatusServiceUnavailable}, {statusCode: http.StatusOK}},
+			expectedRequests: 2,
+			expectedRetries:  []string{`1: received 503 status code from "https://test/v2/"`},
+		},
+		{
+			name:             "transient network error",
+			responses:        []response{{err: io.ErrUnexpectedEOF}, {statusCode: http.StatusOK}},
+			expectedRequests: 2,
+			expectedRetries:  []string{`1: Get "https://test/v2/": unexpected EOF`},
+		},
+		{
+			name: "gives up after max attempts",
+			responses: []response{
+				{statusCode: http.StatusBadGateway},
+				{statusCode: http.StatusBadGateway},
+				{statusCode: http.StatusBadGateway},
+			},
+			expectedRequests: 3,
+			expectedRetries: []string{
+				`1: received 502 status code from "https://test/v2/"`,
+				`2: received 502 status code from "https://test/v2/"`,
+			},
+			expectedErr: `received 502 status code from "https://test/v2/"`,
+		},
+		{
+			name:             "not found isn't retried",
+			responses:        []response{{statusCode: http.StatusNotFound}},
+			expectedRequests: 1,
+			expectedErr:      `received 404 status code from "https://test/v2/"`,
+		},
+		{
+			name:             "other errors aren't retried",
+			responses:        []response{{err: errors.New("x509: certificate signed by unknown authority")}},
+			expectedRequests: 1,
+			expectedErr:      `Get "https://test/v2/": x509: certificate signed by unknown authority`,
+		},
+		{
+			name:             "retry after past the deadline",
+			responses:        []response{{statusCode: http.StatusTooManyRequests, retryAfter: "120"}},
+			maxBackoff:       time.Hour,
+			timeout:          time.Minute,
+			expectedRequests: 1,
+			expectedErr:      `received 429 status code from "https://test/v2/"`,
+		},
+		{
+			name:             "retry after longer than the max backoff",
+			responses:        []response{{statusCode: http.StatusTooManyRequests, retryAfter: "120"}},
+			expectedRequests: 1,
+			expectedErr:      `received 429 status code from "https://test/v2/"`,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			maxBackoff := time.Millisecond
+			if tc.maxBackoff > 0 {
+				maxBackoff = tc.maxBackoff
+			}
+			var retries []string
+			ctx := ContextWithRetryPolicy(context.Background(), api.RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     maxBackoff,
+				OnRetry: func(url string, attempt int, delay time.Duration, err error) {
+					retries = append(retries, fmt.Sprintf("%d: %v", attempt, err))
+				},
+			})
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			r := &responses{responses: tc.responses}
+			body, _, err := New(r).Get(ctx, "https://test/v2/", http.Header{})
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				body.Close()
+			}
+			require.Equal(t, tc.expectedRequests, r.requests)
+			require.Equal(t, tc.expectedRetries, retries)
+		})
+	}
+}
+
+func TestHttpClient_Get_RegistryError(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    response
+		expectedErr string
+		expectedIs  error
+		expected    []api.RegistryErrorDetail
+	}{
+		{
+			name:        "manifest unknown",
+			response:    response{statusCode: http.StatusNotFound, body: `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`},
+			expectedErr: `received 404 status code from "https://test/v2/": MANIFEST_UNKNOWN manifest unknown`,
+			expectedIs:  api.ErrNotFound,
+			expected:    []api.RegistryErrorDetail{{Code: "MANIFEST_UNKNOWN", Message: "manifest unknown"}},
+		},
+		{
+			name:        "name unknown by code",
+			response:    response{statusCode: http.StatusBadRequest, body: `{"errors":[{"code":"NAME_UNKNOWN"}]}`},
+			expectedErr: `received 400 status code from "https://test/v2/": NAME_UNKNOWN`,
+			expectedIs:  api.ErrNotFound,
+			expected:    []api.RegistryErrorDetail{{Code: "NAME_UNKNOWN"}},
+		},
+		{
+			name: "unauthorized",
+			response: response{statusCode: http.StatusUnauthorized,
+				body: `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"},{"code":"DENIED","message":"requested access to the resource is denied"}]}`},
+			expectedErr: `received 401 status code from "https://test/v2/": UNAUTHORIZED authentication required, DENIED requested access to the resource is denied`,
+			expectedIs:  api.ErrUnauthorized,
+			expected: []api.RegistryErrorDetail{
+				{Code: "UNAUTHORIZED", Message: "authentication required"},
+				{Code: "DENIED", Message: "requested access to the resource is denied"},
+			},
+		},
+		{
+			name:        "forbidden",
+			response:    response{statusCode: http.StatusForbidden},
+			expectedErr: `received 403 status code from "https://test/v2/"`,
+			expectedIs:  api.ErrUnauthorized,
+		},
+		{
+			name:        "rate limited",
+			response:    response{statusCode: http.StatusTooManyRequests, body: `{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit."}]}`},
+			expectedErr: `received 429 status code from "https://test/v2/": TOOMANYREQUESTS You have reached your pull rate limit.`,
+			expectedIs:  api.ErrRateLimited,
+			expected:    []api.RegistryErrorDetail{{Code: "TOOMANYREQUESTS", Message: "You have reached your pull rate limit."}},
+		},
+		{
+			name:        "not json",
+			response:    response{statusCode: http.StatusNotFound, body: "<html><body>Not Found</body></html>"},
+			expectedErr: `received 404 status code from "https://test/v2/"`,
+			expectedIs:  api.ErrNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := ContextWithRetryPolicy(context.Background(), api.RetryPolicy{MaxAttempts: 1})
+			_, _, err := New(&responses{responses: []response{tc.response}}).Get(ctx, "https://test/v2/", http.Header{})
+			require.EqualError(t, err, tc.expectedErr)
+			require.ErrorIs(t, err, tc.expectedIs)
+
+			var registryErr *api.RegistryError
+			require.ErrorAs(t, err, &registryErr)
+			require.Equal(t, tc.response.statusCode, registryErr.StatusCode)
+			require.Equal(t, tc.expected, registryErr.Errors)
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	require.Equal(t, 120*time.Second, retryAfter("120"))
+	require.Zero(t, retryAfter(""))
+	require.Zero(t, retryAfter("Fri, 31 Dec 1999 23:59:59 GMT")) // in the past
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	require.InDelta(t, time.Hour, retryAfter(future), float64(2*time.Second))
+}
+
+func TestBackoff(t *testing.T) {
+	policy := api.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for _, tc := range []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: time.Second},
+		{attempt: 2, expected: 2 * time.Second},
+		{attempt: 3, expected: 4 * time.Second},
+		{attempt: 4, expected: 5 * time.Second},  // capped
+		{attempt: 64, expected: 5 * time.Second}, // overflow
+	} {
+		delay := backoff(policy, tc.attempt)
+		require.GreaterOrEqual(t, delay, tc.expected/2)
+		require.LessOrEqual(t, delay, tc.expected)
+	}
+}
+
+func TestHttpClient_Head(t *testing.T) {
+	expectedDigest := "sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129"
+	r := recorder{responseHeaders: map[string][]string{"Docker-Content-Digest": {expectedDigest}}}
+	header, err := New(&r).Head(context.Background(), "https://index.docker.io/v2/envoyproxy/envoy/manifests/v1.18.3",
+		http.Header{"Accept": []string{"application/vnd.oci.image.index.v1+json"}})
+	require.NoError(t, err)
+	require.Equal(t, expectedDigest, header.Get("Docker-Content-Digest"))
+	require.Equal(t, []string{`HEAD /v2/envoyproxy/envoy/manifests/v1.18.3 HTTP/1.1
+Host: index.docker.io
+Accept: application/vnd.oci.image.index.v1+json
+
+`}, r.requests)
+}
+
+func TestHttpClient_GetJSONPage(t *testing.T) {
+	tests := []struct{ name, link, expectedNext string }{
+		{name: "no link"},
+		{
+			name:         "relative",
+			link:         `</v2/envoyproxy/envoy/tags/list?last=v1.18.3&n=100>; rel="next"`,
+			expectedNext: "https://index.docker.io/v2/envoyproxy/envoy/tags/list?last=v1.18.3&n=100",
+		},
+		{
+			name:         "absolute",
+			link:         `<https://ghcr.io/v2/homebrew/core/envoy/tags/list?last=1.18.3&n=100>; rel=next`,
+			expectedNext: "https://ghcr.io/v2/homebrew/core/envoy/tags/list?last=1.18.3&n=100",
+		},
+		{
+			name:         "not next",
+			link:         `</v2/envoyproxy/envoy/tags/list?n=100>; rel="first"`,
+			expectedNext: "",
+		},
+		{
+			name:         "multiple",
+			link:         `</v2/envoyproxy/envoy/tags/list?n=100>; rel="first", </v2/envoyproxy/envoy/tags/list?last=v1.18.3&n=100>; rel="next"`,
+			expectedNext: "https://index.docker.io/v2/envoyproxy/envoy/tags/list?last=v1.18.3&n=100",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			r := recorder{responseBody: `{"tags": ["v1.18.3"]}`, responseHeaders: map[string][]string{}}
+			if tc.link != "" {
+				r.responseHeaders["Link"] = []string{tc.link}
+			}
+
+			var v struct{ Tags []string }
+			next, err := New(&r).GetJSONPage(context.Background(), "https://index.docker.io/v2/envoyproxy/envoy/tags/list?n=100", "application/json", &v)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedNext, next)
+			require.Equal(t, []string{"v1.18.3"}, v.Tags)
+		})
+	}
+}
+
 func TestTransportFromContext(t *testing.T) {
 	require.Equal(t, http.DefaultTransport, TransportFromContext(context.Background()))
 
@@ -143,3 +458,59 @@ func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
 	body := io.NopCloser(strings.NewReader(r.responseBody))
 	return &http.Response{Status: "200 OK", StatusCode: http.StatusOK, Header: r.responseHeaders, Body: body}, nil
 }
+
+// flaky serves content that fails after dropAfter bytes, like a dropped
+// connection, recording the "Range" header of each request.
+type flaky struct {
+	content                   string
+	dropAfter                 int
+	acceptRanges, ignoreRange bool
+	ranges                    []string
+}
+
+func (f *flaky) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.ranges = append(f.ranges, req.Header.Get("Range"))
+	res := &http.Response{Status: "200 OK", StatusCode: http.StatusOK, Header: http.Header{}}
+	if f.acceptRanges {
+		res.Header.Set("Accept-Ranges", "bytes")
+	}
+	var start int
+	if r := req.Header.Get("Range"); r != "" && !f.ignoreRange {
+		fmt.Sscanf(r, "bytes=%d-", &start) //nolint
+		res.Status, res.StatusCode = "206 Partial Content", http.StatusPartialContent
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(f.content)-1, len(f.content)))
+	}
+	rest := f.content[start:]
+	var body io.Reader = strings.NewReader(rest)
+	if len(rest) > f.dropAfter {
+		body = io.MultiReader(strings.NewReader(rest[:f.dropAfter]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	}
+	res.Body = io.NopCloser(body)
+	return res, nil
+}
+
+type response struct {
+	statusCode int
+	retryAfter string
+	body       string
+	err        error
+}
+
+// responses responds to each request with the next response.
+type responses struct {
+	responses []response
+	requests  int
+}
+
+func (r *responses) RoundTrip(*http.Request) (*http.Response, error) {
+	res := r.responses[r.requests]
+	r.requests++
+	if res.err != nil {
+		return nil, res.err
+	}
+	header := http.Header{}
+	if res.retryAfter != "" {
+		header.Set("Retry-After", res.retryAfter)
+	}
+	return &http.Response{StatusCode: res.statusCode, Header: header, Body: io.NopCloser(strings.NewReader(res.body))}, nil
+}
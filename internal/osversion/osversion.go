@@ -0,0 +1,98 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package osversion handles the "os.version" of a platform, such as
+// "10.0.17763.1879" for a Windows image, which must match the build of the
+// host it runs on.
+//
+// See https://github.com/opencontainers/image-spec/blob/master/image-index.md
+package osversion
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Split splits a platform like "windows(10.0.17763)/amd64" into the platform
+// without the os.version, "windows/amd64", and the os.version, "10.0.17763".
+// The os.version is empty when the platform doesn't have one.
+//
+// This is the same syntax as containerd, e.g. "ctr pull --platform".
+func Split(platform string) (string, string) {
+	start := strings.IndexByte(platform, '(')
+	if start == -1 {
+		return platform, ""
+	}
+	end := strings.IndexByte(platform[start:], ')')
+	if end == -1 {
+		return platform, ""
+	}
+	end += start
+	return platform[:start] + platform[end+1:], platform[start+1 : end]
+}
+
+// Join is the inverse of Split, e.g. "windows(10.0.17763)/amd64".
+func Join(platform, osVersion string) string {
+	if osVersion == "" {
+		return platform
+	}
+	pOS, rest, _ := strings.Cut(platform, "/")
+	return pOS + "(" + osVersion + ")/" + rest
+}
+
+// Matches returns true if the version equals the prefix or starts with its
+// fields, e.g. "10.0.17763.1879" matches "10.0.17763", but "10.0.177630"
+// doesn't. An empty prefix matches any version.
+func Matches(prefix, version string) bool {
+	return prefix == "" || version == prefix || strings.HasPrefix(version, prefix+".")
+}
+
+// Compare returns -1, 0 or 1 when a is less than, equal to or greater than b.
+// Fields are delimited by dots or spaces, and numeric ones are compared as
+// numbers, so "10.0.9200" < "10.0.17763" and "macOS 9.2" < "macOS 10.15.7".
+func Compare(a, b string) int {
+	aFields, bFields := fields(a), fields(b)
+	for i := 0; i < len(aFields) && i < len(bFields); i++ {
+		if c := compareField(aFields[i], bFields[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aFields) < len(bFields):
+		return -1
+	case len(aFields) > len(bFields):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func fields(version string) []string {
+	return strings.FieldsFunc(version, func(r rune) bool { return r == '.' || r == ' ' })
+}
+
+func compareField(a, b string) int {
+	aNum, aErr := strconv.ParseUint(a, 10, 64)
+	bNum, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr != nil || bErr != nil:
+		return strings.Compare(a, b)
+	case aNum < bNum:
+		return -1
+	case aNum > bNum:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package osversion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct{ name, expectedPlatform, expectedOSVersion string }{
+		{name: "linux/amd64", expectedPlatform: "linux/amd64"},
+		{name: "windows(10.0.17763)/amd64", expectedPlatform: "windows/amd64", expectedOSVersion: "10.0.17763"},
+		{name: "windows()/amd64", expectedPlatform: "windows/amd64"},
+		{name: "windows(10.0/amd64", expectedPlatform: "windows(10.0/amd64"}, // unterminated
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			platform, osVersion := Split(tc.name)
+			require.Equal(t, tc.expectedPlatform, platform)
+			require.Equal(t, tc.expectedOSVersion, osVersion)
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	require.Equal(t, "linux/amd64", Join("linux/amd64", ""))
+	require.Equal(t, "windows(10.0.17763)/amd64", Join("windows/amd64", "10.0.17763"))
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		prefix, version string
+		expected        bool
+	}{
+		{prefix: "", version: "10.0.17763.1879", expected: true},
+		{prefix: "", version: "", expected: true},
+		{prefix: "10.0.17763", version: "10.0.17763.1879", expected: true},
+		{prefix: "10.0.17763.1879", version: "10.0.17763.1879", expected: true},
+		{prefix: "10.0.17763", version: "10.0.177630", expected: false},
+		{prefix: "10.0.17763", version: "10.0.20348.1726", expected: false},
+		{prefix: "10.0.17763", version: "", expected: false},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.prefix+" "+tc.version, func(t *testing.T) {
+			require.Equal(t, tc.expected, Matches(tc.prefix, tc.version))
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "10.0.9200", b: "10.0.17763", expected: -1},
+		{a: "10.0.17763.1879", b: "10.0.17763.999", expected: 1},
+		{a: "10.0.17763", b: "10.0.17763.1879", expected: -1},
+		{a: "10.0.17763.1879", b: "10.0.17763.1879", expected: 0},
+		{a: "", b: "10.0.17763", expected: -1},
+		{a: "", b: "", expected: 0},
+		{a: "10.0.beta", b: "10.0.alpha", expected: 1}, // not numeric
+		{a: "macOS 9.2", b: "macOS 10.15.7", expected: -1},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.a+" "+tc.b, func(t *testing.T) {
+			require.Equal(t, tc.expected, Compare(tc.a, tc.b))
+		})
+	}
+}
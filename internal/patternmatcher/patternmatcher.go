@@ -29,30 +29,50 @@ type PatternMatcher interface {
 }
 
 type patternMatcher struct {
-	patterns map[string]bool
+	patterns []string
+	matched  map[string]bool
 	fastRead bool
 }
 
 // New returns a possibly no-op PatternMatcher based on the inputs
 func New(patterns []string, fastRead bool) PatternMatcher {
-	pm := &patternMatcher{patterns: map[string]bool{}, fastRead: fastRead}
+	pm := &patternMatcher{matched: map[string]bool{}, fastRead: fastRead}
 	for _, pattern := range patterns {
-		pm.patterns[pattern] = false
+		if _, ok := pm.matched[pattern]; !ok {
+			pm.patterns = append(pm.patterns, pattern)
+			pm.matched[pattern] = false
+		}
 	}
 	return pm
 }
 
-func (pm *patternMatcher) MatchesPattern(name string) bool {
-	if len(pm.patterns) == 0 {
-		return true
+// Matches is like MatchesPattern, except it doesn't track which patterns
+// matched, so is safe to call concurrently.
+func Matches(patterns []string, name string) bool {
+	_, ok := match(patterns, name)
+	return ok
+}
+
+// match returns the first pattern that matches the name, and true if there
+// is one or there are no patterns.
+func match(patterns []string, name string) (string, bool) {
+	if len(patterns) == 0 {
+		return "", true
 	}
-	for pattern := range pm.patterns {
+	for _, pattern := range patterns {
 		if ok, _ := filepath.Match(pattern, name); ok {
-			pm.patterns[pattern] = true
-			return true
+			return pattern, true
 		}
 	}
-	return false
+	return "", false
+}
+
+func (pm *patternMatcher) MatchesPattern(name string) bool {
+	pattern, ok := match(pm.patterns, name)
+	if pattern != "" {
+		pm.matched[pattern] = true
+	}
+	return ok
 }
 
 func (pm *patternMatcher) StillMatching() bool {
@@ -61,8 +81,8 @@ func (pm *patternMatcher) StillMatching() bool {
 
 func (pm *patternMatcher) Unmatched() []string {
 	unmatched := make([]string, 0, len(pm.patterns))
-	for pattern, matched := range pm.patterns {
-		if !matched {
+	for _, pattern := range pm.patterns {
+		if !pm.matched[pattern] {
 			unmatched = append(unmatched, pattern)
 		}
 	}
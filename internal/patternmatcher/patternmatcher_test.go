@@ -67,6 +67,59 @@ func TestMatchesPattern(t *testing.T) {
 	}
 }
 
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		input    string
+		expected bool
+	}{
+		{
+			name:     "no patterns",
+			input:    "usr/local/bin/car",
+			expected: true,
+		},
+		{
+			name:     "no pattern matches",
+			input:    "usr/local/bin/car",
+			patterns: []string{"usr/local/sbin", "etc"},
+		},
+		{
+			name:     "only pattern matches (exact)",
+			input:    "usr/local/bin/car",
+			patterns: []string{"usr/local/bin/car"},
+			expected: true,
+		},
+		{
+			name:     "only pattern matches (glob)",
+			input:    "usr/local/bin/car",
+			patterns: []string{"usr/local/bin/*"},
+			expected: true,
+		},
+		{
+			name:     "one pattern matches",
+			input:    "usr/local/bin/car",
+			patterns: []string{"etc", "usr/local/bin/*"},
+			expected: true,
+		},
+		{
+			name:     "invalid pattern",
+			input:    "usr/local/bin/car",
+			patterns: []string{"usr/local/bin/["},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, Matches(tc.patterns, tc.input))
+			// The same as a PatternMatcher, which also tracks the pattern matched.
+			require.Equal(t, tc.expected, New(tc.patterns, false).MatchesPattern(tc.input))
+		})
+	}
+}
+
 func TestStillMatching(t *testing.T) {
 	tests := []struct {
 		name             string
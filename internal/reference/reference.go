@@ -19,12 +19,13 @@ import (
 	"strings"
 
 	"github.com/tetratelabs/car/internal"
+	"github.com/tetratelabs/car/internal/digest"
 )
 
 type Reference struct {
 	internal.CarOnly
 
-	domain, path, tag string
+	domain, path, tag, digest string
 }
 
 // MustParse calls Parse or panics on error.
@@ -39,39 +40,77 @@ func MustParse(ref string) *Reference {
 // Parse is a simplified parser of OCI references that handle Docker
 // familiar images. This is not strict, so a bad url will result in an HTTP
 // error.
-func Parse(ref string) (r *Reference, err error) {
+//
+// The reference must include a tag, a digest or both. e.g. "alpine:3.14.0",
+// "alpine@sha256:1775..." or "alpine:3.14.0@sha256:1775...".
+//
+// A reference prefixed with "oci:" is an OCI image layout directory, which
+// optionally includes a tag or digest. e.g. "oci:./build:v1.0"
+//
+// A reference prefixed with "docker-archive:" is a "docker save" archive,
+// which optionally includes one of its "RepoTags". e.g.
+// "docker-archive:envoy.tar:envoyproxy/envoy:v1.18.3"
+func Parse(ref string) (*Reference, error) {
+	return parse(ref, true)
+}
+
+// ParseRepository is like Parse, except the tag is optional, as it is for
+// listing the tags of a repository. e.g. "envoyproxy/envoy"
+func ParseRepository(ref string) (*Reference, error) {
+	return parse(ref, false)
+}
+
+func parse(ref string, requireTag bool) (*Reference, error) {
 	if ref == "" {
-		err = errors.New("invalid reference format")
-		return
+		return nil, errors.New("invalid reference format")
+	}
+	if dir, ok := strings.CutPrefix(ref, "oci:"); ok {
+		return parseOCILayout(dir)
+	}
+	if file, ok := strings.CutPrefix(ref, "docker-archive:"); ok {
+		return parseDockerArchive(file, requireTag)
+	}
+
+	var tag, dgst string
+	remaining := ref
+
+	// A digest is always last, and can't contain a slash. e.g. "envoyproxy/envoy@sha256:..."
+	if indexAt := strings.IndexByte(remaining, byte('@')); indexAt != -1 {
+		dgst = remaining[indexAt+1:]
+		if err := digest.Validate(dgst); err != nil {
+			return nil, err
+		}
+		remaining = remaining[0:indexAt]
 	}
 
-	// First, check to see if there's at least one colon. If not, this cannot
+	// Next, check to see if there's at least one colon. If not, this cannot
 	// be a tagged image.
-	indexColon := strings.LastIndexByte(ref, byte(':'))
-	indexSlash := strings.IndexByte(ref, byte('/'))
+	indexColon := strings.LastIndexByte(remaining, byte(':'))
+	indexSlash := strings.IndexByte(remaining, byte('/'))
 	if indexColon == -1 || indexSlash > indexColon /* e.g. host:80/image */ {
-		err = errors.New("expected tagged reference")
-		return
-
+		if dgst == "" && requireTag {
+			return nil, errors.New("expected tagged reference")
+		}
+	} else {
+		tag = remaining[indexColon+1:]
+		remaining = remaining[0:indexColon]
 	}
 
-	r = &Reference{}
-	r.tag = ref[indexColon+1:]
-	remaining := ref[0:indexColon]
+	r := &Reference{tag: tag, digest: dgst}
 
 	// See if this is a familiar official docker image. e.g. "alpine:3.14.0"
 	if indexSlash == -1 {
 		r.domain = "index.docker.io"
 		r.path = "library/" + remaining
-		return
+		return r, nil
 	}
 
 	// See if this is an official docker image. e.g. "envoyproxy/envoy:v1.18.3"
-	if strings.LastIndexByte(ref, byte('/')) == indexSlash &&
+	if strings.LastIndexByte(remaining, byte('/')) == indexSlash &&
 		strings.IndexByte(remaining, byte('.')) == -1 {
 		r.domain = "index.docker.io"
 		r.path = remaining
-		return
+		return r, nil
 	}
 
 	// Otherwise, the part leading to the first slash is the domain.
@@ -83,7 +122,55 @@ func Parse(ref string) (r *Reference, err error) {
 	}
 
 	r.path = remaining[indexSlash+1:]
-	return
+	return r, nil
+}
+
+// parseOCILayout parses the directory and optional tag or digest following
+// "oci:". The directory can't include a colon after its last slash.
+func parseOCILayout(ref string) (*Reference, error) {
+	var tag, dgst string
+	dir := ref
+	if indexAt := strings.IndexByte(dir, byte('@')); indexAt != -1 {
+		dgst = dir[indexAt+1:]
+		if err := digest.Validate(dgst); err != nil {
+			return nil, err
+		}
+		dir = dir[0:indexAt]
+	}
+	if indexColon := strings.LastIndexByte(dir, byte(':')); indexColon > strings.LastIndexByte(dir, byte('/')) {
+		tag = dir[indexColon+1:]
+		dir = dir[0:indexColon]
+	}
+	if dir == "" {
+		return nil, errors.New("invalid reference format")
+	}
+	return &Reference{domain: "oci:" + dir, tag: tag, digest: dgst}, nil
+}
+
+// parseDockerArchive parses the file and optional repository tag following
+// "docker-archive:". The file can't include a colon.
+//
+// The path is the domain and path of the repository tag, e.g.
+// "index.docker.io/library/alpine", so that it can be compared regardless of
+// how a "RepoTags" element is written.
+func parseDockerArchive(ref string, requireTag bool) (*Reference, error) {
+	file, repoTag, _ := strings.Cut(ref, ":")
+	if file == "" {
+		return nil, errors.New("invalid reference format")
+	}
+	r := &Reference{domain: "docker-archive:" + file}
+	if repoTag == "" {
+		return r, nil
+	}
+	parsed, err := parse(repoTag, requireTag)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.digest != "" {
+		return nil, errors.New("docker-archive references can't include a digest")
+	}
+	r.path, r.tag = parsed.domain+"/"+parsed.path, parsed.tag
+	return r, nil
 }
 
 func (r *Reference) Domain() string {
@@ -98,7 +185,21 @@ func (r *Reference) Tag() string {
 	return r.tag
 }
 
+func (r *Reference) Digest() string {
+	return r.digest
+}
+
 // String implements fmt.Stringer
 func (r *Reference) String() string {
-	return r.domain + "/" + r.path + "/" + r.tag
+	s := r.domain
+	if r.path != "" {
+		s += "/" + r.path
+	}
+	if r.tag != "" {
+		s += "/" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
 }
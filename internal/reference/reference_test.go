@@ -21,7 +21,7 @@ import (
 )
 
 func Test_Parse(t *testing.T) {
-	tests := []struct{ name, reference, expectedDomain, expectedPath, expectedTag, expectedErr string }{
+	tests := []struct{ name, reference, expectedDomain, expectedPath, expectedTag, expectedDigest, expectedErr string }{
 		{
 			name:           "docker familiar",
 			reference:      "envoyproxy/envoy:v1.18.3",
@@ -99,11 +99,117 @@ func Test_Parse(t *testing.T) {
 			expectedPath:   "tetratelabs/car",
 			expectedTag:    "latest",
 		},
+		{
+			name:           "docker familiar digest",
+			reference:      "envoyproxy/envoy@sha256:bbfa2d6a4c2a2a8e2d2b9bbbd3a1b5f8c1cd2ec4e9ad3ad58c2df6c52b8e1b9a",
+			expectedDomain: "index.docker.io",
+			expectedPath:   "envoyproxy/envoy",
+			expectedDigest: "sha256:bbfa2d6a4c2a2a8e2d2b9bbbd3a1b5f8c1cd2ec4e9ad3ad58c2df6c52b8e1b9a",
+		},
+		{
+			name:           "docker familiar official tag and digest",
+			reference:      "alpine:3.14.0@sha256:1775bebec23e1f3ce486989bfc9ff3c4e951690df84aa9f926497d82f2ffca9d",
+			expectedDomain: "index.docker.io",
+			expectedPath:   "library/alpine",
+			expectedTag:    "3.14.0",
+			expectedDigest: "sha256:1775bebec23e1f3ce486989bfc9ff3c4e951690df84aa9f926497d82f2ffca9d",
+		},
+		{
+			name:           "port 5000 digest",
+			reference:      "registry:5000/tetratelabs/car@sha256:1775bebec23e1f3ce486989bfc9ff3c4e951690df84aa9f926497d82f2ffca9d",
+			expectedDomain: "registry:5000",
+			expectedPath:   "tetratelabs/car",
+			expectedDigest: "sha256:1775bebec23e1f3ce486989bfc9ff3c4e951690df84aa9f926497d82f2ffca9d",
+		},
+		{
+			name:           "ghcr.io multiple slashes tag and digest",
+			reference:      "ghcr.io/homebrew/core/envoy:1.18.3-1@sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+			expectedDomain: "ghcr.io",
+			expectedPath:   "homebrew/core/envoy",
+			expectedTag:    "1.18.3-1",
+			expectedDigest: "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+		},
+		{
+			name:           "oci layout",
+			reference:      "oci:./build",
+			expectedDomain: "oci:./build",
+		},
+		{
+			name:           "oci layout tag",
+			reference:      "oci:/tmp/build:v1.0",
+			expectedDomain: "oci:/tmp/build",
+			expectedTag:    "v1.0",
+		},
+		{
+			name:           "oci layout digest",
+			reference:      "oci:build@sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+			expectedDomain: "oci:build",
+			expectedDigest: "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+		},
+		{
+			name:           "oci layout colon in directory",
+			reference:      "oci:build:v1/image",
+			expectedDomain: "oci:build:v1/image",
+		},
+		{
+			name:        "oci layout missing directory",
+			reference:   "oci::v1.0",
+			expectedErr: "invalid reference format",
+		},
+		{
+			name:        "oci layout invalid digest",
+			reference:   "oci:build@sha256:bbfa",
+			expectedErr: `invalid digest format: "sha256:bbfa"`,
+		},
+		{
+			name:           "docker archive",
+			reference:      "docker-archive:envoy.tar",
+			expectedDomain: "docker-archive:envoy.tar",
+		},
+		{
+			name:           "docker archive repo tag",
+			reference:      "docker-archive:/tmp/envoy.tar:envoyproxy/envoy:v1.18.3",
+			expectedDomain: "docker-archive:/tmp/envoy.tar",
+			expectedPath:   "index.docker.io/envoyproxy/envoy",
+			expectedTag:    "v1.18.3",
+		},
+		{
+			name:           "docker archive repo tag with port",
+			reference:      "docker-archive:envoy.tar:registry:5000/tetratelabs/car:v1.0",
+			expectedDomain: "docker-archive:envoy.tar",
+			expectedPath:   "registry:5000/tetratelabs/car",
+			expectedTag:    "v1.0",
+		},
+		{
+			name:        "docker archive missing file",
+			reference:   "docker-archive::alpine:3.14.0",
+			expectedErr: "invalid reference format",
+		},
+		{
+			name:        "docker archive missing tag",
+			reference:   "docker-archive:envoy.tar:envoyproxy/envoy",
+			expectedErr: "expected tagged reference",
+		},
+		{
+			name:        "docker archive digest",
+			reference:   "docker-archive:envoy.tar:envoyproxy/envoy@sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+			expectedErr: "docker-archive references can't include a digest",
+		},
 		{
 			name:        "empty",
 			reference:   "",
 			expectedErr: "invalid reference format",
 		},
+		{
+			name:        "invalid digest",
+			reference:   "envoyproxy/envoy@sha256:bbfa",
+			expectedErr: `invalid digest format: "sha256:bbfa"`,
+		},
+		{
+			name:        "unsupported digest",
+			reference:   "envoyproxy/envoy@md5:d41d8cd98f00b204e9800998ecf8427e",
+			expectedErr: `unsupported digest algorithm: "md5:d41d8cd98f00b204e9800998ecf8427e"`,
+		},
 		{
 			name:        "docker familiar, but no tag",
 			reference:   "foo/bar",
@@ -121,6 +227,63 @@ func Test_Parse(t *testing.T) {
 
 		t.Run(tc.name, func(t *testing.T) {
 			r, err := Parse(tc.reference)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expectedDomain, r.domain)
+				require.Equal(t, tc.expectedPath, r.path)
+				require.Equal(t, tc.expectedTag, r.tag)
+				require.Equal(t, tc.expectedDigest, r.digest)
+			}
+		})
+	}
+}
+
+func TestParseRepository(t *testing.T) {
+	tests := []struct{ name, reference, expectedDomain, expectedPath, expectedTag, expectedErr string }{
+		{
+			name:           "docker familiar",
+			reference:      "envoyproxy/envoy",
+			expectedDomain: "index.docker.io",
+			expectedPath:   "envoyproxy/envoy",
+		},
+		{
+			name:           "docker familiar official",
+			reference:      "alpine",
+			expectedDomain: "index.docker.io",
+			expectedPath:   "library/alpine",
+		},
+		{
+			name:           "port",
+			reference:      "registry:5000/tetratelabs/car",
+			expectedDomain: "registry:5000",
+			expectedPath:   "tetratelabs/car",
+		},
+		{
+			name:           "tag",
+			reference:      "envoyproxy/envoy:v1.18.3",
+			expectedDomain: "index.docker.io",
+			expectedPath:   "envoyproxy/envoy",
+			expectedTag:    "v1.18.3",
+		},
+		{
+			name:           "docker archive",
+			reference:      "docker-archive:envoy.tar:envoyproxy/envoy",
+			expectedDomain: "docker-archive:envoy.tar",
+			expectedPath:   "index.docker.io/envoyproxy/envoy",
+		},
+		{
+			reference:   "",
+			expectedErr: "invalid reference format",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := ParseRepository(tc.reference)
 			if tc.expectedErr != "" {
 				require.EqualError(t, err, tc.expectedErr)
 			} else {
@@ -132,3 +295,36 @@ func Test_Parse(t *testing.T) {
 		})
 	}
 }
+
+func TestReference_String(t *testing.T) {
+	tests := []struct{ name, reference, expected string }{
+		{
+			name:      "tag",
+			reference: "envoyproxy/envoy:v1.18.3",
+			expected:  "index.docker.io/envoyproxy/envoy/v1.18.3",
+		},
+		{
+			name:      "digest",
+			reference: "envoyproxy/envoy@sha256:bbfa2d6a4c2a2a8e2d2b9bbbd3a1b5f8c1cd2ec4e9ad3ad58c2df6c52b8e1b9a",
+			expected:  "index.docker.io/envoyproxy/envoy@sha256:bbfa2d6a4c2a2a8e2d2b9bbbd3a1b5f8c1cd2ec4e9ad3ad58c2df6c52b8e1b9a",
+		},
+		{
+			name:      "tag and digest",
+			reference: "envoyproxy/envoy:v1.18.3@sha256:bbfa2d6a4c2a2a8e2d2b9bbbd3a1b5f8c1cd2ec4e9ad3ad58c2df6c52b8e1b9a",
+			expected:  "index.docker.io/envoyproxy/envoy/v1.18.3@sha256:bbfa2d6a4c2a2a8e2d2b9bbbd3a1b5f8c1cd2ec4e9ad3ad58c2df6c52b8e1b9a",
+		},
+		{
+			name:      "oci layout",
+			reference: "oci:./build:v1.0",
+			expected:  "oci:./build/v1.0",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, MustParse(tc.reference).String())
+		})
+	}
+}
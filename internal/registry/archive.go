@@ -0,0 +1,356 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	pathutil "path"
+	"strings"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal"
+	"github.com/tetratelabs/car/internal/digest"
+	"github.com/tetratelabs/car/internal/reference"
+)
+
+// dockerArchiveManifest is an element of "manifest.json" in a "docker save"
+// archive.
+//
+// See https://github.com/moby/moby/blob/master/image/tarexport/tarexport.go
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// archiveEntry is the position of a file's content in the archive.
+type archiveEntry struct {
+	offset, size int64
+}
+
+// archiveImage is an image in the archive, converted to the same types used
+// for a remote registry.
+type archiveImage struct {
+	name     string // first RepoTag, or the config file name when untagged.
+	repoTags []string
+	manifest *imageManifestV1
+	config   *imageConfigV1
+}
+
+// archive implements api.Registry for a "docker save" archive.
+type archive struct {
+	internal.CarOnly
+
+	path, url string
+	images    []*archiveImage
+	// layers are keyed by digest, so that the same file is used for layers
+	// shared between images.
+	layers map[string]archiveEntry
+}
+
+// newArchive reads the index of the archive at the path, so that each
+// ReadFilesystemLayer doesn't need to scan it.
+func newArchive(path string) (api.Registry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint
+
+	a := &archive{path: path, url: "docker-archive:" + path, layers: map[string]archiveEntry{}}
+	if err = a.index(f); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return a, nil
+}
+
+func (a *archive) index(f *os.File) error {
+	entries, err := indexArchive(f)
+	if err != nil {
+		return err
+	}
+
+	b, err := readArchiveFile(f, entries, "manifest.json")
+	if err != nil {
+		return err
+	}
+	var manifests []dockerArchiveManifest
+	if err = json.Unmarshal(b, &manifests); err != nil {
+		return fmt.Errorf("error unmarshalling manifest.json: %w", err)
+	}
+
+	for _, m := range manifests {
+		img, err := a.newArchiveImage(f, entries, m)
+		if err != nil {
+			return err
+		}
+		a.images = append(a.images, img)
+	}
+	return nil
+}
+
+// indexArchive returns the position of each regular file in the tar, also
+// keyed by the name of any link to it.
+func indexArchive(f *os.File) (map[string]archiveEntry, error) {
+	entries := map[string]archiveEntry{}
+	links := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := pathutil.Clean(th.Name)
+		switch th.Typeflag {
+		case tar.TypeReg:
+			// The tar reader doesn't buffer, so the file is now at the start of the content.
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			entries[name] = archiveEntry{offset: offset, size: th.Size}
+		case tar.TypeSymlink: // e.g. "${id}/layer.tar -> ../${otherID}/layer.tar"
+			links[name] = pathutil.Join(pathutil.Dir(name), th.Linkname)
+		case tar.TypeLink:
+			links[name] = pathutil.Clean(th.Linkname)
+		}
+	}
+	for name, target := range links {
+		if e, ok := entries[target]; ok {
+			entries[name] = e
+		}
+	}
+	return entries, nil
+}
+
+func readArchiveFile(f *os.File, entries map[string]archiveEntry, name string) ([]byte, error) {
+	e, ok := entries[name]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+	b := make([]byte, e.size)
+	if _, err := f.ReadAt(b, e.offset); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return b, nil
+}
+
+func (a *archive) newArchiveImage(f *os.File, entries map[string]archiveEntry, m dockerArchiveManifest) (*archiveImage, error) {
+	b, err := readArchiveFile(f, entries, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	config := imageConfigV1{}
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s: %w", m.Config, err)
+	}
+
+	manifest := &imageManifestV1{
+		URL:    a.url + "/" + m.Config,
+		Config: descriptorV1{MediaType: api.MediaTypeDockerContainerImage, Digest: digest.FromBytes(b), Size: int64(len(b))},
+	}
+	for i, name := range m.Layers {
+		e, ok := entries[pathutil.Clean(name)]
+		if !ok {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		var diffID string
+		if i < len(config.RootFS.DiffIDs) {
+			diffID = config.RootFS.DiffIDs[i]
+		}
+		layer, err := archiveLayer(f, e, name, diffID)
+		if err != nil {
+			return nil, err
+		}
+		a.layers[layer.Digest] = e
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+
+	img := &archiveImage{name: m.Config, repoTags: m.RepoTags, manifest: manifest, config: &config}
+	if len(m.RepoTags) > 0 {
+		img.name = m.RepoTags[0]
+	}
+	return img, nil
+}
+
+var (
+	// gzipMagic are the first bytes of a gzip stream.
+	gzipMagic = []byte{0x1f, 0x8b}
+	// zstdMagic are the first bytes of a zstd stream.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// archiveLayer returns a descriptor of the layer file. Layers are usually
+// uncompressed, but recent versions of Docker can save them compressed. Either
+// way, they are described with an OCI layer media type, so they are read like
+// any other layer of that format.
+func archiveLayer(f *os.File, e archiveEntry, name, diffID string) (descriptorV1, error) {
+	layer := descriptorV1{MediaType: api.MediaTypeOCIImageLayerUncompressed, Size: e.size}
+	magic := make([]byte, len(zstdMagic))
+	if n, _ := io.NewSectionReader(f, e.offset, e.size).ReadAt(magic, 0); bytes.HasPrefix(magic[:n], gzipMagic) {
+		layer.MediaType = api.MediaTypeOCIImageLayer
+	} else if bytes.HasPrefix(magic[:n], zstdMagic) {
+		layer.MediaType = api.MediaTypeOCIImageLayerZstd
+	}
+
+	// Prefer a digest implied by the name or config, to avoid reading the layer.
+	if algorithm, encoded, ok := strings.Cut(strings.TrimPrefix(name, "blobs/"), "/"); ok && digest.Validate(algorithm+":"+encoded) == nil {
+		layer.Digest = algorithm + ":" + encoded // e.g. "blobs/sha256/03ef..."
+	} else if diffID != "" && layer.MediaType == api.MediaTypeOCIImageLayerUncompressed {
+		layer.Digest = diffID // the digest of an uncompressed layer.
+	} else {
+		dgst, err := digest.FromReader(io.NewSectionReader(f, e.offset, e.size))
+		if err != nil {
+			return layer, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		layer.Digest = dgst
+	}
+	return layer, nil
+}
+
+func (a *archive) String() string {
+	return a.url
+}
+
+// GetImage implements the same method as documented on api.Registry
+//
+// The image is selected by matching the reference to the "RepoTags" in the
+// archive, or is the only image when the reference has no tag.
+func (a *archive) GetImage(_ context.Context, ref api.Reference, platform string) (api.Image, error) {
+	img, err := a.findImage(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = requireConfigPlatform(platform, img.config); err != nil {
+		return nil, err
+	}
+	return newImage(a.url, img.manifest, img.config), nil
+}
+
+// ListPlatforms implements the same method as documented on api.Registry
+//
+// Images in an archive have no manifest, so this is the platform of the image
+// selected the same way as GetImage.
+func (a *archive) ListPlatforms(_ context.Context, ref api.Reference) ([]api.Platform, error) {
+	img, err := a.findImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	return []api.Platform{{
+		OS:           img.config.OS,
+		Architecture: img.config.Architecture,
+		Variant:      img.config.Variant,
+		OSVersion:    img.config.OSVersion,
+		OSFeatures:   img.config.OSFeatures,
+	}}, nil
+}
+
+// ListTags implements the same method as documented on api.Registry
+//
+// These are the tags of the "RepoTags" in the archive that match the
+// repository of the reference, or each "RepoTags" when it has no repository.
+func (a *archive) ListTags(_ context.Context, ref api.Reference) ([]string, error) {
+	var tags []string
+	for _, img := range a.images {
+		for _, repoTag := range img.repoTags {
+			if ref.Path() == "" {
+				tags = append(tags, repoTag)
+				continue
+			}
+			r, err := reference.Parse(repoTag)
+			if err == nil && r.Domain()+"/"+r.Path() == ref.Path() {
+				tags = append(tags, r.Tag())
+			}
+		}
+	}
+	if len(tags) == 0 && ref.Path() != "" {
+		return nil, &api.NotFoundError{What: ref.Path(), Where: a.path}
+	}
+	return tags, nil
+}
+
+// Resolve implements the same method as documented on api.Registry
+//
+// Images in an archive have no manifest, so this is the image config.
+func (a *archive) Resolve(_ context.Context, ref api.Reference) (api.Descriptor, error) {
+	img, err := a.findImage(ref)
+	if err != nil {
+		return api.Descriptor{}, err
+	}
+	config := img.manifest.Config
+	return api.Descriptor{MediaType: config.MediaType, Digest: config.Digest, Size: config.Size}, nil
+}
+
+func (a *archive) findImage(ref api.Reference) (*archiveImage, error) {
+	if ref.Tag() == "" {
+		if len(a.images) == 1 {
+			return a.images[0], nil
+		}
+		names := map[string]string{}
+		for _, img := range a.images {
+			names[img.name] = ""
+		}
+		return nil, &api.AmbiguousImageError{Images: sortedKeys(names)}
+	}
+
+	// Compare parsed RepoTags, as they can be familiar, e.g. "alpine:3.14.0"
+	// instead of "docker.io/library/alpine:3.14.0".
+	for _, img := range a.images {
+		for _, repoTag := range img.repoTags {
+			r, err := reference.Parse(repoTag)
+			if err == nil && r.Domain()+"/"+r.Path() == ref.Path() && r.Tag() == ref.Tag() {
+				return img, nil
+			}
+		}
+	}
+	return nil, &api.NotFoundError{What: ref.Path() + ":" + ref.Tag(), Where: a.path}
+}
+
+// ReadFilesystemLayer implements the same method as documented on api.Registry
+func (a *archive) ReadFilesystemLayer(_ context.Context, layer api.FilesystemLayer, readFile api.ReadFile) error {
+	l := layer.(filesystemLayer)
+	e, ok := a.layers[l.digest]
+	if !ok {
+		return &api.NotFoundError{What: l.url, Where: a.path}
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint
+
+	verifier, err := digest.NewVerifier(l.digest, io.NewSectionReader(f, e.offset, e.size))
+	if err != nil {
+		return err
+	}
+	if err = readLayer(verifier, layer, readFile); err != nil {
+		return err
+	}
+	if err = verifier.Verify(); err != nil {
+		return fmt.Errorf("invalid layer from %s: %w", l.url, err)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/digest"
+	"github.com/tetratelabs/car/internal/reference"
+)
+
+const (
+	archivePath   = "testdata/docker-archive.tar"
+	archiveLayer0 = "sha256:02fbe9739782164b3c61b854a136a0d20613c5240d990d5b32441a1d53049846"
+)
+
+var imageArchiveLayer = filesystemLayer{
+	url:       "docker-archive:" + archivePath + "/blobs/" + archiveLayer0,
+	digest:    archiveLayer0,
+	mediaType: api.MediaTypeOCIImageLayerUncompressed,
+	size:      3072,
+}
+
+func TestArchive_GetImage(t *testing.T) {
+	userRepo := image{
+		url:      "docker-archive:" + archivePath + "/66329dc078c55b43bff726535f5d68663e215e34096720b67d0ed6f1870b50b4.json",
+		platform: "linux/amd64",
+		filesystemLayers: []filesystemLayer{
+			{
+				url:       imageArchiveLayer.url,
+				digest:    imageArchiveLayer.digest,
+				diffID:    archiveLayer0,
+				mediaType: imageArchiveLayer.mediaType,
+				size:      imageArchiveLayer.size,
+				createdBy: "COPY hello /hello # buildkit",
+			},
+		},
+	}
+	alpine := image{
+		url:      "docker-archive:" + archivePath + "/cefd3c3407138d0f4c6532a2b278b9865e6d09106308bdf159c0895fa008f9fc.json",
+		platform: "linux/arm64",
+		filesystemLayers: []filesystemLayer{
+			{
+				url:       imageArchiveLayer.url,
+				digest:    imageArchiveLayer.digest,
+				diffID:    archiveLayer0,
+				mediaType: imageArchiveLayer.mediaType,
+				size:      imageArchiveLayer.size,
+				createdBy: "/bin/sh -c #(nop) ADD file:abc in / ",
+			},
+		},
+	}
+
+	tests := []struct {
+		name, reference, platform string
+		expected                  api.Image
+		expectedErr               string
+	}{
+		{
+			name:      "repo tag",
+			reference: "docker-archive:" + archivePath + ":user/repo:v1.0",
+			expected:  userRepo,
+		},
+		{
+			name:      "repo tag and platform",
+			reference: "docker-archive:" + archivePath + ":user/repo:v1.0",
+			platform:  "linux/amd64",
+			expected:  userRepo,
+		},
+		{
+			name:      "familiar in archive",
+			reference: "docker-archive:" + archivePath + ":docker.io/library/alpine:3.14.0",
+			expected:  alpine,
+		},
+		{
+			name:      "fully qualified in archive",
+			reference: "docker-archive:" + archivePath + ":alpine:latest",
+			expected:  alpine,
+		},
+		{
+			name:        "no repo tag",
+			reference:   "docker-archive:" + archivePath,
+			expectedErr: "choose an image: alpine:3.14.0, user/repo:v1.0",
+		},
+		{
+			name:        "unknown repo tag",
+			reference:   "docker-archive:" + archivePath + ":user/repo:v2.0",
+			expectedErr: "index.docker.io/user/repo:v2.0 not found in " + archivePath,
+		},
+		{
+			name:        "wrong platform",
+			reference:   "docker-archive:" + archivePath + ":user/repo:v1.0",
+			platform:    "linux/arm64",
+			expectedErr: "linux/arm64 is not a supported platform: linux/amd64",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ref := reference.MustParse(tc.reference)
+			r, err := New(context.Background(), ref.Domain())
+			require.NoError(t, err)
+
+			img, err := r.GetImage(context.Background(), ref, tc.platform)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, img)
+			}
+		})
+	}
+}
+
+func TestArchive_GetImage_Ambiguous(t *testing.T) {
+	ref := reference.MustParse("docker-archive:" + archivePath)
+	r, err := New(context.Background(), ref.Domain())
+	require.NoError(t, err)
+
+	_, err = r.GetImage(context.Background(), ref, "")
+	var ambiguous *api.AmbiguousImageError
+	require.ErrorAs(t, err, &ambiguous)
+	require.Equal(t, []string{"alpine:3.14.0", "user/repo:v1.0"}, ambiguous.Images)
+}
+
+func TestArchive_ListPlatforms(t *testing.T) {
+	ref := reference.MustParse("docker-archive:" + archivePath + ":alpine:latest")
+	r, err := New(context.Background(), ref.Domain())
+	require.NoError(t, err)
+
+	platforms, err := r.ListPlatforms(context.Background(), ref)
+	require.NoError(t, err)
+	require.Equal(t, []api.Platform{{OS: "linux", Architecture: "arm64"}}, platforms)
+}
+
+func TestArchive_ListTags(t *testing.T) {
+	tests := []struct {
+		name, reference string
+		expected        []string
+		expectedErr     string
+	}{
+		{
+			name:      "repository",
+			reference: "docker-archive:" + archivePath + ":alpine",
+			expected:  []string{"3.14.0", "latest"},
+		},
+		{
+			name:      "no repository",
+			reference: "docker-archive:" + archivePath,
+			expected:  []string{"user/repo:v1.0", "alpine:3.14.0", "docker.io/library/alpine:latest"},
+		},
+		{
+			name:        "unknown repository",
+			reference:   "docker-archive:" + archivePath + ":user/other",
+			expectedErr: "index.docker.io/user/other not found in " + archivePath,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := reference.ParseRepository(tc.reference)
+			require.NoError(t, err)
+			r, err := New(context.Background(), ref.Domain())
+			require.NoError(t, err)
+
+			tags, err := r.ListTags(context.Background(), ref)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, tags)
+			}
+		})
+	}
+}
+
+func TestArchive_Resolve(t *testing.T) {
+	ref := reference.MustParse("docker-archive:" + archivePath + ":user/repo:v1.0")
+	r, err := New(context.Background(), ref.Domain())
+	require.NoError(t, err)
+
+	d, err := r.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	require.Equal(t, api.Descriptor{
+		MediaType: api.MediaTypeDockerContainerImage,
+		Digest:    "sha256:66329dc078c55b43bff726535f5d68663e215e34096720b67d0ed6f1870b50b4",
+		Size:      220,
+	}, d)
+}
+
+func TestArchive_ReadFilesystemLayer(t *testing.T) {
+	r, err := New(context.Background(), "docker-archive:"+archivePath)
+	require.NoError(t, err)
+
+	var names []string
+	err = r.ReadFilesystemLayer(context.Background(), imageArchiveLayer,
+		func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+			names = append(names, name)
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, []string{"./", "./hello/", "./hello/README.txt"}, names)
+}
+
+func TestArchive_ReadFilesystemLayer_Unknown(t *testing.T) {
+	r, err := New(context.Background(), "docker-archive:"+archivePath)
+	require.NoError(t, err)
+
+	layer := filesystemLayer{url: "docker-archive:" + archivePath + "/blobs/" + trivyManifestDigest, digest: trivyManifestDigest}
+	err = r.ReadFilesystemLayer(context.Background(), layer, nil)
+	require.EqualError(t, err, layer.url+" not found in "+archivePath)
+	require.ErrorIs(t, err, api.ErrNotFound)
+}
+
+func TestArchiveLayer(t *testing.T) {
+	tarGzDigest := "sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a"
+	tarZstDigest := digest.FromBytes(tarZst)
+
+	tests := []struct {
+		name, path, layerName, diffID string
+		expected                      descriptorV1
+	}{
+		{
+			name:      "digest from name",
+			path:      "testdata/test.tar.gz",
+			layerName: "blobs/sha256/dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a",
+			expected:  descriptorV1{MediaType: api.MediaTypeOCIImageLayer, Digest: tarGzDigest, Size: int64(len(tarGz))},
+		},
+		{
+			name:      "compressed ignores diff_id",
+			path:      "testdata/test.tar.gz",
+			layerName: "abc/layer.tar",
+			diffID:    archiveLayer0,
+			expected:  descriptorV1{MediaType: api.MediaTypeOCIImageLayer, Digest: tarGzDigest, Size: int64(len(tarGz))},
+		},
+		{
+			name:      "zstd",
+			path:      "testdata/test.tar.zst",
+			layerName: "abc/layer.tar",
+			diffID:    archiveLayer0,
+			expected:  descriptorV1{MediaType: api.MediaTypeOCIImageLayerZstd, Digest: tarZstDigest, Size: int64(len(tarZst))},
+		},
+		{
+			name:      "uncompressed uses diff_id",
+			path:      "testdata/test.tar",
+			layerName: "abc/layer.tar",
+			diffID:    archiveLayer0,
+			expected:  descriptorV1{MediaType: api.MediaTypeOCIImageLayerUncompressed, Digest: archiveLayer0, Size: int64(len(tarUncompressed))},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(tc.path)
+			require.NoError(t, err)
+			defer f.Close()
+			stat, err := f.Stat()
+			require.NoError(t, err)
+
+			layer, err := archiveLayer(f, archiveEntry{size: stat.Size()}, tc.layerName, tc.diffID)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, layer)
+		})
+	}
+}
+
+func TestArchive_Invalid(t *testing.T) {
+	notArchive := filepath.Join(t.TempDir(), "empty.tar")
+	require.NoError(t, os.WriteFile(notArchive, make([]byte, 1024), 0o600)) // two empty blocks
+
+	tests := []struct{ name, path, expectedErr string }{
+		{
+			name:        "missing file",
+			path:        "testdata/missing.tar",
+			expectedErr: "open testdata/missing.tar: no such file or directory",
+		},
+		{
+			name:        "missing manifest.json",
+			path:        notArchive,
+			expectedErr: "error reading " + notArchive + ": missing manifest.json",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(context.Background(), "docker-archive:"+tc.path)
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
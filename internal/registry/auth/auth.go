@@ -0,0 +1,411 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth authenticates to registries, such as Docker Hub or GitHub, using
+// their WWW-Authenticate challenge and credentials configured by "docker login".
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	urlpkg "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/car/internal/httpclient"
+)
+
+// Credentials are what "docker login" configured for a registry host.
+type Credentials struct {
+	// Username and Password are used for Basic auth, or to get a Bearer token.
+	Username, Password string
+
+	// IdentityToken is an OAuth2 refresh token used to get a Bearer token.
+	IdentityToken string
+
+	// RegistryToken is a Bearer token sent to the registry as-is.
+	RegistryToken string
+}
+
+// BasicAuth returns the Authorization header value for Basic auth, or empty if
+// there is no Username.
+func (c *Credentials) BasicAuth() string {
+	if c == nil || c.Username == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// challengeAuth authenticates to a registry host as its WWW-Authenticate
+// challenge instructs, caching Bearer tokens per repository scope.
+//
+// See https://distribution.github.io/distribution/spec/auth/token/
+type challengeAuth struct {
+	host string
+	// lookup and now are variables for testing
+	lookup func(ctx context.Context, host string) (*Credentials, error)
+	now    func() time.Time
+
+	// lookupOnce defers running any credential helper until the first
+	// challenge, as anonymous requests don't need one.
+	lookupOnce sync.Once
+
+	mu    sync.Mutex
+	creds *Credentials
+	// realm and service are from the last Bearer challenge, which allows
+	// getting tokens for new scopes without first receiving a 401.
+	realm, service string
+	// basic is true when the host challenged for Basic auth.
+	basic bool
+	// tokens are keyed by scope, e.g. "repository:user/repo:pull"
+	tokens map[string]*token
+	// fetches are the token requests in progress, keyed like tokens. Requests
+	// for the same scope wait on one fetch, without holding mu.
+	fetches map[string]*fetch
+}
+
+type token struct {
+	value   string
+	expires time.Time // zero if the token doesn't expire
+}
+
+func (t *token) valid(now time.Time) bool {
+	return t != nil && (t.expires.IsZero() || now.Before(t.expires))
+}
+
+// fetch is a token request, whose result is set before done is closed.
+type fetch struct {
+	done  chan struct{}
+	token *token
+	err   error
+}
+
+// NewRoundTripper returns a transport that authorizes requests to the host
+// after it responds with a WWW-Authenticate challenge.
+//
+// Credentials are looked up on the first challenge. If that fails, e.g. due
+// to a broken credential helper, Bearer tokens are requested anonymously, as
+// public images don't need credentials. Use ContextWithOnLookupError to see
+// why.
+//
+// A RegistryToken is sent as-is. Requests to other hosts, such as a CDN a blob
+// redirected to, are not authorized, as they would leak credentials.
+func NewRoundTripper(host string) http.RoundTripper {
+	return &challengeAuth{
+		host: host, lookup: Lookup, now: time.Now,
+		tokens: map[string]*token{}, fetches: map[string]*fetch{},
+	}
+}
+
+type contextOnLookupErrorKey struct{}
+
+// ContextWithOnLookupError returns a context that calls onLookupError when
+// credentials for a host can't be looked up, before continuing without them.
+// For example, to print the error when very verbose.
+func ContextWithOnLookupError(ctx context.Context, onLookupError func(host string, err error)) context.Context {
+	return context.WithValue(ctx, contextOnLookupErrorKey{}, onLookupError)
+}
+
+// credentials returns the credentials for the host, looking them up on the
+// first call.
+func (c *challengeAuth) credentials(ctx context.Context) *Credentials {
+	c.lookupOnce.Do(func() {
+		creds, err := c.lookup(ctx, c.host)
+		if onLookupError, ok := ctx.Value(contextOnLookupErrorKey{}).(func(string, error)); ok && err != nil {
+			onLookupError(c.host, err)
+		}
+		c.mu.Lock()
+		c.creds = creds
+		c.mu.Unlock()
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.creds
+}
+
+// registryToken returns the Authorization header value for a RegistryToken,
+// or empty if credentials weren't looked up yet or don't include one.
+func (c *challengeAuth) registryToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds == nil || c.creds.RegistryToken == "" {
+		return ""
+	}
+	return "Bearer " + c.creds.RegistryToken
+}
+
+func (c *challengeAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	transport := httpclient.TransportFromContext(ctx)
+	if req.URL.Host != c.host {
+		return transport.RoundTrip(req)
+	}
+	if registryToken := c.registryToken(); registryToken != "" {
+		req.Header.Set("Authorization", registryToken)
+		return transport.RoundTrip(req)
+	}
+
+	scope := repositoryScope(req.URL.Path)
+	authorization, err := c.authorization(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	var next string
+	if creds := c.credentials(ctx); creds != nil && creds.RegistryToken != "" {
+		next = "Bearer " + creds.RegistryToken
+	} else if next, err = c.onChallenge(ctx, res.Header.Get("WWW-Authenticate"), scope, authorization); err != nil {
+		res.Body.Close() //nolint
+		return nil, err
+	}
+	if next == "" || next == authorization {
+		return res, nil // there's no other way to authorize, so let the caller handle the 401.
+	}
+	res.Body.Close() //nolint
+
+	retry := req.Clone(ctx)
+	retry.Header.Set("Authorization", next)
+	return transport.RoundTrip(retry)
+}
+
+// authorization returns the Authorization header value to send before any
+// challenge, or empty if the host hasn't yet challenged.
+func (c *challengeAuth) authorization(ctx context.Context, scope string) (string, error) {
+	c.mu.Lock()
+	basic, realm, service := c.basic, c.realm, c.service
+	c.mu.Unlock()
+
+	switch {
+	case basic:
+		return c.credentials(ctx).BasicAuth(), nil
+	case realm != "" && scope != "": // a cached token, or a new one for the scope
+		return c.bearerToken(ctx, realm, service, scope, scope, "")
+	}
+	return "", nil
+}
+
+// onChallenge returns the Authorization header value that satisfies the
+// WWW-Authenticate challenge, or empty if there's none. rejected is the
+// Authorization header value the challenge responded to.
+func (c *challengeAuth) onChallenge(ctx context.Context, header, scope, rejected string) (string, error) {
+	scheme, params := parseChallenge(header)
+	switch scheme {
+	case "basic":
+		basicAuth := c.credentials(ctx).BasicAuth()
+		c.mu.Lock()
+		c.basic = basicAuth != ""
+		c.mu.Unlock()
+		return basicAuth, nil
+	case "bearer":
+		realm := params["realm"]
+		if realm == "" {
+			return "", nil
+		}
+		c.mu.Lock()
+		c.realm, c.service = realm, params["service"]
+		c.mu.Unlock()
+		tokenScope := scope
+		if s := params["scope"]; s != "" {
+			tokenScope = s
+		}
+		return c.bearerToken(ctx, realm, params["service"], tokenScope, scope, rejected)
+	}
+	return "", nil
+}
+
+// bearerToken returns the cached token for cacheScope, unless it expired or is
+// the rejected one. Otherwise, it gets a token for the scope and caches it
+// under cacheScope, the scope of the request it authorizes.
+//
+// Concurrent calls for the same cacheScope share one token request. Other
+// scopes aren't blocked, as mu isn't held while waiting for it.
+func (c *challengeAuth) bearerToken(ctx context.Context, realm, service, scope, cacheScope, rejected string) (string, error) {
+	c.mu.Lock()
+	if t := c.tokens[cacheScope]; t.valid(c.now()) && "Bearer "+t.value != rejected {
+		c.mu.Unlock()
+		return "Bearer " + t.value, nil
+	}
+	f, ok := c.fetches[cacheScope]
+	if !ok {
+		f = &fetch{done: make(chan struct{})}
+		c.fetches[cacheScope] = f
+	}
+	c.mu.Unlock()
+
+	if ok { // another request is getting the token
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	} else {
+		f.token, f.err = c.fetchToken(ctx, realm, service, scope)
+		c.mu.Lock()
+		delete(c.fetches, cacheScope)
+		if f.err == nil {
+			c.tokens[cacheScope] = f.token
+		}
+		c.mu.Unlock()
+		close(f.done)
+	}
+	if f.err != nil {
+		return "", f.err
+	}
+	return "Bearer " + f.token.value, nil
+}
+
+// clientID identifies this tool when exchanging a refresh token.
+const clientID = "car"
+
+// defaultExpiresIn is used when the token response doesn't include
+// "expires_in", per the token authentication specification.
+const defaultExpiresIn = 60
+
+// tokenResponse includes both "token" and "access_token" as registries differ
+// on which they set, and fields to know when to get a new token.
+//
+// See https://distribution.github.io/distribution/spec/auth/token/#token-response-fields
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in,omitempty"`
+	IssuedAt    time.Time `json:"issued_at,omitempty"`
+}
+
+// fetchToken gets a Bearer token from the realm, using the OAuth2 refresh
+// token flow when there's an IdentityToken, or otherwise a GET with Basic
+// auth, which is anonymous when there are no credentials.
+func (c *challengeAuth) fetchToken(ctx context.Context, realm, service, scope string) (*token, error) {
+	form := urlpkg.Values{}
+	if service != "" {
+		form.Set("service", service)
+	}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+
+	creds := c.credentials(ctx)
+	var req *http.Request
+	var err error
+	if creds != nil && creds.IdentityToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", clientID)
+		form.Set("refresh_token", creds.IdentityToken)
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(form.Encode())); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm, nil); err != nil {
+			return nil, err
+		}
+		req.URL.RawQuery = form.Encode()
+		if basicAuth := creds.BasicAuth(); basicAuth != "" {
+			req.Header.Set("Authorization", basicAuth)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "") // don't add implicit User-Agent
+
+	client := http.Client{Transport: httpclient.TransportFromContext(ctx)}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() //nolint
+
+	if res.StatusCode != http.StatusOK {
+		return nil, httpclient.NewRegistryError(realm, res)
+	}
+	var tr tokenResponse
+	if err = json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("error unmarshalling token from %q: %w", realm, err)
+	}
+	value := tr.Token
+	if value == "" {
+		value = tr.AccessToken
+	}
+	if value == "" {
+		return nil, fmt.Errorf("invalid bearer token from %q", realm)
+	}
+
+	issuedAt, expiresIn := tr.IssuedAt, tr.ExpiresIn
+	if issuedAt.IsZero() {
+		issuedAt = c.now()
+	}
+	if expiresIn <= 0 {
+		expiresIn = defaultExpiresIn
+	}
+	return &token{value: value, expires: issuedAt.Add(time.Duration(expiresIn) * time.Second)}, nil
+}
+
+// repositoryScope returns the pull scope of the repository in the URL path,
+// or empty if the path isn't for a repository. e.g.
+// "/v2/user/repo/manifests/v1.0" -> "repository:user/repo:pull"
+func repositoryScope(path string) string {
+	afterV2, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return ""
+	}
+	for _, endpoint := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.Index(afterV2, endpoint); i > 0 {
+			return "repository:" + afterV2[:i] + ":pull"
+		}
+	}
+	return ""
+}
+
+// parseChallenge returns the lower-case scheme and parameters of a
+// WWW-Authenticate header. e.g.
+// `Bearer realm="https://ghcr.io/token",service="ghcr.io"`
+//
+// Note: This only parses the first challenge, as registries only send one.
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params = map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) { // quoted values can include commas, e.g. scope="repository:a:pull,push"
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[key], rest = b.String(), value[min(i+1, len(value)):]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(params[key])
+		}
+	}
+	return strings.ToLower(scheme), params
+}
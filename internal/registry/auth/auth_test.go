@@ -0,0 +1,572 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/internal/httpclient"
+)
+
+const (
+	manifestURL = "https://registry.example.com/v2/user/repo/manifests/v1.0"
+	blobURL     = "https://registry.example.com/v2/user/repo/blobs/sha256:28b3"
+	otherURL    = "https://registry.example.com/v2/user/other/manifests/v1.0"
+	cdnURL      = "https://cdn.example.com/blobs/sha256/28/28b3"
+
+	manifestRequest = `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+
+`
+	bearerChallenge = `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:user/repo:pull"`
+	tokenRequest    = `GET /token?scope=repository%3Auser%2Frepo%3Apull&service=registry.example.com HTTP/1.1
+Host: auth.example.com
+Accept: application/json
+
+`
+	authorizedManifestRequest = `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+Authorization: Bearer a
+
+`
+)
+
+func TestRoundTripper(t *testing.T) {
+	tests := []struct {
+		name        string
+		creds       *Credentials
+		urls        []string
+		exchanges   []exchange
+		expectedErr string
+	}{
+		{
+			name: "no challenge",
+			urls: []string{manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusOK},
+			},
+		},
+		{
+			name: "anonymous bearer",
+			urls: []string{manifestURL, blobURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: tokenRequest, status: http.StatusOK, body: `{"token":"a"}`},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+				{request: `GET /v2/user/repo/blobs/sha256:28b3 HTTP/1.1
+Host: registry.example.com
+Authorization: Bearer a
+
+`, status: http.StatusOK}, // token is cached
+			},
+		},
+		{
+			name:  "bearer with username and password",
+			creds: &Credentials{Username: "user", Password: "pass"},
+			urls:  []string{manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: `GET /token?scope=repository%3Auser%2Frepo%3Apull&service=registry.example.com HTTP/1.1
+Host: auth.example.com
+Accept: application/json
+Authorization: Basic dXNlcjpwYXNz
+
+`, status: http.StatusOK, body: `{"access_token":"a"}`},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+			},
+		},
+		{
+			name:  "bearer with identity token",
+			creds: &Credentials{IdentityToken: "refresh"},
+			urls:  []string{manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: `POST /token HTTP/1.1
+Host: auth.example.com
+Content-Length: 127
+Accept: application/json
+Content-Type: application/x-www-form-urlencoded
+
+client_id=car&grant_type=refresh_token&refresh_token=refresh&scope=repository%3Auser%2Frepo%3Apull&service=registry.example.com`, status: http.StatusOK, body: `{"access_token":"a"}`},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+			},
+		},
+		{
+			name: "bearer new scope",
+			urls: []string{manifestURL, otherURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: tokenRequest, status: http.StatusOK, body: `{"token":"a"}`},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+				// The realm is known, so the token is requested without a challenge.
+				{request: `GET /token?scope=repository%3Auser%2Fother%3Apull&service=registry.example.com HTTP/1.1
+Host: auth.example.com
+Accept: application/json
+
+`, status: http.StatusOK, body: `{"token":"b"}`},
+				{request: `GET /v2/user/other/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+Authorization: Bearer b
+
+`, status: http.StatusOK},
+			},
+		},
+		{
+			name: "bearer expired",
+			urls: []string{manifestURL, manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: tokenRequest, status: http.StatusOK, body: `{"token":"a"}`},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+				{request: authorizedManifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: tokenRequest, status: http.StatusOK, body: `{"token":"b"}`},
+				{request: `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+Authorization: Bearer b
+
+`, status: http.StatusOK},
+			},
+		},
+		{
+			name: "bearer token error",
+			urls: []string{manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: tokenRequest, status: http.StatusForbidden},
+			},
+			expectedErr: `received 403 status code from "https://auth.example.com/token"`,
+		},
+		{
+			name: "bearer token missing",
+			urls: []string{manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: tokenRequest, status: http.StatusOK, body: `{}`},
+			},
+			expectedErr: `invalid bearer token from "https://auth.example.com/token"`,
+		},
+		{
+			name:  "basic",
+			creds: &Credentials{Username: "user", Password: "pass"},
+			urls:  []string{manifestURL, manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: `Basic realm="registry"`},
+				{request: `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+Authorization: Basic dXNlcjpwYXNz
+
+`, status: http.StatusOK},
+				{request: `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+Authorization: Basic dXNlcjpwYXNz
+
+`, status: http.StatusOK}, // no second challenge
+			},
+		},
+		{
+			name: "basic without credentials",
+			urls: []string{manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: `Basic realm="registry"`},
+			},
+			expectedErr: "received 401 status code",
+		},
+		{
+			name:  "registry token",
+			creds: &Credentials{Username: "user", Password: "pass", RegistryToken: "a"},
+			urls:  []string{manifestURL, manifestURL},
+			exchanges: []exchange{
+				{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+				{request: authorizedManifestRequest, status: http.StatusOK},
+			},
+		},
+		{
+			name:  "other host",
+			creds: &Credentials{RegistryToken: "a"},
+			urls:  []string{cdnURL},
+			exchanges: []exchange{
+				{request: `GET /blobs/sha256/28/28b3 HTTP/1.1
+Host: cdn.example.com
+
+`, status: http.StatusOK},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			real := &mock{t: t, exchanges: tc.exchanges}
+			ctx := httpclient.ContextWithTransport(context.Background(), real)
+			transport := newTestRoundTripper(tc.creds, nil)
+
+			var err error
+			for _, url := range tc.urls {
+				var u *urlpkg.URL
+				u, err = urlpkg.Parse(url)
+				require.NoError(t, err)
+				req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{"User-Agent": {""}}}
+				var res *http.Response
+				if res, err = transport.RoundTrip(req.WithContext(ctx)); err != nil {
+					break
+				}
+				res.Body.Close() //nolint
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("received %v status code", res.StatusCode)
+					break
+				}
+			}
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, len(tc.exchanges), real.i, "unexpected count of requests")
+		})
+	}
+}
+
+// testNow is a fixed time, so that tests can control token expiry.
+var testNow = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestRoundTripper_TokenExpires(t *testing.T) {
+	real := &mock{t: t, exchanges: []exchange{
+		{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+		{request: tokenRequest, status: http.StatusOK, body: `{"token":"a","expires_in":300}`},
+		{request: authorizedManifestRequest, status: http.StatusOK},
+		{request: authorizedManifestRequest, status: http.StatusOK},
+		// The realm is known, so the expired token is replaced without a challenge.
+		{request: tokenRequest, status: http.StatusOK, body: `{"token":"b","expires_in":300}`},
+		{request: `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
+Host: registry.example.com
+Authorization: Bearer b
+
+`, status: http.StatusOK},
+	}}
+	ctx := httpclient.ContextWithTransport(context.Background(), real)
+	transport := newTestRoundTripper(nil, nil)
+	now := testNow
+	transport.now = func() time.Time { return now }
+
+	for _, elapsed := range []time.Duration{0, 299 * time.Second, 301 * time.Second} {
+		now = testNow.Add(elapsed)
+		u, err := urlpkg.Parse(manifestURL)
+		require.NoError(t, err)
+		req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{"User-Agent": {""}}}
+		res, err := transport.RoundTrip(req.WithContext(ctx))
+		require.NoError(t, err)
+		res.Body.Close() //nolint
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	require.Equal(t, len(real.exchanges), real.i, "unexpected count of requests")
+}
+
+func TestRoundTripper_LookupError(t *testing.T) {
+	real := &mock{t: t, exchanges: []exchange{
+		{request: manifestRequest, status: http.StatusUnauthorized, challenge: bearerChallenge},
+		{request: tokenRequest, status: http.StatusOK, body: `{"token":"a"}`},
+		{request: authorizedManifestRequest, status: http.StatusOK},
+	}}
+	ctx := httpclient.ContextWithTransport(context.Background(), real)
+	var lookupErrors []string
+	ctx = ContextWithOnLookupError(ctx, func(host string, err error) {
+		lookupErrors = append(lookupErrors, fmt.Sprintf("%s: %v", host, err))
+	})
+	var lookups int
+	transport := newTestRoundTripper(nil, nil)
+	transport.lookup = func(context.Context, string) (*Credentials, error) {
+		lookups++
+		return nil, errors.New("error running docker-credential-broken: exit status 1")
+	}
+
+	u, err := urlpkg.Parse(manifestURL)
+	require.NoError(t, err)
+	req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{"User-Agent": {""}}}
+	res, err := transport.RoundTrip(req.WithContext(ctx))
+	require.NoError(t, err) // continues anonymously
+	res.Body.Close()        //nolint
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, 1, lookups)
+	require.Equal(t, []string{"registry.example.com: error running docker-credential-broken: exit status 1"}, lookupErrors)
+	require.Equal(t, len(real.exchanges), real.i, "unexpected count of requests")
+}
+
+func TestRoundTripper_Concurrent(t *testing.T) {
+	var tokenRequests atomic.Int32
+	real := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.URL.Host == "auth.example.com":
+			tokenRequests.Add(1)
+			return newResponse(http.StatusOK, `{"token":"a","expires_in":300}`), nil
+		case req.Header.Get("Authorization") != "Bearer a":
+			res := newResponse(http.StatusUnauthorized, "")
+			res.Header.Set("WWW-Authenticate", bearerChallenge)
+			return res, nil
+		}
+		return newResponse(http.StatusOK, "{}"), nil
+	})
+	ctx := httpclient.ContextWithTransport(context.Background(), real)
+	transport := newTestRoundTripper(nil, nil)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, _ := urlpkg.Parse(manifestURL)
+			req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}
+			if res, err := transport.RoundTrip(req.WithContext(ctx)); err == nil {
+				statuses[i] = res.StatusCode
+				res.Body.Close() //nolint
+			}
+		}()
+	}
+	wg.Wait()
+	for _, s := range statuses {
+		require.Equal(t, http.StatusOK, s)
+	}
+	require.Equal(t, int32(1), tokenRequests.Load())
+}
+
+// TestRoundTripper_SlowScope ensures a slow token request for one repository
+// doesn't block requests to another.
+func TestRoundTripper_SlowScope(t *testing.T) {
+	otherDone := make(chan struct{})
+	real := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		scope := req.URL.Query().Get("scope")
+		switch {
+		case scope == "repository:user/repo:pull":
+			select {
+			case <-otherDone:
+			case <-time.After(5 * time.Second):
+				return nil, fmt.Errorf("token request for %s blocked another repository", scope)
+			}
+			return newResponse(http.StatusOK, `{"token":"a"}`), nil
+		case scope != "":
+			return newResponse(http.StatusOK, `{"token":"b"}`), nil
+		case req.Header.Get("Authorization") == "":
+			res := newResponse(http.StatusUnauthorized, "")
+			res.Header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+			return res, nil
+		}
+		return newResponse(http.StatusOK, "{}"), nil
+	})
+	ctx := httpclient.ContextWithTransport(context.Background(), real)
+	transport := newTestRoundTripper(nil, nil)
+
+	get := func(url string) error {
+		u, _ := urlpkg.Parse(url)
+		req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}
+		res, err := transport.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close() //nolint
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d from %s", res.StatusCode, url)
+		}
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- get(manifestURL) }()
+	require.NoError(t, get(otherURL))
+	close(otherDone)
+	require.NoError(t, <-errs)
+}
+
+func TestFetchToken_Expires(t *testing.T) {
+	issuedAt := testNow.Add(-10 * time.Second)
+	tests := []struct {
+		name, body string
+		expected   time.Time
+	}{
+		{
+			name:     "default",
+			body:     `{"token":"a"}`,
+			expected: testNow.Add(defaultExpiresIn * time.Second),
+		},
+		{
+			name:     "expires_in",
+			body:     `{"token":"a","expires_in":300}`,
+			expected: testNow.Add(300 * time.Second),
+		},
+		{
+			name:     "expires_in and issued_at",
+			body:     `{"token":"a","expires_in":300,"issued_at":"` + issuedAt.Format(time.RFC3339) + `"}`,
+			expected: issuedAt.Add(300 * time.Second),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := httpclient.ContextWithTransport(context.Background(), &mock{t: t, exchanges: []exchange{
+				{request: tokenRequest, status: http.StatusOK, body: tc.body},
+			}})
+			c := newTestRoundTripper(nil, nil)
+			c.now = func() time.Time { return testNow }
+
+			tok, err := c.fetchToken(ctx, "https://auth.example.com/token", "registry.example.com", "repository:user/repo:pull")
+			require.NoError(t, err)
+			require.Equal(t, &token{value: "a", expires: tc.expected}, tok)
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		name, header   string
+		expectedScheme string
+		expectedParams map[string]string
+	}{
+		{
+			name:           "empty",
+			expectedParams: map[string]string{},
+		},
+		{
+			name:           "basic",
+			header:         `Basic realm="Registry Realm"`,
+			expectedScheme: "basic",
+			expectedParams: map[string]string{"realm": "Registry Realm"},
+		},
+		{
+			name:           "bearer",
+			header:         bearerChallenge,
+			expectedScheme: "bearer",
+			expectedParams: map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry.example.com",
+				"scope":   "repository:user/repo:pull",
+			},
+		},
+		{
+			name:           "comma in scope",
+			header:         `Bearer realm="https://auth.example.com/token", scope="repository:user/repo:pull,push"`,
+			expectedScheme: "bearer",
+			expectedParams: map[string]string{
+				"realm": "https://auth.example.com/token",
+				"scope": "repository:user/repo:pull,push",
+			},
+		},
+		{
+			name:           "unquoted and escaped",
+			header:         `Bearer Realm=https://auth.example.com/token,error="insufficient \"scope\""`,
+			expectedScheme: "bearer",
+			expectedParams: map[string]string{
+				"realm": "https://auth.example.com/token",
+				"error": `insufficient "scope"`,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			scheme, params := parseChallenge(tc.header)
+			require.Equal(t, tc.expectedScheme, scheme)
+			require.Equal(t, tc.expectedParams, params)
+		})
+	}
+}
+
+func TestRepositoryScope(t *testing.T) {
+	tests := []struct{ path, expected string }{
+		{path: "/v2/"},
+		{path: "/v2/_catalog"},
+		{path: "/v2/user/repo/manifests/v1.0", expected: "repository:user/repo:pull"},
+		{path: "/v2/org/team/repo/blobs/sha256:28b3", expected: "repository:org/team/repo:pull"},
+		{path: "/v2/user/repo/tags/list", expected: "repository:user/repo:pull"},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.path, func(t *testing.T) {
+			require.Equal(t, tc.expected, repositoryScope(tc.path))
+		})
+	}
+}
+
+func TestCredentials_BasicAuth(t *testing.T) {
+	require.Equal(t, "", (*Credentials)(nil).BasicAuth())
+	require.Equal(t, "", (&Credentials{IdentityToken: "refresh"}).BasicAuth())
+	require.Equal(t, "Basic dXNlcjpwYXNz", (&Credentials{Username: "user", Password: "pass"}).BasicAuth())
+}
+
+type exchange struct {
+	request   string
+	status    int
+	challenge string
+	body      string
+}
+
+type mock struct {
+	t         *testing.T
+	i         int
+	exchanges []exchange
+}
+
+func (m *mock) RoundTrip(req *http.Request) (*http.Response, error) {
+	raw := new(bytes.Buffer)
+	req.Write(raw) //nolint
+	require.Less(m.t, m.i, len(m.exchanges), "unexpected request: %s", raw)
+	e := m.exchanges[m.i]
+	require.Equal(m.t, e.request, strings.ReplaceAll(raw.String(), "\r\n", "\n"))
+	m.i++
+
+	header := http.Header{}
+	if e.challenge != "" {
+		header.Set("WWW-Authenticate", e.challenge)
+	}
+	return &http.Response{StatusCode: e.status, Header: header, Body: io.NopCloser(strings.NewReader(e.body))}, nil
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newResponse(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+// newTestRoundTripper returns a transport for "registry.example.com", whose
+// credential lookup returns creds and err.
+func newTestRoundTripper(creds *Credentials, err error) *challengeAuth {
+	c := NewRoundTripper("registry.example.com").(*challengeAuth)
+	c.lookup = func(context.Context, string) (*Credentials, error) { return creds, err }
+	return c
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubServerAddress is the key "docker login" uses for Docker Hub, which
+// differs from its registry host "index.docker.io".
+const dockerHubServerAddress = "https://index.docker.io/v1/"
+
+// configFile is the subset of the Docker CLI "config.json" we use.
+//
+// See https://github.com/docker/cli/blob/master/cli/config/configfile/file.go
+type configFile struct {
+	Auths       map[string]authConfig `json:"auths"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+type authConfig struct {
+	Auth          string `json:"auth,omitempty"` // base64 encoded "username:password"
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+// helperResponse is what a "docker-credential-*" helper prints on "get".
+//
+// See https://github.com/docker/docker-credential-helpers
+type helperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// helperTokenUsername is the Username a helper returns when the Secret is an
+// identity token instead of a password.
+const helperTokenUsername = "<token>"
+
+// Lookup returns the credentials for the registry host configured in the
+// Docker CLI "config.json", or nil if there are none.
+//
+// The config is read from the directory in the DOCKER_CONFIG environment
+// variable, defaulting to "~/.docker". Credential helpers ("credHelpers" or
+// "credsStore") are preferred over inline "auths".
+func Lookup(ctx context.Context, host string) (*Credentials, error) {
+	config, err := readConfigFile()
+	if err != nil || config == nil {
+		return nil, err
+	}
+
+	serverAddress := host
+	if normalizeHost(host) == "index.docker.io" {
+		serverAddress = dockerHubServerAddress
+	}
+
+	helper := config.CredHelpers[host]
+	if helper == "" {
+		helper = config.CredsStore
+	}
+	if helper != "" {
+		creds, err := runHelper(ctx, helper, serverAddress)
+		if err != nil || creds != nil {
+			return creds, err
+		}
+	}
+
+	for key, a := range config.Auths {
+		if normalizeHost(key) == normalizeHost(host) {
+			return a.credentials(key)
+		}
+	}
+	return nil, nil
+}
+
+func readConfigFile() (*configFile, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil // no home directory means no config.
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	path := filepath.Join(dir, "config.json")
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config := configFile{}
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+func (a authConfig) credentials(key string) (*Credentials, error) {
+	creds := &Credentials{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+		RegistryToken: a.RegistryToken,
+	}
+	if a.Auth != "" {
+		b, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth for %s: %w", key, err)
+		}
+		var ok bool
+		if creds.Username, creds.Password, ok = strings.Cut(string(b), ":"); !ok {
+			return nil, fmt.Errorf("invalid auth for %s: expected username:password", key)
+		}
+	}
+	if *creds == (Credentials{}) {
+		return nil, nil // e.g. only an email, which is left when using a credsStore.
+	}
+	return creds, nil
+}
+
+// runHelper executes "docker-credential-${helper} get", or returns nil if it
+// has no credentials for the server address.
+func runHelper(ctx context.Context, helper, serverAddress string) (*Credentials, error) {
+	name := "docker-credential-" + helper
+	cmd := exec.CommandContext(ctx, name, "get") //nolint:gosec
+	cmd.Stdin = strings.NewReader(serverAddress)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// Helpers write "credentials not found in native keychain" on a miss.
+		if out := stdout.String() + stderr.String(); strings.Contains(out, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error running %s: %w", name, err)
+	}
+
+	var res helperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s response: %w", name, err)
+	}
+	if res.Username == helperTokenUsername {
+		return &Credentials{IdentityToken: res.Secret}, nil
+	}
+	return &Credentials{Username: res.Username, Password: res.Secret}, nil
+}
+
+// normalizeHost strips any scheme or path from a "config.json" key, and maps
+// Docker Hub aliases to "index.docker.io". e.g.
+// "https://index.docker.io/v1/" -> "index.docker.io"
+func normalizeHost(key string) string {
+	host := key
+	if _, after, ok := strings.Cut(host, "://"); ok {
+		host = after
+	}
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		host = host[:i]
+	}
+	switch host {
+	case "docker.io", "registry-1.docker.io":
+		return "index.docker.io"
+	}
+	return host
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// helperScript prints credentials for "ghcr.io" and docker hub, and otherwise
+// fails like docker-credential-osxkeychain.
+const helperScript = `#!/bin/sh
+read server
+case "$server" in
+  ghcr.io) echo '{"ServerURL":"ghcr.io","Username":"helper","Secret":"pass"}' ;;
+  https://index.docker.io/v1/) echo '{"ServerURL":"https://index.docker.io/v1/","Username":"<token>","Secret":"refresh"}' ;;
+  *) echo 'credentials not found in native keychain'; exit 1 ;;
+esac
+`
+
+func TestLookup(t *testing.T) {
+	binDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-test"), []byte(helperScript), 0o700))            //nolint:gosec
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-broken"), []byte("#!/bin/sh\nexit 2\n"), 0o700)) //nolint:gosec
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name, config, host string
+		expected           *Credentials
+		expectedErr        string
+	}{
+		{
+			name:   "no config",
+			host:   "ghcr.io",
+			config: "",
+		},
+		{
+			name:     "auths",
+			host:     "registry.example.com",
+			config:   `{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`,
+			expected: &Credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:     "auths username and password",
+			host:     "registry.example.com",
+			config:   `{"auths":{"registry.example.com":{"username":"user","password":"pass"}}}`,
+			expected: &Credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:     "auths identity token",
+			host:     "registry.example.com",
+			config:   `{"auths":{"registry.example.com":{"identitytoken":"refresh"}}}`,
+			expected: &Credentials{IdentityToken: "refresh"},
+		},
+		{
+			name:     "auths registry token",
+			host:     "registry.example.com",
+			config:   `{"auths":{"registry.example.com":{"registrytoken":"token"}}}`,
+			expected: &Credentials{RegistryToken: "token"},
+		},
+		{
+			name:     "auths key with scheme",
+			host:     "registry.example.com",
+			config:   `{"auths":{"https://registry.example.com/v1/":{"auth":"dXNlcjpwYXNz"}}}`,
+			expected: &Credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:     "auths docker hub",
+			host:     "index.docker.io",
+			config:   `{"auths":{"https://index.docker.io/v1/":{"auth":"dXNlcjpwYXNz"}}}`,
+			expected: &Credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:   "auths other host",
+			host:   "ghcr.io",
+			config: `{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`,
+		},
+		{
+			name:   "auths only email",
+			host:   "registry.example.com",
+			config: `{"auths":{"registry.example.com":{"email":"user@example.com"}}}`,
+		},
+		{
+			name:        "auths invalid base64",
+			host:        "registry.example.com",
+			config:      `{"auths":{"registry.example.com":{"auth":"!"}}}`,
+			expectedErr: "invalid auth for registry.example.com: illegal base64 data at input byte 0",
+		},
+		{
+			name:        "auths missing colon",
+			host:        "registry.example.com",
+			config:      `{"auths":{"registry.example.com":{"auth":"dXNlcg=="}}}`,
+			expectedErr: "invalid auth for registry.example.com: expected username:password",
+		},
+		{
+			name:     "credHelpers",
+			host:     "ghcr.io",
+			config:   `{"credHelpers":{"ghcr.io":"test"}}`,
+			expected: &Credentials{Username: "helper", Password: "pass"},
+		},
+		{
+			name:     "credsStore",
+			host:     "ghcr.io",
+			config:   `{"credsStore":"test"}`,
+			expected: &Credentials{Username: "helper", Password: "pass"},
+		},
+		{
+			name:     "credsStore identity token",
+			host:     "index.docker.io",
+			config:   `{"credsStore":"test"}`,
+			expected: &Credentials{IdentityToken: "refresh"},
+		},
+		{
+			name:     "credHelpers preferred over credsStore",
+			host:     "ghcr.io",
+			config:   `{"credsStore":"broken","credHelpers":{"ghcr.io":"test"}}`,
+			expected: &Credentials{Username: "helper", Password: "pass"},
+		},
+		{
+			name:     "credsStore not found falls back to auths",
+			host:     "registry.example.com",
+			config:   `{"credsStore":"test","auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`,
+			expected: &Credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name:        "credsStore error",
+			host:        "ghcr.io",
+			config:      `{"credsStore":"broken"}`,
+			expectedErr: "error running docker-credential-broken: exit status 2",
+		},
+		{
+			name:        "invalid config",
+			host:        "ghcr.io",
+			config:      `{`,
+			expectedErr: "config.json: unexpected end of JSON input",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("DOCKER_CONFIG", dir)
+			if tc.config != "" {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(tc.config), 0o600))
+			}
+
+			creds, err := Lookup(context.Background(), tc.host)
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, creds)
+			}
+		})
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct{ key, expected string }{
+		{key: "ghcr.io", expected: "ghcr.io"},
+		{key: "localhost:5000", expected: "localhost:5000"},
+		{key: "https://registry.example.com", expected: "registry.example.com"},
+		{key: "https://index.docker.io/v1/", expected: "index.docker.io"},
+		{key: "docker.io", expected: "index.docker.io"},
+		{key: "registry-1.docker.io", expected: "index.docker.io"},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.key, func(t *testing.T) {
+			require.Equal(t, tc.expected, normalizeHost(tc.key))
+		})
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache stores registry content by digest in a directory shared across
+// runs, so that a manifest, config or layer read before isn't downloaded
+// again.
+//
+// Only content requested by digest is cached, as what a tag points to can
+// change. The directory has the same "blobs/${algorithm}/${encoded}" layout as
+// an OCI image layout.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/car/internal/digest"
+	"github.com/tetratelabs/car/internal/registry/ocilayout"
+)
+
+// Cache is a directory of content by digest, optionally bounded by size.
+type Cache struct {
+	dir     string
+	maxSize int64
+	// mu serializes eviction, as several blobs can be written at once.
+	mu sync.Mutex
+}
+
+// New returns a cache in the directory, which is created on first write.
+//
+// When maxSize is positive, writing content evicts the least recently used
+// until the directory is no larger than maxSize bytes.
+func New(dir string, maxSize int64) *Cache {
+	return &Cache{dir: dir, maxSize: maxSize}
+}
+
+type contextCacheKey struct{}
+
+// FromContext returns the Cache in the context or nil
+func FromContext(ctx context.Context) *Cache {
+	if v, ok := ctx.Value(contextCacheKey{}).(*Cache); ok {
+		return v
+	}
+	return nil
+}
+
+// ContextWithCache returns a context with a Cache for registries to use
+func ContextWithCache(ctx context.Context, c *Cache) context.Context {
+	return context.WithValue(ctx, contextCacheKey{}, c)
+}
+
+// NewRoundTripper returns a transport that responds to GET requests ending in
+// "/manifests/${digest}" or "/blobs/${digest}" with content in the cache.
+// Otherwise, it uses next and writes the response body to the cache as it is
+// read, keeping it only if it matches the digest.
+//
+// Failing to write to the cache doesn't fail the request, as the content can
+// be read again.
+func NewRoundTripper(c *Cache, next http.RoundTripper) http.RoundTripper {
+	return &roundTripper{cache: c, next: next}
+}
+
+type roundTripper struct {
+	cache *Cache
+	next  http.RoundTripper
+}
+
+func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	dgst, isManifest := cacheable(req)
+	if dgst == "" {
+		return r.next.RoundTrip(req)
+	}
+
+	if res := r.cache.get(dgst, isManifest); res != nil {
+		return res, nil
+	}
+
+	res, err := r.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+	if w, err := r.cache.newWriter(dgst, res.Body); err == nil {
+		res.Body = w
+	}
+	return res, nil
+}
+
+// cacheable returns the digest a GET request is for, or empty if it is for a
+// tag or isn't a request for content.
+//
+// A request with a "Range" header, e.g. to resume a download, isn't cacheable,
+// as it is for part of the content.
+func cacheable(req *http.Request) (dgst string, isManifest bool) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return "", false
+	}
+	path := req.URL.Path
+	if i := strings.LastIndex(path, "/blobs/"); i != -1 {
+		dgst = path[i+len("/blobs/"):]
+	} else if i = strings.LastIndex(path, "/manifests/"); i != -1 {
+		dgst, isManifest = path[i+len("/manifests/"):], true
+	}
+	if digest.Validate(dgst) != nil {
+		return "", false
+	}
+	return dgst, isManifest
+}
+
+// path returns the path to the content, e.g. "blobs/sha256/03ef...".
+func (c *Cache) path(dgst string) string {
+	algorithm, encoded, _ := strings.Cut(dgst, ":")
+	return filepath.Join(c.dir, "blobs", algorithm, encoded)
+}
+
+// get returns a response with the content of the digest, or nil if it isn't
+// in the cache or can't be read, so that it is requested instead.
+func (c *Cache) get(dgst string, isManifest bool) *http.Response {
+	path := c.path(dgst)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		f.Close() //nolint
+		return nil
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now) // so that eviction keeps what is used
+
+	// A blob is read by digest, so its media type is ignored. A manifest's is
+	// needed to know whether it is an image index.
+	mediaType := "application/octet-stream"
+	var body io.ReadCloser = f
+	if isManifest {
+		b, err := io.ReadAll(f)
+		f.Close() //nolint
+		if err != nil {
+			return nil
+		}
+		mediaType = ocilayout.ManifestMediaType(b)
+		body = io.NopCloser(bytes.NewReader(b))
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":          []string{mediaType},
+			"Content-Length":        []string{strconv.FormatInt(stat.Size(), 10)},
+			"Docker-Content-Digest": []string{dgst},
+		},
+		ContentLength: stat.Size(),
+		Body:          body,
+	}
+}
+
+// writer writes a response body to a temporary file in the cache as it is
+// read, and moves it into place when read to the end, if it matches the
+// digest.
+type writer struct {
+	cache    *Cache
+	dgst     string
+	body     io.ReadCloser
+	verifier *digest.Verifier
+	// file is nil once committed or aborted.
+	file *os.File
+}
+
+func (c *Cache) newWriter(dgst string, body io.ReadCloser) (*writer, error) {
+	dir := filepath.Dir(c.path(dgst))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	verifier, err := digest.NewVerifier(dgst, body)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(c.path(dgst))+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{cache: c, dgst: dgst, body: body, verifier: verifier, file: file}, nil
+}
+
+// Read implements io.Reader
+func (w *writer) Read(p []byte) (int, error) {
+	n, err := w.verifier.Read(p)
+	if w.file != nil && n > 0 {
+		if _, werr := w.file.Write(p[:n]); werr != nil {
+			w.abort()
+		}
+	}
+	if err == io.EOF && w.file != nil {
+		w.commit()
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (w *writer) Close() error {
+	if w.file != nil { // closed before the end, so the content is incomplete.
+		w.abort()
+	}
+	return w.body.Close()
+}
+
+func (w *writer) commit() {
+	name := w.file.Name()
+	if w.verifier.Verify() != nil {
+		w.abort()
+		return
+	}
+	err := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = os.Rename(name, w.cache.path(w.dgst))
+	}
+	if err != nil {
+		os.Remove(name) //nolint
+		return
+	}
+	w.cache.evict() //nolint
+}
+
+func (w *writer) abort() {
+	w.file.Close()           //nolint
+	os.Remove(w.file.Name()) //nolint
+	w.file = nil
+}
+
+// evict removes the least recently used content until the cache is no larger
+// than maxSize.
+func (c *Cache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	err := filepath.WalkDir(filepath.Join(c.dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if err = os.Remove(e.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/digest"
+)
+
+var (
+	index       = []byte(`{"manifests":[]}`)
+	indexDigest = digest.FromBytes(index)
+	blob        = []byte("hello")
+	blobDigest  = digest.FromBytes(blob)
+)
+
+// origin responds with the body, counting requests.
+type origin struct {
+	body     []byte
+	requests int
+}
+
+func (o *origin) RoundTrip(*http.Request) (*http.Response, error) {
+	o.requests++
+	return &http.Response{
+		Status: "200 OK", StatusCode: http.StatusOK,
+		Header: http.Header{"Content-Type": []string{"application/x-origin"}},
+		Body:   io.NopCloser(bytes.NewReader(o.body)),
+	}, nil
+}
+
+func get(t *testing.T, transport http.RoundTripper, url string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	res, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, b
+}
+
+func TestRoundTripper(t *testing.T) {
+	tests := []struct {
+		name, url         string
+		body              []byte
+		expectedMediaType string
+		expectedRequests  int
+	}{
+		{
+			name:              "blob",
+			url:               "https://test/v2/user/repo/blobs/" + blobDigest,
+			body:              blob,
+			expectedMediaType: "application/octet-stream",
+			expectedRequests:  1,
+		},
+		{
+			name:              "manifest digest",
+			url:               "https://test/v2/user/repo/manifests/" + indexDigest,
+			body:              index,
+			expectedMediaType: api.MediaTypeOCIImageIndex,
+			expectedRequests:  1,
+		},
+		{
+			name:              "tag isn't cached",
+			url:               "https://test/v2/user/repo/manifests/v1.0",
+			body:              index,
+			expectedMediaType: "application/x-origin",
+			expectedRequests:  2,
+		},
+		{
+			name:              "digest mismatch isn't cached",
+			url:               "https://test/v2/user/repo/blobs/" + blobDigest,
+			body:              index,
+			expectedMediaType: "application/x-origin",
+			expectedRequests:  2,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			o := &origin{body: tc.body}
+			transport := NewRoundTripper(New(t.TempDir(), 0), o)
+
+			_, b := get(t, transport, tc.url)
+			require.Equal(t, tc.body, b)
+
+			res, b := get(t, transport, tc.url)
+			require.Equal(t, tc.body, b)
+			require.Equal(t, tc.expectedMediaType, res.Header.Get("Content-Type"))
+			require.Equal(t, tc.expectedRequests, o.requests)
+		})
+	}
+}
+
+func TestRoundTripper_ClosedBeforeEnd(t *testing.T) {
+	c := New(t.TempDir(), 0)
+	o := &origin{body: blob}
+	transport := NewRoundTripper(c, o)
+
+	req, err := http.NewRequest(http.MethodGet, "https://test/v2/user/repo/blobs/"+blobDigest, nil)
+	require.NoError(t, err)
+	res, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	_, err = res.Body.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	entries, err := os.ReadDir(filepath.Join(c.dir, "blobs", "sha256"))
+	require.NoError(t, err)
+	require.Empty(t, entries) // neither the blob nor its temporary file
+}
+
+func TestRoundTripper_Range(t *testing.T) {
+	c := New(t.TempDir(), 0)
+	get(t, NewRoundTripper(c, &origin{body: blob}), "https://test/v2/user/repo/blobs/"+blobDigest)
+
+	// The origin responds to the range, not the cache with the whole blob.
+	o := &origin{body: blob[1:]}
+	req, err := http.NewRequest(http.MethodGet, "https://test/v2/user/repo/blobs/"+blobDigest, nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=1-")
+	res, err := NewRoundTripper(c, o).RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, blob[1:], b)
+	require.Equal(t, 1, o.requests)
+}
+
+func TestRoundTripper_Unreadable(t *testing.T) {
+	tests := []struct{ name, url, dgst string }{
+		{name: "blob", url: "https://test/v2/user/repo/blobs/" + blobDigest, dgst: blobDigest},
+		{name: "manifest", url: "https://test/v2/user/repo/manifests/" + indexDigest, dgst: indexDigest},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(t.TempDir(), 0)
+			require.NoError(t, os.MkdirAll(c.path(tc.dgst), 0o755)) // a directory can't be read as content
+
+			o := &origin{body: blob}
+			_, b := get(t, NewRoundTripper(c, o), tc.url)
+			require.Equal(t, blob, b)
+			require.Equal(t, 1, o.requests)
+		})
+	}
+}
+
+func TestEvict(t *testing.T) {
+	c := New(t.TempDir(), int64(len(blob)+len(index)))
+	transport := NewRoundTripper(c, &origin{body: blob})
+	get(t, transport, "https://test/v2/user/repo/blobs/"+blobDigest)
+	transport = NewRoundTripper(c, &origin{body: index})
+	get(t, transport, "https://test/v2/user/repo/manifests/"+indexDigest)
+
+	// Make the blob the most recently used.
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(c.path(blobDigest), old, old))
+	require.NoError(t, os.Chtimes(c.path(indexDigest), old, old))
+	get(t, transport, "https://test/v2/user/repo/blobs/"+blobDigest)
+
+	// Adding content larger than the remaining space evicts the index.
+	other := []byte("world")
+	transport = NewRoundTripper(c, &origin{body: other})
+	get(t, transport, "https://test/v2/user/repo/blobs/"+digest.FromBytes(other))
+
+	require.FileExists(t, c.path(blobDigest))
+	require.FileExists(t, c.path(digest.FromBytes(other)))
+	require.NoFileExists(t, c.path(indexDigest))
+}
+
+func TestContextWithCache(t *testing.T) {
+	require.Nil(t, FromContext(context.Background()))
+
+	c := New(t.TempDir(), 0)
+	require.Same(t, c, FromContext(ContextWithCache(context.Background(), c)))
+}
@@ -17,8 +17,9 @@ package fake
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/tetratelabs/car/api"
@@ -30,6 +31,7 @@ type image struct {
 	internal.CarOnly
 
 	platform string
+	layers   []filesystemLayer
 }
 
 // Platform implements the same method as documented on api.Image
@@ -39,7 +41,7 @@ func (i image) Platform() string {
 
 // FilesystemLayerCount implements the same method as documented on api.Image
 func (i image) FilesystemLayerCount() int {
-	return len(fakeFilesystemLayers)
+	return len(i.layers)
 }
 
 // FilesystemLayer implements the same method as documented on api.Image
@@ -47,7 +49,27 @@ func (i image) FilesystemLayer(idx int) api.FilesystemLayer {
 	if idx < 0 || idx >= i.FilesystemLayerCount() {
 		return nil
 	}
-	return fakeFilesystemLayers[idx]
+	return i.layers[idx]
+}
+
+// ManifestDigest implements the same method as documented on api.Image
+func (i image) ManifestDigest() string {
+	return "sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17"
+}
+
+// ManifestMediaType implements the same method as documented on api.Image
+func (i image) ManifestMediaType() string {
+	return api.MediaTypeDockerManifest
+}
+
+// IndexDigest implements the same method as documented on api.Image
+func (i image) IndexDigest() string {
+	return "sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68"
+}
+
+// Config implements the same method as documented on api.Image
+func (i image) Config() api.ImageConfig {
+	return fakeConfig
 }
 
 // String implements fmt.Stringer
@@ -88,6 +110,21 @@ func (f filesystemLayer) FileName() string {
 	return f.fileName
 }
 
+// Digest implements the same method as documented on api.FilesystemLayer
+func (f filesystemLayer) Digest() string {
+	return "sha256:" + f.sha256
+}
+
+// DiffID implements the same method as documented on api.FilesystemLayer
+func (f filesystemLayer) DiffID() string {
+	return ""
+}
+
+// Annotations implements the same method as documented on api.FilesystemLayer
+func (f filesystemLayer) Annotations() map[string]string {
+	return nil
+}
+
 // String implements fmt.Stringer
 func (f filesystemLayer) String() string {
 	return f.sha256
@@ -105,14 +142,60 @@ var Registry = &fakeRegistry{
 	tag:      "v1.0",
 }
 
+// WhiteoutsTag is an image with the layers of tag "v1.0", and one more whose
+// whiteouts delete "bin/apple.txt" and "usr/local/bin/boat" when squashed.
+const WhiteoutsTag = "v1.0-whiteouts"
+
 func (f *fakeRegistry) GetImage(_ context.Context, ref api.Reference, platform string) (api.Image, error) {
 	if platform != "" && platform != f.platform {
-		return nil, fmt.Errorf("platform %s not found", platform)
+		return nil, &api.NotFoundError{What: "platform " + platform}
+	}
+	switch ref.Tag() {
+	case f.tag:
+		return image{platform: f.platform, layers: fakeFilesystemLayers}, nil
+	case WhiteoutsTag:
+		return image{platform: f.platform, layers: append(slices.Clip(fakeFilesystemLayers), whiteoutsLayer)}, nil
 	}
+	return nil, &api.NotFoundError{What: "tag " + ref.Tag()}
+}
+
+func (f *fakeRegistry) ListPlatforms(_ context.Context, ref api.Reference) ([]api.Platform, error) {
+	if ref.Tag() != f.tag {
+		return nil, &api.NotFoundError{What: "tag " + ref.Tag()}
+	}
+	platformOS, arch, _ := strings.Cut(f.platform, "/")
+	return []api.Platform{
+		{
+			OS:           platformOS,
+			Architecture: arch,
+			Digest:       image{}.ManifestDigest(),
+			MediaType:    image{}.ManifestMediaType(),
+			Size:         1234,
+		},
+		{
+			OS:           "windows",
+			Architecture: "amd64",
+			OSVersion:    "10.0.17763.1879",
+			OSFeatures:   []string{"win32k"},
+			Digest:       "sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129",
+			MediaType:    api.MediaTypeDockerManifest,
+			Size:         2345,
+		},
+	}, nil
+}
+
+func (f *fakeRegistry) ListTags(_ context.Context, ref api.Reference) ([]string, error) {
+	if ref.Path() != "tetratelabs/car" {
+		return nil, &api.NotFoundError{What: "repository " + ref.Path()}
+	}
+	return []string{"latest", "v0.9", f.tag, "v1.0-rc1", "v1.10.0", "v1.9.0"}, nil
+}
+
+func (f *fakeRegistry) Resolve(_ context.Context, ref api.Reference) (api.Descriptor, error) {
 	if ref.Tag() != f.tag {
-		return nil, fmt.Errorf("tag %s not found", ref.Tag())
+		return api.Descriptor{}, &api.NotFoundError{What: "tag " + ref.Tag()}
 	}
-	return image{platform: f.platform}, nil
+	return api.Descriptor{MediaType: api.MediaTypeDockerManifestList, Digest: image{}.IndexDigest(), Size: 743}, nil
 }
 
 func (f *fakeRegistry) ReadFilesystemLayer(_ context.Context, layer api.FilesystemLayer, readFile api.ReadFile) error {
@@ -124,8 +207,11 @@ func (f *fakeRegistry) ReadFilesystemLayer(_ context.Context, layer api.Filesyst
 			break
 		}
 	}
+	if sha256 == whiteoutsLayer.sha256 {
+		files = whiteoutsFiles
+	}
 	if files == nil {
-		return fmt.Errorf("layer %s not found", sha256)
+		return &api.NotFoundError{What: "layer " + sha256}
 	}
 	for i, file := range files {
 		modTime, err := time.Parse(time.RFC3339, file.modTimeRFC3339)
@@ -139,7 +225,7 @@ func (f *fakeRegistry) ReadFilesystemLayer(_ context.Context, layer api.Filesyst
 			fakeFile[j] = byte(i)
 		}
 
-		err = readFile(file.name, file.size, file.mode, modTime, bytes.NewReader(fakeFile))
+		err = readFile(file.name, file.size, file.mode, modTime, file.linkName, bytes.NewReader(fakeFile))
 		if err != nil {
 			return err
 		}
@@ -147,6 +233,16 @@ func (f *fakeRegistry) ReadFilesystemLayer(_ context.Context, layer api.Filesyst
 	return nil
 }
 
+// fakeConfig runs the car binary added by the second layer.
+var fakeConfig = api.ImageConfig{
+	User:       "nobody",
+	Env:        []string{"PATH=/usr/local/bin:/usr/bin:/bin"},
+	Entrypoint: []string{"/usr/local/bin/car"},
+	Cmd:        []string{"--help"},
+	WorkingDir: "/",
+	Labels:     map[string]string{"org.opencontainers.image.version": "v1.0"},
+}
+
 // fakeFilesystemLayers is pair-indexed with fakeFiles
 var fakeFilesystemLayers = []filesystemLayer{
 	{
@@ -180,23 +276,42 @@ type fakeFile struct {
 	size           int64
 	mode           os.FileMode
 	modTimeRFC3339 string
+	linkName       string
 }
 
 // fakeFiles is pair-indexed with fakeFilesystemLayers.
 // The fake data intentionally overlaps on "usr/local" for testing. Even if weird, it adds windows paths.
+// It includes a directory and links.
 var fakeFiles = [][]*fakeFile{
 	{
 		// intentionally leading slash
-		{"/bin/apple.txt", 10, 0o640 & os.ModePerm, "2020-06-07T06:28:15Z"},
-		{"usr/local/bin/boat", 20, 0o755 & os.ModePerm, "2021-04-16T22:53:09Z"},
+		{"/bin/apple.txt", 10, 0o640 & os.ModePerm, "2020-06-07T06:28:15Z", ""},
+		{"usr/local/bin/", 0, os.ModeDir | 0o755&os.ModePerm, "2021-04-16T22:53:09Z", ""},
+		{"usr/local/bin/boat", 20, 0o755 & os.ModePerm, "2021-04-16T22:53:09Z", ""},
+		{"usr/local/boat", 0, os.ModeSymlink | 0o777&os.ModePerm, "2021-04-16T22:53:09Z", "bin/boat"},
 	},
 	{
-		{"usr/local/bin/car", 30, 0o755 & os.ModePerm, "2021-05-12T03:53:29Z"},
+		{"usr/local/bin/car", 30, 0o755 & os.ModePerm, "2021-05-12T03:53:29Z", ""},
+		{"usr/local/bin/van", 0, 0o755 & os.ModePerm, "2021-05-12T03:53:29Z", "usr/local/bin/car"},
 	},
 	{
-		{"Files/ProgramData/truck/bin/truck.exe", 40, 0o644 & os.ModePerm, "2021-05-12T03:53:15Z"},
+		{"Files/ProgramData/truck/bin/truck.exe", 40, 0o644 & os.ModePerm, "2021-05-12T03:53:15Z", ""},
 	},
 	{
-		{"usr/local/sbin/car", 50, 0o755 & os.ModePerm, "2021-05-12T03:53:29Z"},
+		{"usr/local/sbin/car", 50, 0o755 & os.ModePerm, "2021-05-12T03:53:29Z", ""},
 	},
 }
+
+// whiteoutsLayer is the top layer of WhiteoutsTag.
+var whiteoutsLayer = filesystemLayer{
+	sha256:    "9eb6b6c364da71575aa5cc6b125411d39c13200bdefebcf734c834e386548eb9",
+	mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+	size:      20,
+	createdBy: `RUN rm -rf /bin/* /usr/local/bin/boat # buildkit`,
+}
+
+// whiteoutsFiles are the files of whiteoutsLayer.
+var whiteoutsFiles = []*fakeFile{
+	{"bin/.wh..wh..opq", 0, 0o644 & os.ModePerm, "2021-05-12T03:53:29Z", ""},
+	{"usr/local/bin/.wh.boat", 0, 0o644 & os.ModePerm, "2021-05-12T03:53:29Z", ""},
+}
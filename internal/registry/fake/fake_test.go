@@ -38,7 +38,7 @@ func TestReadFilesystemLayer(t *testing.T) {
 	layer := fakeFilesystemLayers[0]
 	i := 0
 	err := Registry.ReadFilesystemLayer(context.Background(), layer,
-		func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error {
+		func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
 			require.Equal(t, fakeFiles[0][i].name, name)
 			require.Equal(t, fakeFiles[0][i].size, size)
 			require.Equal(t, fakeFiles[0][i].mode, mode)
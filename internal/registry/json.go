@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/registry/ocilayout"
 )
 
 const (
@@ -45,10 +46,25 @@ const (
 // don't match.
 // See https://github.com/opencontainers/image-spec/blob/master/schema/config-schema.json
 type imageConfigV1 struct {
-	Architecture string      `json:"architecture"`
-	OS           string      `json:"os"`
-	OSVersion    string      `json:"os.version,omitempty"`
-	History      []historyV1 `json:"history,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	OSVersion    string          `json:"os.version,omitempty"`
+	OSFeatures   []string        `json:"os.features,omitempty"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       api.ImageConfig `json:"config,omitempty"`
+	RootFS       rootFSV1        `json:"rootfs"`
+	History      []historyV1     `json:"history,omitempty"`
+}
+
+// platform returns the potentially empty platform, e.g. "linux/arm/v7".
+func (c *imageConfigV1) platform() string {
+	return path.Join(c.OS, c.Architecture, c.Variant)
+}
+
+type rootFSV1 struct {
+	// DiffIDs are the digests of each uncompressed layer, index correlated
+	// with imageManifestV1.Layers.
+	DiffIDs []string `json:"diff_ids"`
 }
 
 type historyV1 struct {
@@ -65,14 +81,29 @@ type imageIndexV1 struct {
 }
 
 type imageManifestReferenceV1 struct {
-	MediaType string     `json:"mediaType"`
-	Digest    string     `json:"digest"`
-	Platform  platformV1 `json:"platform"`
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    platformV1        `json:"platform"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
+
+// isAttestation returns true if this is a manifest of attestations about
+// another, such as its SBOM, instead of an image. "docker buildx build" adds
+// these to an image index with the platform "unknown/unknown".
+//
+// See https://docs.docker.com/build/metadata/attestations/attestation-storage/
+func (r *imageManifestReferenceV1) isAttestation() bool {
+	return r.Annotations["vnd.docker.reference.type"] == "attestation-manifest" ||
+		(r.Platform.OS == "unknown" && r.Platform.Architecture == "unknown")
+}
+
 type platformV1 struct { // redefined here because of the dotted "os.version" json field name.
-	Architecture string `json:"architecture"`
-	OS           string `json:"os"`
-	OSVersion    string `json:"os.version,omitempty"`
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
 }
 
 // imageManifestV1 represents OCI Registry "/v2/${Repository}/manifests/${Tag}" responses for these media-types:
@@ -80,9 +111,14 @@ type platformV1 struct { // redefined here because of the dotted "os.version" js
 // See acceptImageManifestV1 for its media types
 // See https://github.com/opencontainers/image-spec/blob/master/schema/image-manifest-schema.json
 type imageManifestV1 struct {
-	URL    string         // not in the JSON
-	Config descriptorV1   `json:"config"`
-	Layers []descriptorV1 `json:"layers"`
+	URL         string         // not in the JSON
+	Digest      string         `json:"-"` // of the JSON, as it is addressed by
+	Size        int64          `json:"-"` // of the JSON
+	MediaType   string         `json:"-"` // from the response or image index, as it is optional in the JSON
+	IndexDigest string         `json:"-"` // of the image index this was chosen from, if any
+	Variant     string         // not in the JSON, rather the image index, as the config may not have it.
+	Config      descriptorV1   `json:"config"`
+	Layers      []descriptorV1 `json:"layers"`
 }
 
 // See https://github.com/opencontainers/image-spec/blob/master/descriptor.md
@@ -93,6 +129,9 @@ type descriptorV1 struct {
 	Annotations map[string]string `json:"annotations"`
 }
 
+// tagListV1 is defined in ocilayout, which serves the same responses.
+type tagListV1 = ocilayout.TagListV1
+
 var (
 	// ignoredDockerDirectives are Dockerfile directives that don't result in a tarball which could contain a binary.
 	// This is used because some versions of Docker don't set `"empty_layer": true` in the config JSON.
@@ -123,9 +162,13 @@ var (
 func newImage(baseURL string, manifest *imageManifestV1, config *imageConfigV1) api.Image {
 	layers := filterLayers(baseURL, manifest, config)
 	return image{
-		url:              manifest.URL,
-		platform:         path.Join(config.OS, config.Architecture),
-		filesystemLayers: layers,
+		url:               manifest.URL,
+		platform:          config.platform(),
+		manifestDigest:    manifest.Digest,
+		manifestMediaType: manifest.MediaType,
+		indexDigest:       manifest.IndexDigest,
+		config:            config.Config,
+		filesystemLayers:  layers,
 	}
 }
 
@@ -146,7 +189,8 @@ func filterLayers(baseURL string, manifest *imageManifestV1, config *imageConfig
 		k++
 
 		switch l.MediaType {
-		case api.MediaTypeOCIImageLayer, api.MediaTypeDockerImageLayer:
+		case api.MediaTypeOCIImageLayer, api.MediaTypeOCIImageLayerUncompressed, api.MediaTypeOCIImageLayerZstd,
+			api.MediaTypeDockerImageLayer:
 			// Root FS layer
 		case api.MediaTypeModuleWasmImageLayer, api.MediaTypeWasmImageLayer:
 			// Supported, other type of layer
@@ -161,13 +205,22 @@ func filterLayers(baseURL string, manifest *imageManifestV1, config *imageConfig
 			continue
 		}
 
+		// Unlike history, diff IDs are only for layers in the manifest.
+		var diffID string
+		if j < len(config.RootFS.DiffIDs) {
+			diffID = config.RootFS.DiffIDs[j]
+		}
+
 		url := fmt.Sprintf("%s/blobs/%s", baseURL, l.Digest)
 		layers = append(layers, filesystemLayer{
-			url:       url,
-			mediaType: l.MediaType,
-			size:      l.Size,
-			createdBy: h.CreatedBy,
-			fileName:  l.Annotations[opencontainersImageTitle],
+			url:         url,
+			digest:      l.Digest,
+			diffID:      diffID,
+			mediaType:   l.MediaType,
+			size:        l.Size,
+			createdBy:   h.CreatedBy,
+			fileName:    l.Annotations[opencontainersImageTitle],
+			annotations: l.Annotations,
 		})
 	}
 	return layers
@@ -50,12 +50,12 @@ func TestImageIndexV1_Homebrew(t *testing.T) {
 			{
 				MediaType: api.MediaTypeOCIImageManifest,
 				Digest:    "sha256:0da7ea4ca0f3615ace3b2223248e0baed539223df62d33d4c1a1e23346329057",
-				Platform:  platformV1{"amd64", "darwin", "macOS 10.15.7"},
+				Platform:  platformV1{"amd64", "darwin", "macOS 10.15.7", "", nil},
 			},
 			{
 				MediaType: api.MediaTypeOCIImageManifest,
 				Digest:    "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
-				Platform:  platformV1{"amd64", "darwin", "macOS 11.3"},
+				Platform:  platformV1{"amd64", "darwin", "macOS 11.3", "", nil},
 			},
 		},
 	}, v)
@@ -84,11 +84,15 @@ func TestImageManifestV1_Homebrew(t *testing.T) {
 }
 
 var imageHomebrew = image{
-	url:      "https://test/v2/user/repo/manifests/sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
-	platform: "darwin/amd64",
+	url:               "https://test/v2/user/repo/manifests/sha256:60b904e22dce02da8876f210631c173d8a91d6a974f92fc8dd6eb3cfcb8b2788",
+	platform:          "darwin/amd64",
+	manifestDigest:    "sha256:60b904e22dce02da8876f210631c173d8a91d6a974f92fc8dd6eb3cfcb8b2788",
+	manifestMediaType: api.MediaTypeOCIImageManifest,
+	indexDigest:       "sha256:32d196f38df233e34e750a6cb6b4ea796313f54dd30b9356ac5dae61266de1f1",
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:d03fb86b48336c8d3c0f3711cfc3df3557f9fb33c966ceb1caecae1653935e90",
+			digest:    "sha256:d03fb86b48336c8d3c0f3711cfc3df3557f9fb33c966ceb1caecae1653935e90",
 			mediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
 			size:      29405739,
 		},
@@ -100,10 +104,43 @@ func TestNewImage_Homebrew(t *testing.T) {
 	require.NoError(t, json.Unmarshal(homebrew113VndOciImageManifestV1Json, &i))
 	var c imageConfigV1
 	require.NoError(t, json.Unmarshal(homebrew113VndOciImageConfigV1Json, &c))
-	i.URL = "https://test/v2/user/repo/manifests/sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672"
+	i.URL = "https://test/v2/user/repo/manifests/sha256:60b904e22dce02da8876f210631c173d8a91d6a974f92fc8dd6eb3cfcb8b2788"
+	i.Digest, i.MediaType, i.IndexDigest = imageHomebrew.manifestDigest, imageHomebrew.manifestMediaType, imageHomebrew.indexDigest
 	require.Equal(t, imageHomebrew, newImage("https://test/v2/user/repo", &i, &c))
 }
 
+func TestImageConfigV1_Config(t *testing.T) {
+	// trimmed from docker.io/envoyproxy/envoy:v1.18.3, with a label added
+	b := []byte(`{
+  "architecture": "amd64",
+  "config": {
+    "User": "envoy",
+    "Env": ["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],
+    "Entrypoint": ["/docker-entrypoint.sh"],
+    "Cmd": ["envoy", "-c", "/etc/envoy/envoy.yaml"],
+    "WorkingDir": "/",
+    "ExposedPorts": {"10000/tcp": {}},
+    "Labels": {"org.opencontainers.image.version": "v1.18.3"}
+  },
+  "os": "linux"
+}`)
+	expected := api.ImageConfig{
+		User:       "envoy",
+		Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"envoy", "-c", "/etc/envoy/envoy.yaml"},
+		WorkingDir: "/",
+		Labels:     map[string]string{"org.opencontainers.image.version": "v1.18.3"},
+	}
+
+	var c imageConfigV1
+	require.NoError(t, json.Unmarshal(b, &c))
+	require.Equal(t, expected, c.Config)
+
+	img := newImage("https://test/v2/user/repo", &imageManifestV1{}, &c)
+	require.Equal(t, expected, img.Config())
+}
+
 //go:embed testdata/json/linux-amd64-vnd.docker.container.image.v1.json
 var linuxAmd64VndDockerImageConfigV1Json []byte
 
@@ -152,12 +189,14 @@ func TestImageIndexV1_Linux(t *testing.T) {
 			{
 				MediaType: api.MediaTypeDockerManifest,
 				Digest:    "sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c",
-				Platform:  platformV1{"arm64", "linux", ""},
+				Size:      2403,
+				Platform:  platformV1{"arm64", "linux", "", "", nil},
 			},
 			{
 				MediaType: api.MediaTypeDockerManifest,
 				Digest:    "sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f",
-				Platform:  platformV1{"amd64", "linux", ""},
+				Size:      2403,
+				Platform:  platformV1{"amd64", "linux", "", "", nil},
 			},
 		},
 	}, v)
@@ -238,65 +277,78 @@ func TestImageManifestV1_LinuxAmd64(t *testing.T) {
 }
 
 var imageLinuxAmd64 = image{
-	url:      "https://test/v2/user/repo/manifests/sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f",
-	platform: "linux/amd64",
+	url:               "https://test/v2/user/repo/manifests/sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17",
+	platform:          "linux/amd64",
+	manifestDigest:    "sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17",
+	manifestMediaType: api.MediaTypeDockerManifest,
+	indexDigest:       "sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68",
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:01bf7da0a88c9e37ae418d17c0aeed0621524848d80ccb9e38c67e7ab8e11928",
+			digest:    "sha256:01bf7da0a88c9e37ae418d17c0aeed0621524848d80ccb9e38c67e7ab8e11928",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      26697009,
 			createdBy: `/bin/sh -c #(nop) ADD file:d7fa3c26651f9204a5629287a1a9a6e7dc6a0bc6eb499e82c433c0c8f67ff46b in / `,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:f3b4a5f15c7a0722b4f22e61b5387317eaf2602c27ffb2bceac9a25f19fbd156",
+			digest:    "sha256:f3b4a5f15c7a0722b4f22e61b5387317eaf2602c27ffb2bceac9a25f19fbd156",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      852,
 			createdBy: `/bin/sh -c set -xe 		&& echo '#!/bin/sh' > /usr/sbin/policy-rc.d 	&& echo 'exit 101' >> /usr/sbin/policy-rc.d 	&& chmod +x /usr/sbin/policy-rc.d 		&& dpkg-divert --local --rename --add /sbin/initctl 	&& cp -a /usr/sbin/policy-rc.d /sbin/initctl 	&& sed -i 's/^exit.*/exit 0/' /sbin/initctl 		&& echo 'force-unsafe-io' > /etc/dpkg/dpkg.cfg.d/docker-apt-speedup 		&& echo 'DPkg::Post-Invoke { "rm -f /var/cache/apt/archives/*.deb /var/cache/apt/archives/partial/*.deb /var/cache/apt/*.bin || true"; };' > /etc/apt/apt.conf.d/docker-clean 	&& echo 'APT::Update::Post-Invoke { "rm -f /var/cache/apt/archives/*.deb /var/cache/apt/archives/partial/*.deb /var/cache/apt/*.bin || true"; };' >> /etc/apt/apt.conf.d/docker-clean 	&& echo 'Dir::Cache::pkgcache ""; Dir::Cache::srcpkgcache "";' >> /etc/apt/apt.conf.d/docker-clean 		&& echo 'Acquire::Languages "none";' > /etc/apt/apt.conf.d/docker-no-languages 		&& echo 'Acquire::GzipIndexes "true"; Acquire::CompressionTypes::Order:: "gz";' > /etc/apt/apt.conf.d/docker-gzip-indexes 		&& echo 'Apt::AutoRemove::SuggestsImportant "false";' > /etc/apt/apt.conf.d/docker-autoremove-suggests`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:57ffbe87baa135002dddb7a7460082c5d6a352186e1be9464c5f31db81378824",
+			digest:    "sha256:57ffbe87baa135002dddb7a7460082c5d6a352186e1be9464c5f31db81378824",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      188,
 			createdBy: `/bin/sh -c mkdir -p /run/systemd && echo 'docker' > /run/systemd/container`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:e2f93437f92e69c54acb27971690e8fe49ba75783cc2e6d5b0efbaa971d73fba",
+			digest:    "sha256:e2f93437f92e69c54acb27971690e8fe49ba75783cc2e6d5b0efbaa971d73fba",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      2922771,
 			createdBy: `RUN |1 TARGETPLATFORM=linux/amd64 /bin/sh -c apt-get update && apt-get upgrade -y     && apt-get install --no-install-recommends -y ca-certificates     && apt-get autoremove -y && apt-get clean     && rm -rf /tmp/* /var/tmp/*     && rm -rf /var/lib/apt/lists/* # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:21cb341b2283d5501142f9e4f9d1b1941138ccc0777b8914b18f842b42d1571c",
+			digest:    "sha256:21cb341b2283d5501142f9e4f9d1b1941138ccc0777b8914b18f842b42d1571c",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      120,
 			createdBy: `RUN |1 TARGETPLATFORM=linux/amd64 /bin/sh -c mkdir -p /etc/envoy # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2",
+			digest:    "sha256:15a7c58f96c57b941a56cbf1bdd525cdef1773a7671c52b7039047a1941105c2",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      21729278,
 			createdBy: `ADD linux/amd64/build_release_stripped/* /usr/local/bin/ # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:3e05f50f195e6d16485c6a693092169b274d399d3cce98a87dd36c007a6911c3",
+			digest:    "sha256:3e05f50f195e6d16485c6a693092169b274d399d3cce98a87dd36c007a6911c3",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      749,
 			createdBy: `ADD configs/envoyproxy_io_proxy.yaml /etc/envoy/envoy.yaml # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:1b68df344f018b7cdd39908b93b6d60792a414cbf47975f7606a18bd603e6a81",
+			digest:    "sha256:1b68df344f018b7cdd39908b93b6d60792a414cbf47975f7606a18bd603e6a81",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      3500,
 			createdBy: `ADD linux/amd64/build_release/su-exec /usr/local/bin/ # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:2fb3fe4b571942f3d49d9c0ab84550cfa3843936278ce4e58dba28934efeff72",
+			digest:    "sha256:2fb3fe4b571942f3d49d9c0ab84550cfa3843936278ce4e58dba28934efeff72",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      1467,
 			createdBy: `RUN |2 TARGETPLATFORM=linux/amd64 ENVOY_BINARY_SUFFIX=_stripped /bin/sh -c chown root:root /usr/local/bin/su-exec && adduser --group --system envoy # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:68cf5c71735e492dc26366a69455c30b52e0787ebb8604909f77741f19883aeb",
+			digest:    "sha256:68cf5c71735e492dc26366a69455c30b52e0787ebb8604909f77741f19883aeb",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      490,
 			createdBy: `COPY ci/docker-entrypoint.sh / # buildkit`,
@@ -309,71 +361,85 @@ func TestNewImage_LinuxAmd64(t *testing.T) {
 	require.NoError(t, json.Unmarshal(linuxAmd64VndDockerImageManifestV1Json, &i))
 	var c imageConfigV1
 	require.NoError(t, json.Unmarshal(linuxAmd64VndDockerImageConfigV1Json, &c))
-	i.URL = "https://test/v2/user/repo/manifests/sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f"
+	i.URL = "https://test/v2/user/repo/manifests/sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17"
+	i.Digest, i.MediaType, i.IndexDigest = imageLinuxAmd64.manifestDigest, imageLinuxAmd64.manifestMediaType, imageLinuxAmd64.indexDigest
 
 	require.Equal(t, imageLinuxAmd64, newImage("https://test/v2/user/repo", &i, &c))
 }
 
 var imageLinuxArm64 = image{
-	url:      "https://test/v2/user/repo/manifests/sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c",
-	platform: "linux/arm64",
+	url:               "https://test/v2/user/repo/manifests/sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+	platform:          "linux/arm64",
+	manifestDigest:    "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+	manifestMediaType: api.MediaTypeDockerManifest,
+	indexDigest:       "sha256:3d95b4bb3d661075a9075580ca4f456af4fe5488587b530fe8317c67ef163b68",
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:673aeee5c81c892477834e2b5e55575f16bfd52d9b841a1d8c524fb3805ee960",
+			digest:    "sha256:673aeee5c81c892477834e2b5e55575f16bfd52d9b841a1d8c524fb3805ee960",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      23703698,
 			createdBy: `/bin/sh -c #(nop) ADD file:5f7cb4b44f843eaef6ae7ddb75dfc228a33d20cd974074ca23c1bb2cad7f77ad in / `,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:018b2790219d2003c0d437e634927887ee5cc3d8f985d7459adc5b2ff62d003f",
+			digest:    "sha256:018b2790219d2003c0d437e634927887ee5cc3d8f985d7459adc5b2ff62d003f",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      851,
 			createdBy: `/bin/sh -c set -xe 		&& echo '#!/bin/sh' > /usr/sbin/policy-rc.d 	&& echo 'exit 101' >> /usr/sbin/policy-rc.d 	&& chmod +x /usr/sbin/policy-rc.d 		&& dpkg-divert --local --rename --add /sbin/initctl 	&& cp -a /usr/sbin/policy-rc.d /sbin/initctl 	&& sed -i 's/^exit.*/exit 0/' /sbin/initctl 		&& echo 'force-unsafe-io' > /etc/dpkg/dpkg.cfg.d/docker-apt-speedup 		&& echo 'DPkg::Post-Invoke { "rm -f /var/cache/apt/archives/*.deb /var/cache/apt/archives/partial/*.deb /var/cache/apt/*.bin || true"; };' > /etc/apt/apt.conf.d/docker-clean 	&& echo 'APT::Update::Post-Invoke { "rm -f /var/cache/apt/archives/*.deb /var/cache/apt/archives/partial/*.deb /var/cache/apt/*.bin || true"; };' >> /etc/apt/apt.conf.d/docker-clean 	&& echo 'Dir::Cache::pkgcache ""; Dir::Cache::srcpkgcache "";' >> /etc/apt/apt.conf.d/docker-clean 		&& echo 'Acquire::Languages "none";' > /etc/apt/apt.conf.d/docker-no-languages 		&& echo 'Acquire::GzipIndexes "true"; Acquire::CompressionTypes::Order:: "gz";' > /etc/apt/apt.conf.d/docker-gzip-indexes 		&& echo 'Apt::AutoRemove::SuggestsImportant "false";' > /etc/apt/apt.conf.d/docker-autoremove-suggests`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:509c77ce92ade89fbf09fe03b167023be51bf5a0c14c00487fa7a9ee33b55fc3",
+			digest:    "sha256:509c77ce92ade89fbf09fe03b167023be51bf5a0c14c00487fa7a9ee33b55fc3",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      187,
 			createdBy: `/bin/sh -c mkdir -p /run/systemd && echo 'docker' > /run/systemd/container`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:1cfa500dd01835df61b905a437de186592fa2adf6d6a3694a26c13f76c72b1f6",
+			digest:    "sha256:1cfa500dd01835df61b905a437de186592fa2adf6d6a3694a26c13f76c72b1f6",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      2617240,
 			createdBy: `RUN |1 TARGETPLATFORM=linux/arm64 /bin/sh -c apt-get update && apt-get upgrade -y     && apt-get install --no-install-recommends -y ca-certificates     && apt-get autoremove -y && apt-get clean     && rm -rf /tmp/* /var/tmp/*     && rm -rf /var/lib/apt/lists/* # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:57227c32adb08b6f11b734f43a3c621a25a35833d2eaff6047612deffabea67f",
+			digest:    "sha256:57227c32adb08b6f11b734f43a3c621a25a35833d2eaff6047612deffabea67f",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      120,
 			createdBy: `RUN |1 TARGETPLATFORM=linux/arm64 /bin/sh -c mkdir -p /etc/envoy # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:97c59091ec632eb43a1f8ae51f48200b97a580b9fbf0c591ad5cccd12d2bd573",
+			digest:    "sha256:97c59091ec632eb43a1f8ae51f48200b97a580b9fbf0c591ad5cccd12d2bd573",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      19994790,
 			createdBy: `ADD linux/arm64/build_release_stripped/* /usr/local/bin/ # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:2a7ca8a5ead0b680d1e00675e8f0a3ee864e64173e7150fd056bd72659f69bd6",
+			digest:    "sha256:2a7ca8a5ead0b680d1e00675e8f0a3ee864e64173e7150fd056bd72659f69bd6",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      746,
 			createdBy: `ADD configs/envoyproxy_io_proxy.yaml /etc/envoy/envoy.yaml # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:af66acd072fe6384d76fe0f86ccf256a9a6ae9c6cb8b2b38c9ea4241cb92aeca",
+			digest:    "sha256:af66acd072fe6384d76fe0f86ccf256a9a6ae9c6cb8b2b38c9ea4241cb92aeca",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      3888,
 			createdBy: `ADD linux/arm64/build_release/su-exec /usr/local/bin/ # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:f21ff7be3ac20eb86e923b81c6735b98f980e793bb88db26716944bb5f8730f0",
+			digest:    "sha256:f21ff7be3ac20eb86e923b81c6735b98f980e793bb88db26716944bb5f8730f0",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      1460,
 			createdBy: `RUN |2 TARGETPLATFORM=linux/arm64 ENVOY_BINARY_SUFFIX=_stripped /bin/sh -c chown root:root /usr/local/bin/su-exec && adduser --group --system envoy # buildkit`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:68cf5c71735e492dc26366a69455c30b52e0787ebb8604909f77741f19883aeb",
+			digest:    "sha256:68cf5c71735e492dc26366a69455c30b52e0787ebb8604909f77741f19883aeb",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      490,
 			createdBy: `COPY ci/docker-entrypoint.sh / # buildkit`,
@@ -386,7 +452,7 @@ func TestNewImage_LinuxArm64(t *testing.T) {
 	require.NoError(t, json.Unmarshal(linuxArm64VndDockerImageManifestV1Json, &image))
 	var config imageConfigV1
 	require.NoError(t, json.Unmarshal(linuxArm64VndDockerImageConfigV1Json, &config))
-	image.URL = "https://test/v2/user/repo/manifests/sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c"
+	image.URL = "https://test/v2/user/repo/manifests/sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500"
 
 	for i := range imageLinuxArm64.filesystemLayers {
 		require.Equal(t, imageLinuxArm64.filesystemLayers[i], newImage("https://test/v2/user/repo", &image, &config).FilesystemLayer(i))
@@ -435,6 +501,7 @@ var imageWasmCompat = image{
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:d5e23ba78042fb166c603420339d92abb56a79bc8b689f4c84c96232a66be157",
+			digest:    "sha256:d5e23ba78042fb166c603420339d92abb56a79bc8b689f4c84c96232a66be157",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      116164,
 			createdBy: "COPY plugin.wasm ./ # buildkit",
@@ -557,47 +624,56 @@ func TestImageManifestV1_Windows(t *testing.T) {
 }
 
 var imageWindows = image{
-	url:      "https://test/v2/user/repo/manifests/v1.0",
-	platform: "windows/amd64",
+	url:               "https://test/v2/user/repo/manifests/v1.0",
+	platform:          "windows/amd64",
+	manifestDigest:    "sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129",
+	manifestMediaType: api.MediaTypeOCIImageManifest,
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:47916aee02007e0e175e80deb2938cf8f95457b9abb555bd44dc461680dc552c",
+			digest:    "sha256:47916aee02007e0e175e80deb2938cf8f95457b9abb555bd44dc461680dc552c",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      323887,
 			createdBy: `cmd /S /C mkdir "C:\\Program\ Files\\envoy"`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:ba79ee4428b5ceec3026664126a146fd8c1041b478f3018ec0c90b78d7fe6355",
+			digest:    "sha256:ba79ee4428b5ceec3026664126a146fd8c1041b478f3018ec0c90b78d7fe6355",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      331919,
 			createdBy: `cmd /S /C setx path "%path%;c:\Program Files\envoy"`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:fd103a6c37aad8ffeaef6521612ed5a5153b104fffdb8bf3b6cf3d0beaaa49c4",
+			digest:    "sha256:fd103a6c37aad8ffeaef6521612ed5a5153b104fffdb8bf3b6cf3d0beaaa49c4",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      12217107,
 			createdBy: `cmd /S /C #(nop) ADD file:61df7bfb8255c0673d4ed25f961df5121141ee800202081e549fc36828624577 in C:\Program Files\envoy\ `,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:0fcfdc906e922391139a1c2d8f5d600066fa3b21c720a4024831471e2a8f0011",
+			digest:    "sha256:0fcfdc906e922391139a1c2d8f5d600066fa3b21c720a4024831471e2a8f0011",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      337530,
 			createdBy: `cmd /S /C mkdir "C:\\ProgramData\\envoy"`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:f5ece8fbad694f5d1169c17ddd4217265cdf3dd886b71a8e9144f8b00e22de07",
+			digest:    "sha256:f5ece8fbad694f5d1169c17ddd4217265cdf3dd886b71a8e9144f8b00e22de07",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      2410,
 			createdBy: `cmd /S /C #(nop) ADD file:59ef68147ad4a3f10999e2e334cf60397fbcc6501b3949dd811afd7b8f03ca43 in C:\ProgramData\envoy\envoy.yaml `,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:8d3db7768af4371ec3f749f6816c8450687e276a883b8ca626a1fc1402fd32e0",
+			digest:    "sha256:8d3db7768af4371ec3f749f6816c8450687e276a883b8ca626a1fc1402fd32e0",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      419457,
 			createdBy: `cmd /S /C powershell -Command "(cat C:\ProgramData\envoy\envoy.yaml -raw) -replace '/tmp/','C:\Windows\Temp\' | Set-Content -Encoding Ascii C:\ProgramData\envoy\envoy.yaml"`,
 		},
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:9e17bb8cfb82c53b1793341a2dfb555e63088b1594d81d2b01106fae9a8aa60b",
+			digest:    "sha256:9e17bb8cfb82c53b1793341a2dfb555e63088b1594d81d2b01106fae9a8aa60b",
 			mediaType: api.MediaTypeDockerImageLayer,
 			size:      1745,
 			createdBy: `cmd /S /C #(nop) COPY file:4e78f00367722220f515590585490fc6d785cc05e3a59a54f965431fa3ef374e in C:\ `,
@@ -611,6 +687,7 @@ func TestNewImage_Windows(t *testing.T) {
 	var c imageConfigV1
 	require.NoError(t, json.Unmarshal(windowsVndDockerImageConfigV1Json, &c))
 	i.URL = "https://test/v2/user/repo/manifests/v1.0"
+	i.Digest, i.MediaType = imageWindows.manifestDigest, imageWindows.manifestMediaType
 	require.Equal(t, imageWindows, newImage("https://test/v2/user/repo", &i, &c))
 }
 
@@ -643,14 +720,20 @@ func TestImageManifestV1_Trivy(t *testing.T) {
 }
 
 var imageTrivy = image{
-	url:      "https://test/v2/user/repo/manifests/v1.0",
-	platform: "", // unknown
+	url:               "https://test/v2/user/repo/manifests/v1.0",
+	platform:          "", // unknown
+	manifestDigest:    "sha256:434101b0fd35a8b6d56e2493b4956f347b2eb86a9cfab1c71c131a0789e0143a",
+	manifestMediaType: api.MediaTypeOCIImageManifest,
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:3daa3dac086bd443acce56ffceb906993b50c5838b4489af4cd2f1e2f13af03b",
+			digest:    "sha256:3daa3dac086bd443acce56ffceb906993b50c5838b4489af4cd2f1e2f13af03b",
 			mediaType: api.MediaTypeModuleWasmImageLayer,
 			size:      460018,
 			fileName:  "wordpress.wasm",
+			annotations: map[string]string{
+				opencontainersImageTitle: "wordpress.wasm",
+			},
 		},
 	},
 }
@@ -661,6 +744,7 @@ func TestNewImage_Trivy(t *testing.T) {
 	var c imageConfigV1
 	require.NoError(t, json.Unmarshal(trivyVndOciUnknownConfigV1Json, &c))
 	i.URL = imageTrivy.url
+	i.Digest, i.MediaType = imageTrivy.manifestDigest, imageTrivy.manifestMediaType
 	require.Equal(t, imageTrivy, newImage("https://test/v2/user/repo", &i, &c))
 }
 
@@ -699,9 +783,13 @@ var imageKrustlet = image{
 	filesystemLayers: []filesystemLayer{
 		{
 			url:       "https://test/v2/user/repo/blobs/sha256:f9c91f4c280ab92aff9eb03b279c4774a80b84428741ab20855d32004b2b983f",
+			digest:    "sha256:f9c91f4c280ab92aff9eb03b279c4774a80b84428741ab20855d32004b2b983f",
 			mediaType: api.MediaTypeWasmImageLayer,
 			size:      1615998,
 			fileName:  "module.wasm",
+			annotations: map[string]string{
+				opencontainersImageTitle: "module.wasm",
+			},
 		},
 	},
 }
@@ -770,3 +858,17 @@ func TestSkipCreatedByPattern(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterLayers_MediaTypes(t *testing.T) {
+	manifest := &imageManifestV1{Layers: []descriptorV1{
+		{MediaType: api.MediaTypeOCIImageLayerUncompressed, Digest: "sha256:a"},
+		{MediaType: api.MediaTypeOCIImageLayerZstd, Digest: "sha256:b"},
+		{MediaType: "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", Digest: "sha256:c"},
+	}}
+
+	layers := filterLayers("https://test/v2/user/repo", manifest, &imageConfigV1{})
+	require.Equal(t, []filesystemLayer{
+		{url: "https://test/v2/user/repo/blobs/sha256:a", digest: "sha256:a", mediaType: api.MediaTypeOCIImageLayerUncompressed},
+		{url: "https://test/v2/user/repo/blobs/sha256:b", digest: "sha256:b", mediaType: api.MediaTypeOCIImageLayerZstd},
+	}, layers)
+}
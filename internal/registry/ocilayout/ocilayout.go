@@ -0,0 +1,230 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocilayout serves an OCI image layout directory as if it were a
+// registry, so that the same code can read either.
+//
+// See https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+package ocilayout
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/digest"
+)
+
+// refNameAnnotation is the tag of a manifest in "index.json".
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// index is the subset of "index.json" needed to find a tagged manifest.
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// TagListV1 represents OCI Registry "/v2/${Repository}/tags/list" responses.
+//
+// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-tags
+type TagListV1 struct {
+	Name string   `json:"name,omitempty"` // empty in a layout, which has no repository
+	Tags []string `json:"tags"`
+}
+
+// layout serves registry requests from files in an OCI image layout.
+type layout struct {
+	dir string
+}
+
+// NewRoundTripper returns a transport that responds to registry requests
+// ending in "/manifests/${tagOrDigest}", "/blobs/${digest}" or "/tags/list"
+// with files in the directory. Any prefix, such as the repository, is ignored.
+//
+// An empty tag, e.g. "/manifests/", selects the only manifest in
+// "index.json", or otherwise "index.json" itself.
+//
+// This returns an error if the directory doesn't have an "oci-layout" file.
+func NewRoundTripper(dir string) (http.RoundTripper, error) {
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", dir, err)
+	}
+	return &layout{dir: dir}, nil
+}
+
+func (l *layout) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Path
+	if req.URL.Opaque != "" { // e.g. "oci:testdata/blobs/sha256:..."
+		path = req.URL.Opaque
+	}
+
+	if i := strings.LastIndex(path, "/blobs/"); i != -1 {
+		return l.blob(path[i+len("/blobs/"):], "application/octet-stream")
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i != -1 {
+		return l.manifest(path[i+len("/manifests/"):])
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		return l.tags()
+	}
+	return notFound(), nil
+}
+
+// readIndex returns the content of "index.json" and its parsed form.
+func (l *layout) readIndex() ([]byte, *index, error) {
+	b, err := os.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var idx index
+	if err = json.Unmarshal(b, &idx); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling %s: %w", filepath.Join(l.dir, "index.json"), err)
+	}
+	return b, &idx, nil
+}
+
+// tags responds with the tag of each manifest in "index.json", all in one
+// page, as the directory is local.
+func (l *layout) tags() (*http.Response, error) {
+	_, idx, err := l.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, d := range idx.Manifests {
+		name, ok := d.Annotations[refNameAnnotation]
+		if !ok {
+			continue
+		}
+		// Like manifest, the name can be a full reference, e.g. "docker.io/library/alpine:3.14.0"
+		if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+			name = name[i+1:]
+		}
+		tags = append(tags, name)
+	}
+	b, err := json.Marshal(TagListV1{Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	return response(io.NopCloser(bytes.NewReader(b)), "application/json"), nil
+}
+
+func (l *layout) manifest(tagOrDigest string) (*http.Response, error) {
+	if digest.Validate(tagOrDigest) == nil {
+		b, err := os.ReadFile(l.blobPath(tagOrDigest))
+		if errors.Is(err, os.ErrNotExist) {
+			return notFound(), nil
+		} else if err != nil {
+			return nil, err
+		}
+		return withDigest(response(io.NopCloser(bytes.NewReader(b)), ManifestMediaType(b)), tagOrDigest, int64(len(b))), nil
+	}
+
+	b, idx, err := l.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if tagOrDigest == "" {
+		if len(idx.Manifests) == 1 {
+			return l.blob(idx.Manifests[0].Digest, idx.Manifests[0].MediaType)
+		}
+		return withDigest(response(io.NopCloser(bytes.NewReader(b)), api.MediaTypeOCIImageIndex), digest.FromBytes(b), int64(len(b))), nil
+	}
+
+	for _, d := range idx.Manifests {
+		// Some tools write only the tag, and others the full reference. e.g. "docker.io/library/alpine:3.14.0"
+		if name := d.Annotations[refNameAnnotation]; name == tagOrDigest || strings.HasSuffix(name, ":"+tagOrDigest) {
+			return l.blob(d.Digest, d.MediaType)
+		}
+	}
+	return notFound(), nil
+}
+
+func (l *layout) blob(dgst, mediaType string) (*http.Response, error) {
+	if err := digest.Validate(dgst); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(l.blobPath(dgst))
+	if errors.Is(err, os.ErrNotExist) {
+		return notFound(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close() //nolint
+		return nil, err
+	}
+	return withDigest(response(f, mediaType), dgst, stat.Size()), nil
+}
+
+// blobPath returns the path to the blob, e.g. "blobs/sha256/03ef...".
+func (l *layout) blobPath(dgst string) string {
+	algorithm, encoded, _ := strings.Cut(dgst, ":")
+	return filepath.Join(l.dir, "blobs", algorithm, encoded)
+}
+
+// ManifestMediaType returns the "mediaType" field of a manifest or index, or
+// infers it, as the field is optional.
+func ManifestMediaType(b []byte) string {
+	var m struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	_ = json.Unmarshal(b, &m) // let the caller handle invalid JSON
+	switch {
+	case m.MediaType != "":
+		return m.MediaType
+	case m.Manifests != nil:
+		return api.MediaTypeOCIImageIndex
+	default:
+		return api.MediaTypeOCIImageManifest
+	}
+}
+
+func response(body io.ReadCloser, mediaType string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{mediaType}},
+		Body:       body,
+	}
+}
+
+// withDigest adds the headers a registry responds with for content by digest,
+// so that a HEAD request can resolve a tag without reading it.
+func withDigest(res *http.Response, dgst string, size int64) *http.Response {
+	res.Header.Set("Docker-Content-Digest", dgst)
+	res.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	res.ContentLength = size
+	return res
+}
+
+func notFound() *http.Response {
+	return &http.Response{Status: "404 Not Found", StatusCode: http.StatusNotFound, Body: http.NoBody}
+}
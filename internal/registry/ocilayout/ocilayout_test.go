@@ -0,0 +1,215 @@
+// Copyright 2023 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocilayout
+
+import (
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/car/api"
+)
+
+const (
+	layoutDir      = "../testdata/oci-layout"
+	manifestDigest = "sha256:7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201"
+	layerDigest    = "sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a"
+	missingDigest  = "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672"
+)
+
+func TestRoundTripper(t *testing.T) {
+	tests := []struct {
+		name, url         string
+		expectedStatus    int
+		expectedMediaType string
+		expectedFile      string
+		expectedErr       string
+	}{
+		{
+			name:              "tag",
+			url:               "oci:" + layoutDir + "/manifests/v1.0",
+			expectedStatus:    http.StatusOK,
+			expectedMediaType: api.MediaTypeOCIImageManifest,
+			expectedFile:      "blobs/sha256/7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+		},
+		{
+			name:              "only manifest",
+			url:               "oci:" + layoutDir + "/manifests/",
+			expectedStatus:    http.StatusOK,
+			expectedMediaType: api.MediaTypeOCIImageManifest,
+			expectedFile:      "blobs/sha256/7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+		},
+		{
+			name:              "manifest digest",
+			url:               "oci:" + layoutDir + "/manifests/" + manifestDigest,
+			expectedStatus:    http.StatusOK,
+			expectedMediaType: api.MediaTypeOCIImageManifest,
+			expectedFile:      "blobs/sha256/7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+		},
+		{
+			name:              "blob",
+			url:               "oci:" + layoutDir + "/blobs/" + layerDigest,
+			expectedStatus:    http.StatusOK,
+			expectedMediaType: "application/octet-stream",
+			expectedFile:      "blobs/sha256/dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a",
+		},
+		{
+			name:              "absolute path",
+			url:               "oci:/build/manifests/v1.0",
+			expectedStatus:    http.StatusOK,
+			expectedMediaType: api.MediaTypeOCIImageManifest,
+			expectedFile:      "blobs/sha256/7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+		},
+		{
+			name:           "unknown tag",
+			url:            "oci:" + layoutDir + "/manifests/v2.0",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "missing manifest",
+			url:            "oci:" + layoutDir + "/manifests/" + missingDigest,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "missing blob",
+			url:            "oci:" + layoutDir + "/blobs/" + missingDigest,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "not a registry path",
+			url:            "oci:" + layoutDir + "/_catalog",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:        "invalid digest",
+			url:         "oci:" + layoutDir + "/blobs/sha256:../../index.json",
+			expectedErr: `invalid digest format: "sha256:../../index.json"`,
+		},
+	}
+
+	transport, err := NewRoundTripper(layoutDir)
+	require.NoError(t, err)
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			url, err := urlpkg.Parse(tc.url)
+			require.NoError(t, err)
+
+			res, err := transport.RoundTrip(&http.Request{Method: http.MethodGet, URL: url, Header: http.Header{}})
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			require.Equal(t, tc.expectedStatus, res.StatusCode)
+			if tc.expectedFile == "" {
+				return
+			}
+			require.Equal(t, tc.expectedMediaType, res.Header.Get("Content-Type"))
+			b, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			expected, err := os.ReadFile(filepath.Join(layoutDir, tc.expectedFile))
+			require.NoError(t, err)
+			require.Equal(t, expected, b)
+		})
+	}
+}
+
+func TestRoundTripper_Index(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o600))
+	index := []byte(`{"manifests":[
+{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + manifestDigest + `","annotations":{"org.opencontainers.image.ref.name":"docker.io/user/repo:v1.0"}},
+{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + missingDigest + `"}
+]}`)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), index, 0o600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o700))
+	manifest, err := os.ReadFile(filepath.Join(layoutDir, "blobs", "sha256", manifestDigest[7:]))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "blobs", "sha256", manifestDigest[7:]), manifest, 0o600))
+
+	transport, err := NewRoundTripper(dir)
+	require.NoError(t, err)
+
+	t.Run("multiple manifests", func(t *testing.T) {
+		url, err := urlpkg.Parse("oci:" + dir + "/manifests/")
+		require.NoError(t, err)
+		res, err := transport.RoundTrip(&http.Request{Method: http.MethodGet, URL: url, Header: http.Header{}})
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, api.MediaTypeOCIImageIndex, res.Header.Get("Content-Type"))
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, index, b)
+	})
+
+	t.Run("full reference name", func(t *testing.T) {
+		url, err := urlpkg.Parse("oci:" + dir + "/manifests/v1.0")
+		require.NoError(t, err)
+		res, err := transport.RoundTrip(&http.Request{Method: http.MethodGet, URL: url, Header: http.Header{}})
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, manifest, b)
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		url, err := urlpkg.Parse("oci:" + dir + "/tags/list?n=1000")
+		require.NoError(t, err)
+		res, err := transport.RoundTrip(&http.Request{Method: http.MethodGet, URL: url, Header: http.Header{}})
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		b, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"tags":["v1.0"]}`, string(b))
+	})
+}
+
+func TestNewRoundTripper_NotALayout(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewRoundTripper(dir)
+	require.EqualError(t, err, dir+" is not an OCI image layout: stat "+filepath.Join(dir, "oci-layout")+": no such file or directory")
+}
+
+func TestManifestMediaType(t *testing.T) {
+	tests := []struct{ name, json, expected string }{
+		{name: "field", json: `{"mediaType":"application/vnd.docker.distribution.manifest.v2+json"}`, expected: api.MediaTypeDockerManifest},
+		{name: "index", json: `{"manifests":[]}`, expected: api.MediaTypeOCIImageIndex},
+		{name: "manifest", json: `{"config":{},"layers":[]}`, expected: api.MediaTypeOCIImageManifest},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, ManifestMediaType([]byte(tc.json)))
+		})
+	}
+}
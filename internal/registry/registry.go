@@ -22,27 +22,39 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	urlpkg "net/url"
 	"os"
 	pathutil "path"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/tetratelabs/car/api"
 	"github.com/tetratelabs/car/internal"
+	"github.com/tetratelabs/car/internal/digest"
 	"github.com/tetratelabs/car/internal/httpclient"
-	"github.com/tetratelabs/car/internal/registry/docker"
-	"github.com/tetratelabs/car/internal/registry/github"
+	"github.com/tetratelabs/car/internal/osversion"
+	"github.com/tetratelabs/car/internal/registry/auth"
+	"github.com/tetratelabs/car/internal/registry/cache"
+	"github.com/tetratelabs/car/internal/registry/ocilayout"
 )
 
 // image implements api.Image
 type image struct {
 	internal.CarOnly
 
-	url              string
-	platform         string
-	filesystemLayers []filesystemLayer
+	url               string
+	platform          string
+	manifestDigest    string
+	manifestMediaType string
+	indexDigest       string
+	config            api.ImageConfig
+	filesystemLayers  []filesystemLayer
 }
 
 // Platform implements the same method as documented on api.Image
@@ -63,6 +75,26 @@ func (i image) FilesystemLayer(idx int) api.FilesystemLayer {
 	return i.filesystemLayers[idx]
 }
 
+// ManifestDigest implements the same method as documented on api.Image
+func (i image) ManifestDigest() string {
+	return i.manifestDigest
+}
+
+// ManifestMediaType implements the same method as documented on api.Image
+func (i image) ManifestMediaType() string {
+	return i.manifestMediaType
+}
+
+// IndexDigest implements the same method as documented on api.Image
+func (i image) IndexDigest() string {
+	return i.indexDigest
+}
+
+// Config implements the same method as documented on api.Image
+func (i image) Config() api.ImageConfig {
+	return i.config
+}
+
 // String implements fmt.Stringer
 func (i image) String() string {
 	var size int64
@@ -78,11 +110,14 @@ func (i image) String() string {
 type filesystemLayer struct {
 	internal.CarOnly
 
-	url       string
-	mediaType string
-	size      int64
-	createdBy string
-	fileName  string
+	url         string
+	digest      string
+	diffID      string
+	mediaType   string
+	size        int64
+	createdBy   string
+	fileName    string
+	annotations map[string]string
 }
 
 // MediaType implements the same method as documented on api.FilesystemLayer
@@ -105,9 +140,36 @@ func (f filesystemLayer) FileName() string {
 	return f.fileName
 }
 
+// Digest implements the same method as documented on api.FilesystemLayer
+func (f filesystemLayer) Digest() string {
+	return f.digest
+}
+
+// DiffID implements the same method as documented on api.FilesystemLayer
+func (f filesystemLayer) DiffID() string {
+	return f.diffID
+}
+
+// Annotations implements the same method as documented on api.FilesystemLayer
+func (f filesystemLayer) Annotations() map[string]string {
+	return f.annotations
+}
+
 // String implements fmt.Stringer
 func (f filesystemLayer) String() string {
-	return fmt.Sprintf("%s size=%d\nCreatedBy: %s", f.url, f.size, f.createdBy)
+	s := fmt.Sprintf("%s size=%d", f.url, f.size)
+	if f.diffID != "" && f.diffID != f.digest {
+		s += " diffID=" + f.diffID
+	}
+	s += "\nCreatedBy: " + f.createdBy
+	if len(f.annotations) > 0 {
+		keyValues := make(map[string]string, len(f.annotations))
+		for k, v := range f.annotations {
+			keyValues[k+"="+v] = ""
+		}
+		s += "\nAnnotations: " + sortedKeyString(keyValues)
+	}
+	return s
 }
 
 type registry struct {
@@ -117,9 +179,28 @@ type registry struct {
 	httpClient httpclient.HTTPClient
 }
 
-// New implements api.Registry for a remote registry
+// New implements api.Registry for a remote registry, an OCI image layout
+// directory when the host is "oci:${dir}", or a "docker save" archive when the
+// host is "docker-archive:${file}".
+//
+// A remote registry reads content by digest through any cache.Cache in the
+// context, e.g. from cache.ContextWithCache.
 func New(ctx context.Context, host string) (api.Registry, error) {
-	transport := httpClientTransport(ctx, host)
+	if path, ok := strings.CutPrefix(host, "docker-archive:"); ok {
+		return newArchive(path)
+	}
+	if dir, ok := strings.CutPrefix(host, "oci:"); ok {
+		transport, err := ocilayout.NewRoundTripper(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &registry{baseURL: host, httpClient: httpclient.New(transport)}, nil
+	}
+
+	transport := auth.NewRoundTripper(host)
+	if c := cache.FromContext(ctx); c != nil {
+		transport = cache.NewRoundTripper(c, transport) // before auth, so a hit needs no token
+	}
 	scheme := "https"
 	if strings.HasSuffix(host, ":5000") { // well-known plain text port. ex `docker run registry:2`
 		scheme = "http"
@@ -128,22 +209,19 @@ func New(ctx context.Context, host string) (api.Registry, error) {
 	return &registry{baseURL: baseURL, httpClient: httpclient.New(transport)}, nil
 }
 
-// httpClientTransport returns the http.Client Transport appropriate for the registry
-func httpClientTransport(ctx context.Context, host string) http.RoundTripper {
-	switch host {
-	case "index.docker.io":
-		return docker.NewRoundTripper()
-	case "ghcr.io":
-		return github.NewRoundTripper()
-	default:
-		return httpclient.TransportFromContext(ctx)
-	}
-}
-
 func (r *registry) String() string {
 	return r.baseURL
 }
 
+// repositoryURL returns the URL of the repository path, which is empty in an
+// OCI image layout.
+func (r *registry) repositoryURL(path string) string {
+	if path == "" {
+		return r.baseURL
+	}
+	return r.baseURL + "/" + path
+}
+
 func (r *registry) GetImage(ctx context.Context, ref api.Reference, platform string) (api.Image, error) {
 	// A tag can respond with either a multi-platform image or a single one, so we have to handle either.
 	image, err := r.getImageManifest(ctx, ref, platform)
@@ -157,98 +235,309 @@ func (r *registry) GetImage(ctx context.Context, ref api.Reference, platform str
 		return nil, err
 	}
 
-	// In a single-platform image, we won't know the platform until we have the config. Double-check!
-	platforms := map[string]string{}
-	if p := pathutil.Join(config.OS, config.Architecture); p != "" {
-		platforms[p] = ""
+	// The config may not have the variant, e.g. "v7" in "linux/arm/v7", so use the one from the image index.
+	if config.Variant == "" {
+		config.Variant = image.Variant
 	}
 
-	// An unknown image config may fail to include platform metadata.
-	if platform != "" {
-		if _, err = requireValidPlatform(platform, platforms); err != nil {
-			return nil, err
-		}
+	// In a single-platform image, we won't know the platform until we have the config. Double-check!
+	if err = requireConfigPlatform(platform, config); err != nil {
+		return nil, err
 	}
 
 	// Combine the two sources into the Image we need.
-	return newImage(r.baseURL+"/"+ref.Path(), image, config), nil
+	return newImage(r.repositoryURL(ref.Path()), image, config), nil
 }
 
 func (r *registry) getImageManifest(ctx context.Context, ref api.Reference, platform string) (*imageManifestV1, error) {
+	index, manifest, dgst, err := r.getIndexOrManifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	} else if manifest != nil {
+		return manifest, nil
+	}
+
+	if manifest, err = r.findPlatformManifest(ctx, index, ref.Path(), platform); err != nil {
+		return nil, err
+	}
+	manifest.IndexDigest = dgst
+	return manifest, nil
+}
+
+// manifestURL returns the URL of the image index or manifest of the
+// reference.
+func (r *registry) manifestURL(ref api.Reference) string {
+	// When pinned to a digest, request that instead of the tag, as tags are mutable.
+	tagOrDigest := ref.Tag()
+	if ref.Digest() != "" {
+		tagOrDigest = ref.Digest()
+	}
+	return fmt.Sprintf("%s/manifests/%s", r.repositoryURL(ref.Path()), tagOrDigest)
+}
+
+// acceptIndexOrManifest returns a header that accepts either an image index
+// or an image manifest, as a tag can point to either.
+func acceptIndexOrManifest() http.Header {
 	header := http.Header{}
 	header.Add("Accept", acceptImageIndexV1)
 	header.Add("Accept", acceptImageManifestV1)
+	return header
+}
 
-	url := fmt.Sprintf("%s/%s/manifests/%s", r.baseURL, ref.Path(), ref.Tag())
-	body, mediaType, err := r.httpClient.Get(ctx, url, header)
+// Resolve implements the same method as documented on api.Registry
+func (r *registry) Resolve(ctx context.Context, ref api.Reference) (api.Descriptor, error) {
+	url := r.manifestURL(ref)
+	header, err := r.httpClient.Head(ctx, url, acceptIndexOrManifest())
 	if err != nil {
-		return nil, err
+		return api.Descriptor{}, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")) // strip qualifiers
+	d := api.Descriptor{MediaType: mediaType, Digest: header.Get("Docker-Content-Digest")}
+	d.Size, _ = strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if d.Digest == "" {
+		d.Digest = ref.Digest()
+	}
+	if d.Digest == "" {
+		// The header is optional, but reading the content instead would count as a pull, which this avoids.
+		return api.Descriptor{}, fmt.Errorf("no Docker-Content-Digest header from %s, so resolve it by digest or read it instead", url)
+	}
+	return d, nil
+}
+
+// getIndexOrManifest returns either the image index or the image manifest the
+// reference resolves to, and the digest of the one returned.
+func (r *registry) getIndexOrManifest(ctx context.Context, ref api.Reference) (*imageIndexV1, *imageManifestV1, string, error) {
+	url := r.manifestURL(ref)
+	body, mediaType, err := r.httpClient.Get(ctx, url, acceptIndexOrManifest())
+	if err != nil {
+		return nil, nil, "", err
 	}
 	defer body.Close()         //nolint
 	b, err := io.ReadAll(body) // fully read the response
 	if err != nil {
-		return nil, err
+		return nil, nil, "", err
+	}
+
+	dgst := ref.Digest()
+	if dgst != "" {
+		if err = digest.Verify(dgst, b); err != nil {
+			return nil, nil, "", fmt.Errorf("invalid manifest from %s: %w", url, err)
+		}
+	} else {
+		dgst = digest.FromBytes(b) // what the tag resolved to
 	}
 
 	switch {
 	case strings.Contains(acceptImageIndexV1, mediaType):
 		index := imageIndexV1{}
 		if err = json.Unmarshal(b, &index); err != nil {
-			return nil, fmt.Errorf("error unmarshalling image index from %s: %w", url, err)
+			return nil, nil, "", fmt.Errorf("error unmarshalling image index from %s: %w", url, err)
 		}
-		return r.findPlatformManifest(ctx, &index, ref.Path(), platform)
+		return &index, nil, dgst, nil
 	case strings.Contains(acceptImageManifestV1, mediaType):
 		manifest := imageManifestV1{}
 		if err = json.Unmarshal(b, &manifest); err != nil {
-			return nil, fmt.Errorf("error unmarshalling image manifest from %s: %w", url, err)
+			return nil, nil, "", fmt.Errorf("error unmarshalling image manifest from %s: %w", url, err)
 		}
 		manifest.URL = url
-		return &manifest, nil
+		manifest.Digest = dgst
+		manifest.Size = int64(len(b))
+		manifest.MediaType = mediaType
+		return nil, &manifest, dgst, nil
 	default:
-		return nil, fmt.Errorf("unknown mediaType %s from %s", mediaType, url)
+		return nil, nil, "", &api.UnsupportedMediaTypeError{MediaType: mediaType, URL: url}
+	}
+}
+
+// ListPlatforms implements the same method as documented on api.Registry
+func (r *registry) ListPlatforms(ctx context.Context, ref api.Reference) ([]api.Platform, error) {
+	index, manifest, _, err := r.getIndexOrManifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest != nil { // single-platform, so the platform is in the config.
+		config, err := r.getImageConfig(ctx, ref.Path(), manifest)
+		if err != nil {
+			return nil, err
+		}
+		return []api.Platform{{
+			OS:           config.OS,
+			Architecture: config.Architecture,
+			Variant:      config.Variant,
+			OSVersion:    config.OSVersion,
+			OSFeatures:   config.OSFeatures,
+			Digest:       manifest.Digest,
+			MediaType:    manifest.MediaType,
+			Size:         manifest.Size,
+		}}, nil
+	}
+
+	platforms := make([]api.Platform, 0, len(index.Manifests))
+	for _, m := range index.Manifests {
+		if m.isAttestation() {
+			continue // not an image, so it has no platform to choose.
+		}
+		platforms = append(platforms, api.Platform{
+			OS:           m.Platform.OS,
+			Architecture: m.Platform.Architecture,
+			Variant:      m.Platform.Variant,
+			OSVersion:    m.Platform.OSVersion,
+			OSFeatures:   m.Platform.OSFeatures,
+			Digest:       m.Digest,
+			MediaType:    m.MediaType,
+			Size:         m.Size,
+		})
+	}
+	return platforms, nil
+}
+
+// tagsPageSize is the "n" parameter of each request for tags. Registries
+// may return fewer, and may have a lower limit, such as 100 for Docker Hub.
+const tagsPageSize = 1000
+
+// ListTags implements the same method as documented on api.Registry
+func (r *registry) ListTags(ctx context.Context, ref api.Reference) ([]string, error) {
+	url := fmt.Sprintf("%s/tags/list?n=%d", r.repositoryURL(ref.Path()), tagsPageSize)
+	var tags []string
+	for url != "" {
+		page := tagListV1{}
+		next, err := r.httpClient.GetJSONPage(ctx, url, "application/json", &page)
+		if err != nil {
+			return nil, fmt.Errorf("error listing tags from %s: %w", url, err)
+		}
+		// Stop when the last tag doesn't advance, e.g. a registry that ignores "last" returns the same page again.
+		if len(page.Tags) == 0 || len(tags) > 0 && page.Tags[len(page.Tags)-1] == tags[len(tags)-1] {
+			break
+		}
+		tags = append(tags, page.Tags...)
+
+		// Registries that don't return a "Link" header can still be paged by the last tag, until a page isn't full.
+		if next == "" && len(page.Tags) == tagsPageSize {
+			next = fmt.Sprintf("%s/tags/list?n=%d&last=%s", r.repositoryURL(ref.Path()), tagsPageSize, urlpkg.QueryEscape(page.Tags[len(page.Tags)-1]))
+		} else if next == url { // e.g. a "Link" header to the same page
+			break
+		}
+		url = next
 	}
+	return tags, nil
 }
 
 func (r *registry) findPlatformManifest(ctx context.Context, index *imageIndexV1, path, platform string) (*imageManifestV1, error) {
-	platformToURL := map[string]string{} // duplicate keys are possible with os.version
-	platformToOSVersion := map[string]string{}
-	urlToMediaType := map[string]string{}
+	platform, osVersion := osversion.Split(platform)
 
+	platformToRefs := map[string][]*imageManifestReferenceV1{} // more than one when they differ by os.version
 	for _, ref := range index.Manifests {
-		p := pathutil.Join(ref.Platform.OS, ref.Platform.Architecture)
-		if p == "" {
+		p := pathutil.Join(ref.Platform.OS, ref.Platform.Architecture, ref.Platform.Variant)
+		if p == "" || ref.isAttestation() {
 			continue // skip unknown platform
 		}
-		url := fmt.Sprintf("%s/%s/manifests/%s", r.baseURL, path, ref.Digest)
-		lastOSVersion := platformToOSVersion[p]
-		if ref.Platform.OSVersion >= lastOSVersion {
-			platformToURL[p] = url
-			urlToMediaType[url] = ref.MediaType
-			platformToOSVersion[p] = ref.Platform.OSVersion
-		}
+		platformToRefs[p] = append(platformToRefs[p], ref)
 	}
 
+	platforms := make(map[string]string, len(platformToRefs))
+	for p := range platformToRefs {
+		platforms[p] = ""
+	}
 	var err error
-	if platform, err = requireValidPlatform(platform, platformToURL); err != nil {
+	if platform, err = requireValidPlatform(platform, platforms); err != nil {
+		return nil, err
+	}
+	ref, err := chooseOSVersion(platform, osVersion, platformToRefs[platform])
+	if err != nil {
 		return nil, err
 	}
 
-	url := platformToURL[platform]
-	mediaType := urlToMediaType[url]
+	url := fmt.Sprintf("%s/manifests/%s", r.repositoryURL(path), ref.Digest)
 
 	manifest := imageManifestV1{}
-	if err := r.httpClient.GetJSON(ctx, url, mediaType, &manifest); err != nil {
+	if err := r.getJSON(ctx, url, ref.MediaType, ref.Digest, &manifest); err != nil {
 		return nil, fmt.Errorf("error getting image ref for platform %s: %w", platform, err)
 	}
 	manifest.URL = url
+	manifest.Digest = ref.Digest
+	manifest.MediaType = ref.MediaType
+	manifest.Variant = ref.Platform.Variant
 	return &manifest, nil
 }
 
+// chooseOSVersion returns the reference with the latest os.version that
+// matches osVersion, e.g. "10.0.17763.1879" for "10.0.17763". Any os.version
+// matches when osVersion is empty.
+func chooseOSVersion(platform, osVersion string, refs []*imageManifestReferenceV1) (*imageManifestReferenceV1, error) {
+	var chosen *imageManifestReferenceV1
+	var versions []string
+	for _, ref := range refs {
+		if v := ref.Platform.OSVersion; v != "" {
+			versions = append(versions, v)
+		}
+		if !osversion.Matches(osVersion, ref.Platform.OSVersion) {
+			continue
+		}
+		if chosen == nil || osversion.Compare(ref.Platform.OSVersion, chosen.Platform.OSVersion) >= 0 {
+			chosen = ref
+		}
+	}
+	if chosen != nil {
+		return chosen, nil
+	}
+	return nil, osVersionNotFound(platform, osVersion, versions...)
+}
+
+// osVersionNotFound returns an error listing the platform with each available
+// os.version, latest first, as that's what a host is most likely to run.
+func osVersionNotFound(platform, osVersion string, versions ...string) error {
+	sort.Slice(versions, func(i, j int) bool { return osversion.Compare(versions[i], versions[j]) > 0 })
+	available := []string{platform}
+	if len(versions) > 0 {
+		available = available[:0]
+		for _, v := range versions {
+			available = append(available, osversion.Join(platform, v))
+		}
+	}
+	return &api.UnsupportedPlatformError{Platform: osversion.Join(platform, osVersion), Platforms: available}
+}
+
+// requireConfigPlatform double-checks the platform of an image config, as a
+// single-platform image has no image index to choose it from.
+func requireConfigPlatform(platform string, config *imageConfigV1) error {
+	platform, osVersion := osversion.Split(platform)
+
+	platforms := map[string]string{}
+	if p := config.platform(); p != "" {
+		platforms[p] = ""
+	}
+
+	// An unknown image config may fail to include platform metadata.
+	if platform != "" {
+		if _, err := requireValidPlatform(platform, platforms); err != nil {
+			return err
+		}
+	}
+	if !osversion.Matches(osVersion, config.OSVersion) {
+		var versions []string
+		if config.OSVersion != "" {
+			versions = append(versions, config.OSVersion)
+		}
+		return osVersionNotFound(config.platform(), osVersion, versions...)
+	}
+	return nil
+}
+
+// defaultVariants are the variants implied when a platform doesn't have one.
+//
+// See https://github.com/containerd/containerd/blob/main/platforms/database.go
+var defaultVariants = map[string]string{"arm": "v7", "arm64": "v8"}
+
+// requireValidPlatform returns the key in platforms that matches platform,
+// e.g. "linux/arm64/v8" when platform is "linux/arm64", or the only one when
+// platform is empty.
 func requireValidPlatform(platform string, platforms map[string]string) (string, error) {
 	// While possible to pull a manifest with no platform information, we currently error as it could
 	// be a sign of a bug in the JSON. We can change this to be allowed if platform == "" as needed.
 	if len(platforms) == 0 {
-		return "", fmt.Errorf("image config contains no platform information")
+		return "", api.ErrNoPlatform
 	}
 
 	// If we are platform-agnostic return the only platform or error if it is ambiguous
@@ -258,17 +547,62 @@ func requireValidPlatform(platform string, platforms map[string]string) (string,
 				return p, nil
 			}
 		}
-		return "", fmt.Errorf("choose a platform: %s", sortedKeyString(platforms))
+		return "", &api.AmbiguousPlatformError{Platforms: sortedKeys(platforms)}
 	}
 
 	// see if the desired platform is present. Otherwise
 	if _, ok := platforms[platform]; ok {
 		return platform, nil
 	}
-	return "", fmt.Errorf("%s is not a supported platform: %s", platform, sortedKeyString(platforms))
+
+	// Otherwise, look for one that differs only by variant, e.g. "linux/arm/v7" for "linux/arm".
+	matches := map[string]string{}
+	for p := range platforms {
+		if variantMatches(platform, p) {
+			matches[p] = ""
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", &api.UnsupportedPlatformError{Platform: platform, Platforms: sortedKeys(platforms)}
+	case 1:
+		for p := range matches {
+			return p, nil
+		}
+	}
+	return "", &api.AmbiguousPlatformError{Platforms: sortedKeys(matches)}
+}
+
+// variantMatches returns true if the platforms have the same OS and
+// architecture, and the variant of the candidate is compatible. No variant
+// is compatible with any, and a default variant is compatible with none.
+func variantMatches(platform, candidate string) bool {
+	pOS, pArch, pVariant := splitPlatform(platform)
+	cOS, cArch, cVariant := splitPlatform(candidate)
+	switch {
+	case pOS != cOS || pArch != cArch:
+		return false
+	case pVariant == "" || pVariant == cVariant:
+		return true
+	case cVariant == "":
+		return pVariant == defaultVariants[pArch]
+	default:
+		return false
+	}
+}
+
+// splitPlatform splits a platform like "linux/arm/v7" into its fields.
+func splitPlatform(platform string) (pOS, pArch, pVariant string) {
+	pOS, pArch, _ = strings.Cut(platform, "/")
+	pArch, pVariant, _ = strings.Cut(pArch, "/")
+	return
 }
 
 func sortedKeyString(m map[string]string) string {
+	return strings.Join(sortedKeys(m), ", ")
+}
+
+func sortedKeys(m map[string]string) []string {
 	keys := make([]string, 0, len(m))
 	for key := range m {
 		keys = append(keys, key)
@@ -276,33 +610,74 @@ func sortedKeyString(m map[string]string) string {
 	sort.Slice(keys, func(i, j int) bool {
 		return keys[i] < keys[j]
 	})
-	return strings.Join(keys, ", ")
+	return keys
 }
 
 func (r *registry) getImageConfig(ctx context.Context, path string, image *imageManifestV1) (*imageConfigV1, error) {
+	url := fmt.Sprintf("%s/blobs/%s", r.repositoryURL(path), image.Config.Digest)
 	if !strings.Contains(acceptImageConfigV1, image.Config.MediaType) {
-		return nil, fmt.Errorf("invalid config media type in image %v", image)
+		return nil, &api.UnsupportedMediaTypeError{MediaType: image.Config.MediaType, URL: url}
 	}
-	url := fmt.Sprintf("%s/%s/blobs/%s", r.baseURL, path, image.Config.Digest)
 	config := imageConfigV1{}
-	if err := r.httpClient.GetJSON(ctx, url, image.Config.MediaType, &config); err != nil {
+	if err := r.getJSON(ctx, url, image.Config.MediaType, image.Config.Digest, &config); err != nil {
 		return nil, fmt.Errorf("error getting image config from %s: %w", url, err)
 	}
 	return &config, nil
 }
 
+// getJSON is like httpclient.HTTPClient GetJSON, except it returns
+// api.DigestMismatchError if the content doesn't match the digest it was
+// requested by.
+func (r *registry) getJSON(ctx context.Context, url, accept, dgst string, v interface{}) error {
+	header := http.Header{}
+	header.Add("Accept", accept)
+	body, _, err := r.httpClient.Get(ctx, url, header)
+	if err != nil {
+		return err // wrapping doesn't help on this branch
+	}
+	defer body.Close()         //nolint
+	b, err := io.ReadAll(body) // fully read the response
+	if err != nil {
+		return err
+	}
+	if err = digest.Verify(dgst, b); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error unmarshalling %v: %w", v, err)
+	}
+	return nil
+}
+
 func (r *registry) ReadFilesystemLayer(ctx context.Context, layer api.FilesystemLayer, readFile api.ReadFile) error {
 	l := layer.(filesystemLayer)
-	mediaType := l.MediaType()
 
 	header := http.Header{}
-	header.Add("Accept", mediaType)
+	header.Add("Accept", l.MediaType())
 	body, _, err := r.httpClient.Get(ctx, l.url, header)
 	if err != nil {
 		return err
 	}
 	defer body.Close() //nolint
 
+	// Hash the compressed stream as it is read, so that we don't buffer it.
+	verifier, err := digest.NewVerifier(l.digest, body)
+	if err != nil {
+		return err
+	}
+	if err = readLayer(verifier, layer, readFile); err != nil {
+		return err
+	}
+	if err = verifier.Verify(); err != nil {
+		return fmt.Errorf("invalid layer from %s: %w", l.url, err)
+	}
+	return nil
+}
+
+// readLayer calls readFile for each file in the possibly compressed layer.
+func readLayer(body io.Reader, layer api.FilesystemLayer, readFile api.ReadFile) error {
+	mediaType := layer.MediaType()
+
 	var src io.Reader = body
 	if strings.HasSuffix(mediaType, "gzip") {
 		zSrc, err := gzip.NewReader(body)
@@ -312,6 +687,14 @@ func (r *registry) ReadFilesystemLayer(ctx context.Context, layer api.Filesystem
 		defer zSrc.Close() //nolint
 		src = zSrc
 		mediaType = mediaType[:len(mediaType)-5] // +gzip or .gzip
+	} else if strings.HasSuffix(mediaType, "+zstd") {
+		zSrc, err := zstd.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer zSrc.Close()
+		src = zSrc
+		mediaType = mediaType[:len(mediaType)-5]
 	}
 
 	if strings.HasSuffix(mediaType, "tar") {
@@ -324,22 +707,25 @@ func (r *registry) ReadFilesystemLayer(ctx context.Context, layer api.Filesystem
 				return err
 			}
 
-			// Skip directories, symbolic links, block devices, etc.
-			if th.Typeflag != tar.TypeReg {
+			// Skip block devices, FIFOs, etc.
+			switch th.Typeflag {
+			case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+			default:
 				continue
 			}
 
-			// We currently don't implement deleting files from the list
-			// https://github.com/opencontainers/image-spec/blob/859973e32ccae7b7fc76b40b762c9fff6e912f9e/layer.md#whiteouts
-			if strings.Contains(th.Name, ".wh.") {
-				continue
-			}
+			// Whiteout files, e.g. ".wh.foo", are passed through, as they only
+			// make sense when applying layers on top of each other.
 			mode := th.FileInfo().Mode()
 			if mode.Perm() == 0 {
 				// Windows doesn't need an execute bit, this makes `car` usable on darwin and linux.
-				mode = 0o644 & os.ModePerm
+				if mode.IsDir() {
+					mode |= 0o755 & os.ModePerm
+				} else {
+					mode |= 0o644 & os.ModePerm
+				}
 			}
-			if err := readFile(th.Name, th.Size, mode, th.ModTime, tr); err != nil {
+			if err := readFile(th.Name, th.Size, mode, th.ModTime, th.Linkname, tr); err != nil {
 				return fmt.Errorf("error calling readFile on %s: %w", th.Name, err)
 			}
 		}
@@ -347,7 +733,7 @@ func (r *registry) ReadFilesystemLayer(ctx context.Context, layer api.Filesystem
 		if fileName := layer.FileName(); fileName == "" {
 			return errors.New("missing filename")
 		} else {
-			return readFile(layer.FileName(), layer.Size(), 0o644, time.Now(), src)
+			return readFile(layer.FileName(), layer.Size(), 0o644, time.Now(), "", src)
 		}
 	}
 	return nil
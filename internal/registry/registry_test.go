@@ -15,13 +15,17 @@
 package registry
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -29,12 +33,24 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/tetratelabs/car/api"
+	"github.com/tetratelabs/car/internal/digest"
 	"github.com/tetratelabs/car/internal/httpclient"
 	"github.com/tetratelabs/car/internal/reference"
-	"github.com/tetratelabs/car/internal/registry/docker"
-	"github.com/tetratelabs/car/internal/registry/github"
+	"github.com/tetratelabs/car/internal/registry/cache"
 )
 
+// TestMain ensures tests don't use credentials of the current user.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "docker-config")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DOCKER_CONFIG", dir) //nolint
+	code := m.Run()
+	os.RemoveAll(dir) //nolint
+	os.Exit(code)
+}
+
 func TestNew(t *testing.T) {
 	tests := []struct{ name, host, expectedBaseURL string }{
 		{
@@ -87,45 +103,40 @@ func TestNew(t *testing.T) {
 	}
 }
 
-func TestHttpClientTransport(t *testing.T) {
-	tests := []struct {
-		name     string
-		ctx      context.Context
-		host     string
-		expected http.RoundTripper
-	}{
-		{
-			name:     "default nothing in context",
-			ctx:      context.Background(),
-			expected: http.DefaultTransport,
-		},
-		{
-			name:     "default something in context",
-			ctx:      httpclient.ContextWithTransport(context.Background(), github.NewRoundTripper()),
-			expected: github.NewRoundTripper(),
-		},
-		{
-			name:     "Docker",
-			ctx:      context.Background(),
-			host:     "index.docker.io",
-			expected: docker.NewRoundTripper(),
-		},
-		{
-			name:     "GitHub",
-			ctx:      context.Background(),
-			host:     "ghcr.io",
-			expected: github.NewRoundTripper(),
-		},
-	}
+// TestNew_InvalidDockerConfig ensures credentials aren't read until the
+// registry challenges, so a broken config doesn't fail anonymous pulls.
+func TestNew_InvalidDockerConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte("{"), 0o600))
 
-	for _, tc := range tests {
-		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+	_, err := New(context.Background(), "ghcr.io")
+	require.NoError(t, err)
+}
 
-		t.Run(tc.name, func(t *testing.T) {
-			transport := httpClientTransport(tc.ctx, tc.host)
-			require.IsType(t, tc.expected, transport)
-		})
-	}
+// The JSON in testdata is trimmed to the fields read, so it no longer hashes
+// to the digests it was referenced by. As digests are verified, the served
+// copies reference the digests of the trimmed content instead.
+var (
+	servedHomebrewManifest = withDigest(homebrew113VndOciImageManifestV1Json,
+		"sha256:a7f8bac78026ae40545531454c2ef4df75ec3de1c60f1d6923142fe4e44daf8a", homebrew113VndOciImageConfigV1Json)
+	servedHomebrewIndex = withDigest(homebrewVndOciImageIndexV1Json,
+		"sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672", servedHomebrewManifest)
+	servedLinuxAmd64Manifest = withDigest(linuxAmd64VndDockerImageManifestV1Json,
+		"sha256:33655f17f09318801873b70f89c1596ce38f41f6c074e2343d26e9b425f939ec", linuxAmd64VndDockerImageConfigV1Json)
+	servedLinuxArm64Manifest = withDigest(linuxArm64VndDockerImageManifestV1Json,
+		"sha256:a76857bf7e536baff5d0e4b316f1197dff0763bef3d9405f00e63f0deddb7447", linuxArm64VndDockerImageConfigV1Json)
+	servedLinuxIndex = withDigest(withDigest(linuxVndDockerImageIndexV1Json,
+		"sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c", servedLinuxArm64Manifest),
+		"sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f", servedLinuxAmd64Manifest)
+	servedWindowsManifest = withDigest(windowsVndDockerImageManifestV1Json,
+		"sha256:00378fa4979bfcc7d1f5d33bb8cebe526395021801f9e233f8909ffc25a6f630", windowsVndDockerImageConfigV1Json)
+)
+
+// withDigest returns a copy of the JSON, replacing the digest with that of
+// the content.
+func withDigest(b []byte, dgst string, content []byte) []byte {
+	return bytes.ReplaceAll(b, []byte(dgst), []byte(digest.FromBytes(content)))
 }
 
 var indexOrManifestRequest = `GET /v2/user/repo/manifests/v1.0 HTTP/1.1
@@ -135,11 +146,11 @@ Accept: application/vnd.oci.image.manifest.v1+json,application/vnd.docker.distri
 
 `
 
-var homebrewRequests = []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672 HTTP/1.1
+var homebrewRequests = []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:60b904e22dce02da8876f210631c173d8a91d6a974f92fc8dd6eb3cfcb8b2788 HTTP/1.1
 Host: test
 Accept: application/vnd.oci.image.manifest.v1+json
 
-`, `GET /v2/user/repo/blobs/sha256:a7f8bac78026ae40545531454c2ef4df75ec3de1c60f1d6923142fe4e44daf8a HTTP/1.1
+`, `GET /v2/user/repo/blobs/sha256:8438f5d2d6e98d64ac50091d0f4292d4ac3887b97d1fbbda4da5f401daf0e5b9 HTTP/1.1
 Host: test
 Accept: application/vnd.oci.image.config.v1+json
 
@@ -152,8 +163,8 @@ var homebrewMediaTypes = []string{
 }
 
 var homebrewResponseBodies = [][]byte{
-	homebrewVndOciImageIndexV1Json,
-	homebrew113VndOciImageManifestV1Json,
+	servedHomebrewIndex,
+	servedHomebrewManifest,
 	homebrew113VndOciImageConfigV1Json,
 }
 
@@ -173,7 +184,7 @@ var trivyResponseBodies = [][]byte{
 	trivyVndOciUnknownConfigV1Json,
 }
 
-var windowsRequests = []string{indexOrManifestRequest, `GET /v2/user/repo/blobs/sha256:00378fa4979bfcc7d1f5d33bb8cebe526395021801f9e233f8909ffc25a6f630 HTTP/1.1
+var windowsRequests = []string{indexOrManifestRequest, `GET /v2/user/repo/blobs/sha256:9ee6adf86f56435a40e9bc6b34025c6f73ad3f68e7d418194233d855b7c32b36 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.container.image.v1+json
 
@@ -185,10 +196,136 @@ var windowsMediaTypes = []string{
 }
 
 var windowsResponseBodies = [][]byte{
-	windowsVndDockerImageManifestV1Json,
+	servedWindowsManifest,
 	windowsVndDockerImageConfigV1Json,
 }
 
+var linuxArm64Requests = []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500 HTTP/1.1
+Host: test
+Accept: application/vnd.docker.distribution.manifest.v2+json
+
+`, `GET /v2/user/repo/blobs/sha256:235379a0c68df2ad22c23d63eb00839ad95cd987620f94875b0d18ad7ded0690 HTTP/1.1
+Host: test
+Accept: application/vnd.docker.container.image.v1+json
+
+`}
+
+// linuxVariantIndex has variants of "linux/arm", and its "linux/arm64/v8" is
+// the same image as "linux/arm64" in servedLinuxIndex.
+var linuxVariantIndex = []byte(`{
+  "manifests": [
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "digest": "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+      "platform": {"architecture": "arm", "os": "linux", "variant": "v6"}
+    },
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "digest": "sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17",
+      "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}
+    },
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "digest": "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+      "platform": {"architecture": "arm64", "os": "linux", "variant": "v8"}
+    }
+  ]
+}`)
+
+// imageLinuxArm64V8 is imageLinuxArm64, with the variant from linuxVariantIndex.
+var imageLinuxArm64V8 = func() image {
+	i := imageLinuxArm64
+	i.platform = "linux/arm64/v8"
+	i.indexDigest = digest.FromBytes(linuxVariantIndex)
+	return i
+}()
+
+// linuxAttestationIndex has "linux/arm64" from servedLinuxIndex, and an
+// attestation manifest for it, as added by "docker buildx build".
+var linuxAttestationIndex = []byte(`{
+  "manifests": [
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "digest": "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+      "platform": {"architecture": "arm64", "os": "linux"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f",
+      "platform": {"architecture": "unknown", "os": "unknown"},
+      "annotations": {
+        "vnd.docker.reference.digest": "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+        "vnd.docker.reference.type": "attestation-manifest"
+      }
+    }
+  ]
+}`)
+
+// imageLinuxArm64Attested is imageLinuxArm64, from linuxAttestationIndex.
+var imageLinuxArm64Attested = func() image {
+	i := imageLinuxArm64
+	i.indexDigest = digest.FromBytes(linuxAttestationIndex)
+	return i
+}()
+
+// homebrewIndexMissingPlatform is servedHomebrewIndex, except the
+// first manifest has no platform.
+var homebrewIndexMissingPlatform = []byte(`{
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:0da7ea4ca0f3615ace3b2223248e0baed539223df62d33d4c1a1e23346329057"
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:60b904e22dce02da8876f210631c173d8a91d6a974f92fc8dd6eb3cfcb8b2788",
+      "platform": {
+        "architecture": "amd64",
+        "os": "darwin",
+        "os.version": "macOS 11.3"
+      }
+    }
+  ]
+}`)
+
+// imageHomebrewMissingPlatform is imageHomebrew, from homebrewIndexMissingPlatform.
+var imageHomebrewMissingPlatform = func() image {
+	i := imageHomebrew
+	i.indexDigest = digest.FromBytes(homebrewIndexMissingPlatform)
+	return i
+}()
+
+// windowsOSVersionIndex has two builds of "windows/amd64", where the latest is
+// lexically less than the other.
+var windowsOSVersionIndex = []byte(`{
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129",
+      "platform": {"architecture": "amd64", "os": "windows", "os.version": "10.0.17763.1879"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
+      "platform": {"architecture": "amd64", "os": "windows", "os.version": "10.0.9200.1"}
+    }
+  ]
+}`)
+
+var windowsOSVersionRequests = []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129 HTTP/1.1
+Host: test
+Accept: application/vnd.oci.image.manifest.v1+json
+
+`, windowsRequests[1]}
+
+// imageWindowsOSVersion is imageWindows, from windowsOSVersionIndex.
+var imageWindowsOSVersion = func() image {
+	i := imageWindows
+	i.url = "https://test/v2/user/repo/manifests/" + i.manifestDigest
+	i.indexDigest = digest.FromBytes(windowsOSVersionIndex)
+	return i
+}()
+
 func TestGetImage(t *testing.T) {
 	tests := []struct {
 		name, platform     string
@@ -254,28 +391,12 @@ func TestGetImage(t *testing.T) {
 		},
 		{
 			name:               "index skips manifest missing platform",
-			expected:           imageHomebrew,
+			expected:           imageHomebrewMissingPlatform,
 			expectedRequests:   homebrewRequests,
 			responseMediaTypes: homebrewMediaTypes,
 			responseBodies: [][]byte{
-				[]byte(`{
-  "manifests": [
-    {
-      "mediaType": "application/vnd.oci.image.manifest.v1+json",
-      "digest": "sha256:0da7ea4ca0f3615ace3b2223248e0baed539223df62d33d4c1a1e23346329057"
-    },
-    {
-      "mediaType": "application/vnd.oci.image.manifest.v1+json",
-      "digest": "sha256:03efb0078d32e24f3730afb13fc58b635bd4e9c6d5ab32b90af3922efc7f8672",
-      "platform": {
-        "architecture": "amd64",
-        "os": "darwin",
-        "os.version": "macOS 11.3"
-      }
-    }
-  ]
-}`),
-				homebrew113VndOciImageManifestV1Json,
+				homebrewIndexMissingPlatform,
+				servedHomebrewManifest,
 				homebrew113VndOciImageConfigV1Json,
 			},
 		},
@@ -287,15 +408,70 @@ func TestGetImage(t *testing.T) {
 			responseBodies:     homebrewResponseBodies,
 			expectedErr:        "windows/amd64 is not a supported platform: darwin/amd64",
 		},
+		{
+			name:               "os.version prefix",
+			platform:           "darwin(macOS 11)/amd64",
+			expected:           imageHomebrew,
+			expectedRequests:   homebrewRequests,
+			responseMediaTypes: homebrewMediaTypes,
+			responseBodies:     homebrewResponseBodies,
+		},
+		{
+			name:               "os.version wrong choice",
+			platform:           "darwin(macOS 12)/amd64",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: homebrewMediaTypes[:1],
+			responseBodies:     homebrewResponseBodies[:1],
+			expectedErr:        "darwin(macOS 12)/amd64 is not a supported platform: darwin(macOS 11.3)/amd64, darwin(macOS 10.15.7)/amd64",
+		},
+		{
+			name:               "os.version chooses latest numerically",
+			expected:           imageWindowsOSVersion,
+			expectedRequests:   windowsOSVersionRequests,
+			responseMediaTypes: []string{api.MediaTypeOCIImageIndex, api.MediaTypeOCIImageManifest, api.MediaTypeDockerContainerImage},
+			responseBodies:     [][]byte{windowsOSVersionIndex, servedWindowsManifest, windowsVndDockerImageConfigV1Json},
+		},
+		{
+			name:               "os.version wrong choice sorted numerically",
+			platform:           "windows(10.0.20348)/amd64",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeOCIImageIndex},
+			responseBodies:     [][]byte{windowsOSVersionIndex},
+			expectedErr:        "windows(10.0.20348)/amd64 is not a supported platform: windows(10.0.17763.1879)/amd64, windows(10.0.9200.1)/amd64",
+		},
+		{
+			name:               "single platform os.version",
+			platform:           "windows(10.0.17763)/amd64",
+			expected:           imageWindows,
+			expectedRequests:   windowsRequests,
+			responseMediaTypes: windowsMediaTypes,
+			responseBodies:     windowsResponseBodies,
+		},
+		{
+			name:               "single platform os.version wrong choice",
+			platform:           "windows(10.0.20348)/amd64",
+			expectedRequests:   windowsRequests,
+			responseMediaTypes: windowsMediaTypes,
+			responseBodies:     windowsResponseBodies,
+			expectedErr:        "windows(10.0.20348)/amd64 is not a supported platform: windows(10.0.17763.1879)/amd64",
+		},
+		{
+			name:               "no os.version wrong choice",
+			platform:           "linux(10.0)/amd64",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
+			responseBodies:     [][]byte{servedLinuxIndex},
+			expectedErr:        "linux(10.0)/amd64 is not a supported platform: linux/amd64",
+		},
 		{
 			name:     "chooses correct platform (linux/amd64)",
 			platform: "linux/amd64",
 			expected: imageLinuxAmd64,
-			expectedRequests: []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f HTTP/1.1
+			expectedRequests: []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.distribution.manifest.v2+json
 
-`, `GET /v2/user/repo/blobs/sha256:33655f17f09318801873b70f89c1596ce38f41f6c074e2343d26e9b425f939ec HTTP/1.1
+`, `GET /v2/user/repo/blobs/sha256:41f3c087311d59c44cdec3dfda00dfad7a3528590b3bf383befeab1778d3d412 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.container.image.v1+json
 
@@ -306,8 +482,8 @@ Accept: application/vnd.docker.container.image.v1+json
 				api.MediaTypeDockerContainerImage,
 			},
 			responseBodies: [][]byte{
-				linuxVndDockerImageIndexV1Json,
-				linuxAmd64VndDockerImageManifestV1Json,
+				servedLinuxIndex,
+				servedLinuxAmd64Manifest,
 				linuxAmd64VndDockerImageConfigV1Json,
 			},
 		},
@@ -315,11 +491,11 @@ Accept: application/vnd.docker.container.image.v1+json
 			name:     "multi-platform correct choice (linux/arm64)",
 			platform: "linux/arm64",
 			expected: imageLinuxArm64,
-			expectedRequests: []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c HTTP/1.1
+			expectedRequests: []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.distribution.manifest.v2+json
 
-`, `GET /v2/user/repo/blobs/sha256:a76857bf7e536baff5d0e4b316f1197dff0763bef3d9405f00e63f0deddb7447 HTTP/1.1
+`, `GET /v2/user/repo/blobs/sha256:235379a0c68df2ad22c23d63eb00839ad95cd987620f94875b0d18ad7ded0690 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.container.image.v1+json
 
@@ -330,8 +506,8 @@ Accept: application/vnd.docker.container.image.v1+json
 				api.MediaTypeDockerContainerImage,
 			},
 			responseBodies: [][]byte{
-				linuxVndDockerImageIndexV1Json,
-				linuxArm64VndDockerImageManifestV1Json,
+				servedLinuxIndex,
+				servedLinuxArm64Manifest,
 				linuxArm64VndDockerImageConfigV1Json,
 			},
 		},
@@ -339,11 +515,11 @@ Accept: application/vnd.docker.container.image.v1+json
 			name:     "multi-platform correct choice (linux/arm64)",
 			platform: "linux/arm64",
 			expected: imageLinuxArm64,
-			expectedRequests: []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c HTTP/1.1
+			expectedRequests: []string{indexOrManifestRequest, `GET /v2/user/repo/manifests/sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.distribution.manifest.v2+json
 
-`, `GET /v2/user/repo/blobs/sha256:a76857bf7e536baff5d0e4b316f1197dff0763bef3d9405f00e63f0deddb7447 HTTP/1.1
+`, `GET /v2/user/repo/blobs/sha256:235379a0c68df2ad22c23d63eb00839ad95cd987620f94875b0d18ad7ded0690 HTTP/1.1
 Host: test
 Accept: application/vnd.docker.container.image.v1+json
 
@@ -354,11 +530,20 @@ Accept: application/vnd.docker.container.image.v1+json
 				api.MediaTypeDockerContainerImage,
 			},
 			responseBodies: [][]byte{
-				linuxVndDockerImageIndexV1Json,
-				linuxArm64VndDockerImageManifestV1Json,
+				servedLinuxIndex,
+				servedLinuxArm64Manifest,
 				linuxArm64VndDockerImageConfigV1Json,
 			},
 		},
+		{
+			name:               "config digest mismatch",
+			expectedRequests:   windowsRequests,
+			responseMediaTypes: windowsMediaTypes,
+			responseBodies:     [][]byte{servedWindowsManifest, trivyVndOciUnknownConfigV1Json},
+			expectedErr: "error getting image config from https://test/v2/user/repo/blobs/" + digest.FromBytes(windowsVndDockerImageConfigV1Json) +
+				": digest mismatch: expected " + digest.FromBytes(windowsVndDockerImageConfigV1Json) +
+				", but was " + digest.FromBytes(trivyVndOciUnknownConfigV1Json),
+		},
 		{
 			name:               "multi-platform, but no manifests",
 			expectedRequests:   []string{indexOrManifestRequest},
@@ -374,12 +559,12 @@ Accept: application/vnd.docker.container.image.v1+json
   "manifests": [
     {
       "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-      "digest": "sha256:f1cb90d4df0521842fe5f5c01a00032c76ba1743e1b2477589103373af06707c",
+      "digest": "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
       "size": 2403
     },
     {
       "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-      "digest": "sha256:4e07f3bd88fb4a468d5551c21eb05f625b0efe9ee00ae25d3ffb87c0f563693f",
+      "digest": "sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17",
       "size": 2403
     }
   ]
@@ -390,15 +575,69 @@ Accept: application/vnd.docker.container.image.v1+json
 			name:               "multi-platform ambiguous",
 			expectedRequests:   []string{indexOrManifestRequest},
 			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
-			responseBodies:     [][]byte{linuxVndDockerImageIndexV1Json},
+			responseBodies:     [][]byte{servedLinuxIndex},
 			expectedErr:        "choose a platform: linux/amd64, linux/arm64",
 		},
+		{
+			name:               "variant",
+			platform:           "linux/arm64/v8",
+			expected:           imageLinuxArm64V8,
+			expectedRequests:   linuxArm64Requests,
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList, api.MediaTypeDockerManifest, api.MediaTypeDockerContainerImage},
+			responseBodies:     [][]byte{linuxVariantIndex, servedLinuxArm64Manifest, linuxArm64VndDockerImageConfigV1Json},
+		},
+		{
+			name:               "variant implied by platform",
+			platform:           "linux/arm64",
+			expected:           imageLinuxArm64V8,
+			expectedRequests:   linuxArm64Requests,
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList, api.MediaTypeDockerManifest, api.MediaTypeDockerContainerImage},
+			responseBodies:     [][]byte{linuxVariantIndex, servedLinuxArm64Manifest, linuxArm64VndDockerImageConfigV1Json},
+		},
+		{
+			name:               "default variant",
+			platform:           "linux/arm64/v8",
+			expected:           imageLinuxArm64,
+			expectedRequests:   linuxArm64Requests,
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList, api.MediaTypeDockerManifest, api.MediaTypeDockerContainerImage},
+			responseBodies:     [][]byte{servedLinuxIndex, servedLinuxArm64Manifest, linuxArm64VndDockerImageConfigV1Json},
+		},
+		{
+			name:               "attestation skipped",
+			expected:           imageLinuxArm64Attested,
+			expectedRequests:   linuxArm64Requests,
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList, api.MediaTypeDockerManifest, api.MediaTypeDockerContainerImage},
+			responseBodies:     [][]byte{linuxAttestationIndex, servedLinuxArm64Manifest, linuxArm64VndDockerImageConfigV1Json},
+		},
+		{
+			name:               "variant ambiguous",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
+			responseBodies:     [][]byte{linuxVariantIndex},
+			expectedErr:        "choose a platform: linux/arm/v6, linux/arm/v7, linux/arm64/v8",
+		},
+		{
+			name:               "variant ambiguous platform",
+			platform:           "linux/arm",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
+			responseBodies:     [][]byte{linuxVariantIndex},
+			expectedErr:        "choose a platform: linux/arm/v6, linux/arm/v7",
+		},
+		{
+			name:               "variant wrong choice",
+			platform:           "linux/arm/v5",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
+			responseBodies:     [][]byte{linuxVariantIndex},
+			expectedErr:        "linux/arm/v5 is not a supported platform: linux/arm/v6, linux/arm/v7, linux/arm64/v8",
+		},
 		{
 			name:               "multi-platform wrong choice",
 			platform:           "windows/arm64",
 			expectedRequests:   []string{indexOrManifestRequest},
 			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
-			responseBodies:     [][]byte{linuxVndDockerImageIndexV1Json},
+			responseBodies:     [][]byte{servedLinuxIndex},
 			expectedErr:        "windows/arm64 is not a supported platform: linux/amd64, linux/arm64",
 		},
 	}
@@ -429,13 +668,443 @@ Accept: application/vnd.docker.container.image.v1+json
 	}
 }
 
+func TestListPlatforms(t *testing.T) {
+	tests := []struct {
+		name               string
+		expected           []api.Platform
+		expectedErr        string
+		expectedRequests   []string
+		responseMediaTypes []string
+		responseBodies     [][]byte
+	}{
+		{
+			name: "multi-platform",
+			expected: []api.Platform{
+				{
+					OS:           "linux",
+					Architecture: "arm64",
+					Digest:       "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+					MediaType:    api.MediaTypeDockerManifest,
+					Size:         2403,
+				},
+				{
+					OS:           "linux",
+					Architecture: "amd64",
+					Digest:       "sha256:66d28cf619987bf1df1e8f1ac47836da99ae2235e4c170ea095f3515e1c43a17",
+					MediaType:    api.MediaTypeDockerManifest,
+					Size:         2403,
+				},
+			},
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
+			responseBodies:     [][]byte{servedLinuxIndex},
+		},
+		{
+			name: "multi-platform os.version",
+			expected: []api.Platform{
+				{OS: "darwin", Architecture: "amd64", OSVersion: "macOS 10.15.7", Digest: "sha256:0da7ea4ca0f3615ace3b2223248e0baed539223df62d33d4c1a1e23346329057", MediaType: api.MediaTypeOCIImageManifest},
+				{OS: "darwin", Architecture: "amd64", OSVersion: "macOS 11.3", Digest: "sha256:60b904e22dce02da8876f210631c173d8a91d6a974f92fc8dd6eb3cfcb8b2788", MediaType: api.MediaTypeOCIImageManifest},
+			},
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeOCIImageIndex},
+			responseBodies:     [][]byte{servedHomebrewIndex},
+		},
+		{
+			name: "attestation skipped",
+			expected: []api.Platform{
+				{
+					OS:           "linux",
+					Architecture: "arm64",
+					Digest:       "sha256:d6ec929de2238aa49a3583db8c8dd306cbbff32fedab60c76143598156d0c500",
+					MediaType:    api.MediaTypeDockerManifest,
+				},
+			},
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerManifestList},
+			responseBodies:     [][]byte{linuxAttestationIndex},
+		},
+		{
+			name: "single platform",
+			expected: []api.Platform{
+				{
+					OS:           "windows",
+					Architecture: "amd64",
+					OSVersion:    "10.0.17763.1879",
+					Digest:       "sha256:d76ef52b8702e4d149b921f17c14a9b73065e50e86edc19d330cdd6741ac5129",
+					MediaType:    api.MediaTypeOCIImageManifest,
+					Size:         int64(len(servedWindowsManifest)),
+				},
+			},
+			expectedRequests:   windowsRequests,
+			responseMediaTypes: windowsMediaTypes,
+			responseBodies:     windowsResponseBodies,
+		},
+		{
+			name:               "unknown media type",
+			expectedRequests:   []string{indexOrManifestRequest},
+			responseMediaTypes: []string{api.MediaTypeDockerContainerImage},
+			responseBodies:     [][]byte{windowsVndDockerImageConfigV1Json},
+			expectedErr:        "unknown mediaType application/vnd.docker.container.image.v1+json from https://test/v2/user/repo/manifests/v1.0",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := httpclient.ContextWithTransport(context.Background(), &mock{
+				t:                  t,
+				requests:           tc.expectedRequests,
+				responseBodies:     tc.responseBodies,
+				responseMediaTypes: tc.responseMediaTypes,
+			})
+
+			r, err := New(ctx, "test")
+			require.NoError(t, err)
+			platforms, err := r.ListPlatforms(ctx, reference.MustParse("user/repo:v1.0"))
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, platforms)
+			}
+		})
+	}
+}
+
+func tagsRequest(query string) string {
+	return `GET /v2/user/repo/tags/list?` + query + ` HTTP/1.1
+Host: test
+Accept: application/json
+
+`
+}
+
+func TestListTags(t *testing.T) {
+	// fullPage is as many tags as requested, so the next page is requested by the last.
+	var fullPage tagListV1
+	for i := 0; i < tagsPageSize; i++ {
+		fullPage.Tags = append(fullPage.Tags, fmt.Sprintf("v0.%d", i))
+	}
+	fullPageJSON, err := json.Marshal(fullPage)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		expected           []string
+		expectedRequests   []string
+		responseMediaTypes []string
+		responseBodies     [][]byte
+		responseHeaders    []http.Header
+	}{
+		{
+			name:               "one page",
+			expected:           []string{"v1.0", "v1.1"},
+			expectedRequests:   []string{tagsRequest("n=1000")},
+			responseMediaTypes: []string{"application/json"},
+			responseBodies:     [][]byte{[]byte(`{"name":"user/repo","tags":["v1.0","v1.1"]}`)},
+		},
+		{
+			name:               "no tags",
+			expectedRequests:   []string{tagsRequest("n=1000")},
+			responseMediaTypes: []string{"application/json"},
+			responseBodies:     [][]byte{[]byte(`{"name":"user/repo","tags":null}`)},
+		},
+		{
+			name:               "link header",
+			expected:           []string{"v1.0", "v1.1"},
+			expectedRequests:   []string{tagsRequest("n=1000"), tagsRequest("last=v1.0&n=1000")},
+			responseMediaTypes: []string{"application/json", "application/json"},
+			responseBodies: [][]byte{
+				[]byte(`{"name":"user/repo","tags":["v1.0"]}`),
+				[]byte(`{"name":"user/repo","tags":["v1.1"]}`),
+			},
+			responseHeaders: []http.Header{{"Link": []string{`</v2/user/repo/tags/list?last=v1.0&n=1000>; rel="next"`}}},
+		},
+		{
+			name:               "link header to the same page",
+			expected:           []string{"v1.0"},
+			expectedRequests:   []string{tagsRequest("n=1000")},
+			responseMediaTypes: []string{"application/json"},
+			responseBodies:     [][]byte{[]byte(`{"name":"user/repo","tags":["v1.0"]}`)},
+			responseHeaders:    []http.Header{{"Link": []string{`</v2/user/repo/tags/list?n=1000>; rel="next"`}}},
+		},
+		{
+			name:               "link header after no tags",
+			expected:           []string{"v1.0"},
+			expectedRequests:   []string{tagsRequest("n=1000"), tagsRequest("last=v1.0&n=1000")},
+			responseMediaTypes: []string{"application/json", "application/json"},
+			responseBodies: [][]byte{
+				[]byte(`{"name":"user/repo","tags":["v1.0"]}`),
+				[]byte(`{"name":"user/repo","tags":[]}`),
+			},
+			responseHeaders: []http.Header{
+				{"Link": []string{`</v2/user/repo/tags/list?last=v1.0&n=1000>; rel="next"`}},
+				{"Link": []string{`</v2/user/repo/tags/list?last=v1.0&n=1000>; rel="next"`}},
+			},
+		},
+		{
+			name:               "full page without link header",
+			expected:           append(fullPage.Tags, "v1.0"),
+			expectedRequests:   []string{tagsRequest("n=1000"), tagsRequest("n=1000&last=v0.999")},
+			responseMediaTypes: []string{"application/json", "application/json"},
+			responseBodies:     [][]byte{fullPageJSON, []byte(`{"name":"user/repo","tags":["v1.0"]}`)},
+		},
+		{
+			name:               "full page with last ignored",
+			expected:           fullPage.Tags,
+			expectedRequests:   []string{tagsRequest("n=1000"), tagsRequest("n=1000&last=v0.999")},
+			responseMediaTypes: []string{"application/json", "application/json"},
+			responseBodies:     [][]byte{fullPageJSON, fullPageJSON},
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := httpclient.ContextWithTransport(context.Background(), &mock{
+				t:                  t,
+				requests:           tc.expectedRequests,
+				responseBodies:     tc.responseBodies,
+				responseMediaTypes: tc.responseMediaTypes,
+				responseHeaders:    tc.responseHeaders,
+			})
+
+			ref, err := reference.ParseRepository("user/repo")
+			require.NoError(t, err)
+			r, err := New(ctx, "test")
+			require.NoError(t, err)
+			tags, err := r.ListTags(ctx, ref)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, tags)
+		})
+	}
+}
+
+func TestListTags_OCILayout(t *testing.T) {
+	ref, err := reference.ParseRepository("oci:" + ociLayoutDir)
+	require.NoError(t, err)
+	r, err := New(context.Background(), ref.Domain())
+	require.NoError(t, err)
+
+	tags, err := r.ListTags(context.Background(), ref)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v1.0"}, tags)
+}
+
+var resolveRequest = strings.Replace(indexOrManifestRequest, "GET", "HEAD", 1)
+
+func TestResolve(t *testing.T) {
+	homebrewIndexDigest := digest.FromBytes(servedHomebrewIndex)
+	homebrewIndexSize := int64(len(servedHomebrewIndex))
+
+	tests := []struct {
+		name, ref          string
+		expected           api.Descriptor
+		expectedErr        string
+		expectedRequests   []string
+		responseMediaTypes []string
+		responseBodies     [][]byte
+		responseHeaders    []http.Header
+	}{
+		{
+			name:               "digest header",
+			ref:                "user/repo:v1.0",
+			expected:           api.Descriptor{MediaType: api.MediaTypeOCIImageIndex, Digest: homebrewIndexDigest, Size: homebrewIndexSize},
+			expectedRequests:   []string{resolveRequest},
+			responseMediaTypes: []string{api.MediaTypeOCIImageIndex + "; charset=utf-8"},
+			responseBodies:     [][]byte{nil},
+			responseHeaders: []http.Header{{
+				"Docker-Content-Digest": []string{homebrewIndexDigest},
+				"Content-Length":        []string{fmt.Sprint(homebrewIndexSize)},
+			}},
+		},
+		{
+			name:               "pinned to a digest",
+			ref:                "user/repo@" + trivyManifestDigest,
+			expected:           api.Descriptor{MediaType: api.MediaTypeOCIImageManifest, Digest: trivyManifestDigest, Size: 1234},
+			expectedRequests:   []string{strings.Replace(trivyDigestRequests[0], "GET", "HEAD", 1)},
+			responseMediaTypes: []string{api.MediaTypeOCIImageManifest},
+			responseBodies:     [][]byte{nil},
+			responseHeaders:    []http.Header{{"Content-Length": []string{"1234"}}},
+		},
+		{
+			name:               "no digest header",
+			ref:                "user/repo:v1.0",
+			expectedRequests:   []string{resolveRequest},
+			responseMediaTypes: []string{api.MediaTypeOCIImageIndex},
+			responseBodies:     [][]byte{nil},
+			expectedErr:        "no Docker-Content-Digest header from https://test/v2/user/repo/manifests/v1.0, so resolve it by digest or read it instead",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := httpclient.ContextWithTransport(context.Background(), &mock{
+				t:                  t,
+				requests:           tc.expectedRequests,
+				responseBodies:     tc.responseBodies,
+				responseMediaTypes: tc.responseMediaTypes,
+				responseHeaders:    tc.responseHeaders,
+			})
+
+			r, err := New(ctx, "test")
+			require.NoError(t, err)
+			d, err := r.Resolve(ctx, reference.MustParse(tc.ref))
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, d)
+			}
+		})
+	}
+}
+
+func TestResolve_OCILayout(t *testing.T) {
+	ref := reference.MustParse("oci:" + ociLayoutDir + ":v1.0")
+	r, err := New(context.Background(), ref.Domain())
+	require.NoError(t, err)
+
+	d, err := r.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	require.Equal(t, api.Descriptor{
+		MediaType: api.MediaTypeOCIImageManifest,
+		Digest:    imageOCILayout.manifestDigest,
+		Size:      477,
+	}, d)
+}
+
+// trivyManifestDigest is the digest of testdata/json/trivy-vnd.oci.image.manifest.v1.json
+const trivyManifestDigest = "sha256:434101b0fd35a8b6d56e2493b4956f347b2eb86a9cfab1c71c131a0789e0143a"
+
+var trivyDigestRequests = []string{`GET /v2/user/repo/manifests/` + trivyManifestDigest + ` HTTP/1.1
+Host: test
+Accept: application/vnd.oci.image.index.v1+json,application/vnd.docker.distribution.manifest.list.v2+json
+Accept: application/vnd.oci.image.manifest.v1+json,application/vnd.docker.distribution.manifest.v2+json
+
+`, trivyRequests[1]}
+
+func TestGetImage_Digest(t *testing.T) {
+	tests := []struct {
+		name, ref          string
+		expectedErr        string
+		expectedRequests   []string
+		responseMediaTypes []string
+		responseBodies     [][]byte
+	}{
+		{
+			name:               "digest",
+			ref:                "user/repo@" + trivyManifestDigest,
+			expectedRequests:   trivyDigestRequests,
+			responseMediaTypes: trivyMediaTypes,
+			responseBodies:     trivyResponseBodies,
+		},
+		{
+			name:               "tag and digest requests digest",
+			ref:                "user/repo:v1.0@" + trivyManifestDigest,
+			expectedRequests:   trivyDigestRequests,
+			responseMediaTypes: trivyMediaTypes,
+			responseBodies:     trivyResponseBodies,
+		},
+		{
+			name:               "digest mismatch",
+			ref:                "user/repo@" + trivyManifestDigest,
+			expectedRequests:   trivyDigestRequests,
+			responseMediaTypes: windowsMediaTypes,
+			responseBodies:     windowsResponseBodies,
+			expectedErr: "invalid manifest from https://test/v2/user/repo/manifests/" + trivyManifestDigest +
+				": digest mismatch: expected " + trivyManifestDigest +
+				", but was " + digest.FromBytes(servedWindowsManifest),
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := httpclient.ContextWithTransport(context.Background(), &mock{
+				t:                  t,
+				requests:           tc.expectedRequests,
+				responseBodies:     tc.responseBodies,
+				responseMediaTypes: tc.responseMediaTypes,
+			})
+
+			r, err := New(ctx, "test")
+			require.NoError(t, err)
+			i, err := r.GetImage(ctx, reference.MustParse(tc.ref), "")
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, imageTrivy.filesystemLayers, i.(image).filesystemLayers)
+			}
+		})
+	}
+}
+
+func TestGetImage_Cache(t *testing.T) {
+	c := cache.New(t.TempDir(), 0)
+
+	getImage := func(m *mock) api.Image {
+		ctx := cache.ContextWithCache(httpclient.ContextWithTransport(context.Background(), m), c)
+		r, err := New(ctx, "test")
+		require.NoError(t, err)
+		i, err := r.GetImage(ctx, reference.MustParse("user/repo:v1.0"), "")
+		require.NoError(t, err)
+		return i
+	}
+
+	first := getImage(&mock{
+		t:                  t,
+		requests:           trivyRequests,
+		responseBodies:     trivyResponseBodies,
+		responseMediaTypes: trivyMediaTypes,
+	})
+
+	// The tag is requested again, as it can move, but not the config.
+	second := getImage(&mock{
+		t:                  t,
+		requests:           trivyRequests[:1],
+		responseBodies:     trivyResponseBodies[:1],
+		responseMediaTypes: trivyMediaTypes[:1],
+	})
+	require.Equal(t, first, second)
+}
+
 //go:embed testdata/add.wasm
 var addWasm []byte
 
 //go:embed testdata/test.tar.gz
 var tarGz []byte
 
+//go:embed testdata/test.tar
+var tarUncompressed []byte
+
+//go:embed testdata/test.tar.zst
+var tarZst []byte
+
 func TestReadFilesystemLayer(t *testing.T) {
+	// readHello verifies the contents of "testdata/test.tar", regardless of compression.
+	readHello := func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+		if mode.IsDir() { // "./" and "./hello/"
+			return nil
+		}
+		require.Equal(t, "./hello/README.txt", name)
+		require.Equal(t, int64(6), size)
+		require.Equal(t, fs.FileMode(0o644), mode)
+		require.NotZero(t, modTime.Unix())
+
+		b, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "hello\n", string(b))
+
+		return nil
+	}
+
 	tests := []struct {
 		name, platform     string
 		layer              filesystemLayer
@@ -448,12 +1117,13 @@ func TestReadFilesystemLayer(t *testing.T) {
 		{
 			name: "tar.gz",
 			layer: filesystemLayer{
-				url:       "https://test/v2/user/repo/blobs/sha256:68cf5c71735e492dc26366a69455c30b52e0787ebb8604909f77741f19883aeb",
+				url:       "https://test/v2/user/repo/blobs/sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a",
+				digest:    "sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a",
 				mediaType: api.MediaTypeDockerImageLayer,
 				size:      int64(len(tarGz)),
 				createdBy: `COPY hello / # buildkit`,
 			},
-			expectedRequests: []string{`GET /v2/user/repo/blobs/sha256:68cf5c71735e492dc26366a69455c30b52e0787ebb8604909f77741f19883aeb HTTP/1.1
+			expectedRequests: []string{`GET /v2/user/repo/blobs/sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a HTTP/1.1
 Host: test
 Accept: application/vnd.docker.image.rootfs.diff.tar.gzip
 
@@ -461,35 +1131,59 @@ Accept: application/vnd.docker.image.rootfs.diff.tar.gzip
 
 			responseMediaTypes: []string{api.MediaTypeDockerImageLayer},
 			responseBodies:     [][]byte{tarGz},
-			expected: func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error {
-				require.Equal(t, "./hello/README.txt", name)
-				require.Equal(t, int64(6), size)
-				require.Equal(t, fs.FileMode(0o644), mode)
-				require.NotZero(t, modTime.Unix())
-
-				b, err := io.ReadAll(reader)
-				require.NoError(t, err)
-				require.Equal(t, "hello\n", string(b))
+			expected:           readHello,
+		},
+		{
+			name: "tar",
+			layer: filesystemLayer{
+				url:       "https://test/v2/user/repo/blobs/" + digest.FromBytes(tarUncompressed),
+				digest:    digest.FromBytes(tarUncompressed),
+				mediaType: api.MediaTypeOCIImageLayerUncompressed,
+				size:      int64(len(tarUncompressed)),
+			},
+			expectedRequests: []string{`GET /v2/user/repo/blobs/` + digest.FromBytes(tarUncompressed) + ` HTTP/1.1
+Host: test
+Accept: application/vnd.oci.image.layer.v1.tar
 
-				return nil
+`},
+			responseMediaTypes: []string{api.MediaTypeOCIImageLayerUncompressed},
+			responseBodies:     [][]byte{tarUncompressed},
+			expected:           readHello,
+		},
+		{
+			name: "tar.zst",
+			layer: filesystemLayer{
+				url:       "https://test/v2/user/repo/blobs/" + digest.FromBytes(tarZst),
+				digest:    digest.FromBytes(tarZst),
+				mediaType: api.MediaTypeOCIImageLayerZstd,
+				size:      int64(len(tarZst)),
 			},
+			expectedRequests: []string{`GET /v2/user/repo/blobs/` + digest.FromBytes(tarZst) + ` HTTP/1.1
+Host: test
+Accept: application/vnd.oci.image.layer.v1.tar+zstd
+
+`},
+			responseMediaTypes: []string{api.MediaTypeOCIImageLayerZstd},
+			responseBodies:     [][]byte{tarZst},
+			expected:           readHello,
 		},
 		{
 			name: "wasm",
 			layer: filesystemLayer{
-				url:       "https://test/v2/user/repo/blobs/sha256:3daa3dac086bd443acce56ffceb906993b50c5838b4489af4cd2f1e2f13af03b",
+				url:       "https://test/v2/user/repo/blobs/sha256:f61fd62f57c41269c3c23f360eeaf1090b1db9c38651106674d48bc65dba88ba",
+				digest:    "sha256:f61fd62f57c41269c3c23f360eeaf1090b1db9c38651106674d48bc65dba88ba",
 				mediaType: api.MediaTypeModuleWasmImageLayer,
 				size:      int64(len(addWasm)),
 				fileName:  "add.wasm",
 			},
-			expectedRequests: []string{`GET /v2/user/repo/blobs/sha256:3daa3dac086bd443acce56ffceb906993b50c5838b4489af4cd2f1e2f13af03b HTTP/1.1
+			expectedRequests: []string{`GET /v2/user/repo/blobs/sha256:f61fd62f57c41269c3c23f360eeaf1090b1db9c38651106674d48bc65dba88ba HTTP/1.1
 Host: test
 Accept: application/vnd.module.wasm.content.layer.v1+wasm
 
 `},
 			responseMediaTypes: []string{api.MediaTypeModuleWasmImageLayer},
 			responseBodies:     [][]byte{addWasm},
-			expected: func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error {
+			expected: func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
 				require.Equal(t, "add.wasm", name)
 				require.Equal(t, int64(len(addWasm)), size)
 				require.Equal(t, fs.FileMode(0o644), mode)
@@ -503,10 +1197,32 @@ Accept: application/vnd.module.wasm.content.layer.v1+wasm
 				return nil
 			},
 		},
+		{
+			name: "tar.gz digest mismatch",
+			layer: filesystemLayer{
+				url:       "https://test/v2/user/repo/blobs/" + digest.FromBytes(addWasm),
+				digest:    digest.FromBytes(addWasm),
+				mediaType: api.MediaTypeDockerImageLayer,
+				size:      int64(len(tarGz)),
+			},
+			expectedRequests: []string{`GET /v2/user/repo/blobs/` + digest.FromBytes(addWasm) + ` HTTP/1.1
+Host: test
+Accept: application/vnd.docker.image.rootfs.diff.tar.gzip
+
+`},
+			responseMediaTypes: []string{api.MediaTypeDockerImageLayer},
+			responseBodies:     [][]byte{tarGz},
+			expected: func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+				return nil
+			},
+			expectedErr: "invalid layer from https://test/v2/user/repo/blobs/" + digest.FromBytes(addWasm) +
+				": digest mismatch: expected " + digest.FromBytes(addWasm) + ", but was " + digest.FromBytes(tarGz),
+		},
 		{
 			name: "wasm missing name",
 			layer: filesystemLayer{
 				url:       imageTrivy.filesystemLayers[0].url,
+				digest:    imageTrivy.filesystemLayers[0].digest,
 				mediaType: imageTrivy.filesystemLayers[0].mediaType,
 			},
 			expectedRequests: []string{`GET /v2/user/repo/blobs/sha256:3daa3dac086bd443acce56ffceb906993b50c5838b4489af4cd2f1e2f13af03b HTTP/1.1
@@ -516,7 +1232,7 @@ Accept: application/vnd.module.wasm.content.layer.v1+wasm
 `},
 			responseMediaTypes: []string{api.MediaTypeModuleWasmImageLayer},
 			responseBodies:     [][]byte{addWasm},
-			expected: func(name string, size int64, mode os.FileMode, modTime time.Time, reader io.Reader) error {
+			expected: func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
 				t.Fatal("unexpected to call file when missing name")
 				return nil
 			},
@@ -540,6 +1256,11 @@ Accept: application/vnd.module.wasm.content.layer.v1+wasm
 			err = r.ReadFilesystemLayer(ctx, tc.layer, tc.expected)
 			if tc.expectedErr != "" {
 				require.EqualError(t, err, tc.expectedErr)
+				if strings.Contains(tc.expectedErr, "digest mismatch") {
+					var mismatch *api.DigestMismatchError
+					require.ErrorAs(t, err, &mismatch)
+					require.Equal(t, tc.layer.digest, mismatch.Expected)
+				}
 			} else {
 				require.NoError(t, err)
 			}
@@ -547,12 +1268,188 @@ Accept: application/vnd.module.wasm.content.layer.v1+wasm
 	}
 }
 
+func TestReadLayer_Types(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	modTime := time.Unix(1620791609, 0)
+	for _, th := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr/lib/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "usr/lib/libfoo.so.1", Mode: 0o755, Size: 3},
+		{Typeflag: tar.TypeSymlink, Name: "usr/lib/libfoo.so", Linkname: "libfoo.so.1", Mode: 0o777},
+		{Typeflag: tar.TypeLink, Name: "usr/lib/libbar.so.1", Linkname: "usr/lib/libfoo.so.1", Mode: 0o755},
+		{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0o644},
+		{Typeflag: tar.TypeDir, Name: "Files/", Mode: 0}, // windows
+	} {
+		th.ModTime = modTime
+		require.NoError(t, tw.WriteHeader(th))
+		if th.Size > 0 {
+			_, err := tw.Write([]byte("foo"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	type entry struct {
+		name     string
+		mode     os.FileMode
+		linkName string
+	}
+	var entries []entry
+	layer := filesystemLayer{mediaType: api.MediaTypeOCIImageLayerUncompressed}
+	err := readLayer(&buf, layer, func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+		entries = append(entries, entry{name, mode, linkName})
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []entry{
+		{"usr/lib/", fs.ModeDir | 0o755, ""},
+		{"usr/lib/libfoo.so.1", 0o755, ""},
+		{"usr/lib/libfoo.so", fs.ModeSymlink | 0o777, "libfoo.so.1"},
+		{"usr/lib/libbar.so.1", 0o755, "usr/lib/libfoo.so.1"},
+		{"Files/", fs.ModeDir | 0o755, ""},
+	}, entries)
+}
+
+const ociLayoutDir = "testdata/oci-layout"
+
+var imageOCILayout = image{
+	url:               "oci:" + ociLayoutDir + "/manifests/sha256:7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+	platform:          "linux/amd64",
+	manifestDigest:    "sha256:7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+	manifestMediaType: api.MediaTypeOCIImageManifest,
+	filesystemLayers: []filesystemLayer{
+		{
+			url:       "oci:" + ociLayoutDir + "/blobs/sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a",
+			digest:    "sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a",
+			diffID:    "sha256:02fbe9739782164b3c61b854a136a0d20613c5240d990d5b32441a1d53049846",
+			mediaType: api.MediaTypeOCIImageLayer,
+			size:      188,
+			createdBy: "COPY hello /hello # buildkit",
+		},
+	},
+}
+
+func TestOCILayout(t *testing.T) {
+	tests := []struct {
+		name, reference, expectedErr string
+		expected                     api.Image
+	}{
+		{
+			name:      "tag",
+			reference: "oci:" + ociLayoutDir + ":v1.0",
+			expected: image{
+				url:               "oci:" + ociLayoutDir + "/manifests/v1.0",
+				platform:          imageOCILayout.platform,
+				manifestDigest:    imageOCILayout.manifestDigest,
+				manifestMediaType: imageOCILayout.manifestMediaType,
+				filesystemLayers:  imageOCILayout.filesystemLayers,
+			},
+		},
+		{
+			name:      "only image",
+			reference: "oci:" + ociLayoutDir,
+			expected: image{
+				url:               "oci:" + ociLayoutDir + "/manifests/",
+				platform:          imageOCILayout.platform,
+				manifestDigest:    imageOCILayout.manifestDigest,
+				manifestMediaType: imageOCILayout.manifestMediaType,
+				filesystemLayers:  imageOCILayout.filesystemLayers,
+			},
+		},
+		{
+			name:      "digest",
+			reference: "oci:" + ociLayoutDir + "@sha256:7dfc955cecdccaf486c6144c20177a84a543e35009e9880087c07052c3635201",
+			expected:  imageOCILayout,
+		},
+		{
+			name:        "unknown tag",
+			reference:   "oci:" + ociLayoutDir + ":v2.0",
+			expectedErr: `received 404 status code from "oci:` + ociLayoutDir + `/manifests/v2.0"`,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ref := reference.MustParse(tc.reference)
+			r, err := New(ctx, ref.Domain())
+			require.NoError(t, err)
+
+			img, err := r.GetImage(ctx, ref, "")
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, img)
+
+			var names []string
+			err = r.ReadFilesystemLayer(ctx, img.FilesystemLayer(0), func(name string, size int64, mode os.FileMode, modTime time.Time, linkName string, reader io.Reader) error {
+				names = append(names, name)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{"./", "./hello/", "./hello/README.txt"}, names)
+		})
+	}
+}
+
+func TestFilesystemLayer_String(t *testing.T) {
+	url := "https://test/v2/user/repo/blobs/sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a"
+	tests := []struct {
+		name     string
+		layer    filesystemLayer
+		expected string
+	}{
+		{
+			name:     "no diff ID",
+			layer:    filesystemLayer{url: url, size: 188, createdBy: "COPY hello /hello # buildkit"},
+			expected: url + " size=188\nCreatedBy: COPY hello /hello # buildkit",
+		},
+		{
+			name:     "diff ID",
+			layer:    imageOCILayout.filesystemLayers[0],
+			expected: "oci:" + ociLayoutDir + "/blobs/sha256:dd167ad11c374d3080287eff4c7009a990b1a650f86d6fe5fce2699eb0bdaf6a size=188 diffID=sha256:02fbe9739782164b3c61b854a136a0d20613c5240d990d5b32441a1d53049846\nCreatedBy: COPY hello /hello # buildkit",
+		},
+		{
+			name:     "diff ID same as digest",
+			layer:    filesystemLayer{url: url, digest: "sha256:abc", diffID: "sha256:abc", size: 188},
+			expected: url + " size=188\nCreatedBy: ",
+		},
+		{
+			name: "annotations",
+			layer: filesystemLayer{url: url, size: 188, annotations: map[string]string{
+				opencontainersImageTitle:           "add.wasm",
+				"org.opencontainers.image.version": "v1.0",
+			}},
+			expected: url + " size=188\nCreatedBy: \nAnnotations: org.opencontainers.image.title=add.wasm, org.opencontainers.image.version=v1.0",
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc // pin! see https://github.com/kyoh86/scopelint for why
+
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.layer.String())
+		})
+	}
+}
+
+func TestOCILayout_NotALayout(t *testing.T) {
+	_, err := New(context.Background(), "oci:testdata/json")
+	require.EqualError(t, err, "testdata/json is not an OCI image layout: stat testdata/json/oci-layout: no such file or directory")
+}
+
 type mock struct {
 	t                  *testing.T
 	i                  int
 	requests           []string
 	responseMediaTypes []string
 	responseBodies     [][]byte
+	// responseHeaders are optional, in addition to the Content-Type.
+	responseHeaders []http.Header
 }
 
 func (m *mock) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -565,14 +1462,42 @@ func (m *mock) RoundTrip(req *http.Request) (*http.Response, error) {
 	require.Equal(m.t, m.requests[m.i], strings.ReplaceAll(raw.String(), "\r\n", "\n"))
 
 	body := m.responseBodies[m.i]
-	mediaType := m.responseMediaTypes[m.i]
+	header := http.Header{"Content-Type": []string{m.responseMediaTypes[m.i]}}
+	if m.i < len(m.responseHeaders) {
+		for k, v := range m.responseHeaders[m.i] {
+			header[k] = v
+		}
+	}
 	m.i++
 	return &http.Response{
 		Status: "200 OK", StatusCode: http.StatusOK,
-		Header: http.Header{"Content-Type": []string{mediaType}}, Body: io.NopCloser(bytes.NewReader(body)),
+		Header: header, Body: io.NopCloser(bytes.NewReader(body)),
 	}, nil
 }
 
+func TestRequireValidPlatform_Errors(t *testing.T) {
+	platforms := map[string]string{"linux/amd64": "", "linux/arm/v6": "", "linux/arm/v7": ""}
+
+	_, err := requireValidPlatform("", platforms)
+	var ambiguous *api.AmbiguousPlatformError
+	require.ErrorAs(t, err, &ambiguous)
+	require.Equal(t, []string{"linux/amd64", "linux/arm/v6", "linux/arm/v7"}, ambiguous.Platforms)
+
+	_, err = requireValidPlatform("linux/arm", platforms)
+	require.ErrorAs(t, err, &ambiguous)
+	require.Equal(t, []string{"linux/arm/v6", "linux/arm/v7"}, ambiguous.Platforms)
+
+	_, err = requireValidPlatform("windows/amd64", platforms)
+	var unsupported *api.UnsupportedPlatformError
+	require.ErrorAs(t, err, &unsupported)
+	require.Equal(t, "windows/amd64", unsupported.Platform)
+	require.Equal(t, []string{"linux/amd64", "linux/arm/v6", "linux/arm/v7"}, unsupported.Platforms)
+	require.ErrorIs(t, err, api.ErrNotFound)
+
+	_, err = requireValidPlatform("", map[string]string{})
+	require.ErrorIs(t, err, api.ErrNoPlatform)
+}
+
 func TestSortedKeyString(t *testing.T) {
 	tests := []struct {
 		name     string